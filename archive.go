@@ -8,31 +8,50 @@
 package knoxite
 
 import (
+	"errors"
 	"io"
 	"os"
 )
 
+// Error declarations.
+var (
+	ErrHardlinkTargetMissing  = errors.New("hardlinked file is missing from the snapshot")
+	ErrSpecialFileUnsupported = errors.New("device nodes, FIFOs and sockets can't be restored on this platform")
+)
+
 // Types of archives.
 const (
-	File      = iota // A File
-	Directory        // A Directory
-	SymLink          // A SymLink
+	File        = iota // A File
+	Directory          // A Directory
+	SymLink            // A SymLink
+	CharDevice         // A character device node
+	BlockDevice        // A block device node
+	FIFO               // A named pipe
+	Socket             // A unix domain socket
 )
 
 // Archive contains all metadata belonging to a file/directory.
 type Archive struct {
-	Path        string      `json:"path"`               // Where in filesystem does this belong to
-	PointsTo    string      `json:"pointsto,omitempty"` // If this is a SymLink, where does it point to
-	Mode        os.FileMode `json:"mode"`               // file mode bits
-	ModTime     int64       `json:"modtime"`            // modification time
-	Size        uint64      `json:"size"`               // size
-	StorageSize uint64      `json:"storagesize"`        // size in storage
-	UID         uint32      `json:"uid"`                // owner
-	GID         uint32      `json:"gid"`                // group
-	Chunks      []Chunk     `json:"chunks,omitempty"`   // data chunks
-	Encrypted   uint16      `json:"encrypted"`          // encryption type
-	Compressed  uint16      `json:"compressed"`         // compression type
-	Type        uint8       `json:"type"`               // Is this a File, Directory or SymLink
+	Path          string      `json:"path"`                // Where in filesystem does this belong to
+	PointsTo      string      `json:"pointsto,omitempty"`  // If this is a SymLink, where does it point to
+	Mode          os.FileMode `json:"mode"`                // file mode bits
+	ModTime       int64       `json:"modtime"`             // modification time
+	ChangeTime    int64       `json:"ctime,omitempty"`     // inode change time in nanoseconds
+	Inode         uint64      `json:"inode,omitempty"`     // inode number
+	Size          uint64      `json:"size"`                // size
+	StorageSize   uint64      `json:"storagesize"`         // size in storage
+	UID           uint32      `json:"uid"`                 // owner
+	GID           uint32      `json:"gid"`                 // group
+	Chunks        []Chunk     `json:"chunks,omitempty"`    // data chunks
+	Encrypted     uint16      `json:"encrypted"`           // encryption type
+	Compressed    uint16      `json:"compressed"`          // compression type
+	KeyGeneration uint        `json:"key_generation"`      // oldest key generation any of the chunks is encrypted with
+	Type          uint8       `json:"type"`                // Is this a File, Directory, SymLink or special file
+	DevMajor      uint32      `json:"dev_major,omitempty"` // major device number of a CharDevice or BlockDevice
+	DevMinor      uint32      `json:"dev_minor,omitempty"` // minor device number of a CharDevice or BlockDevice
+
+	XAttrs map[string][]byte `json:"xattrs,omitempty"` // extended attributes, including ACLs & capabilities
+	LinkTo string            `json:"linkto,omitempty"` // If this File is a hardlink, the path of the archive containing its data
 }
 
 // ArchiveResult wraps Archive and an error.
@@ -42,6 +61,15 @@ type ArchiveResult struct {
 	Error   error
 }
 
+// IsSpecial returns true for device nodes, FIFOs and sockets.
+func (arc *Archive) IsSpecial() bool {
+	switch arc.Type {
+	case CharDevice, BlockDevice, FIFO, Socket:
+		return true
+	}
+	return false
+}
+
 // IndexOfChunk returns the slice-index for a specific chunk number.
 func (arc *Archive) IndexOfChunk(chunkNum uint) (int, error) {
 	for i, chunk := range arc.Chunks {
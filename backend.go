@@ -60,6 +60,15 @@ type Backend interface {
 	LoadRepository() ([]byte, error)
 	// SaveRepository stores the metadata for a repository
 	SaveRepository(data []byte) error
+
+	// ListLocks returns the IDs of all locks
+	ListLocks() ([]string, error)
+	// LoadLock loads a lock
+	LoadLock(id string) ([]byte, error)
+	// SaveLock stores a lock
+	SaveLock(id string, data []byte) error
+	// DeleteLock deletes a lock
+	DeleteLock(id string) error
 }
 
 // Error declarations.
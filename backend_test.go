@@ -7,7 +7,14 @@
 
 package knoxite
 
-import "testing"
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
 
 func TestBackendURLError(t *testing.T) {
 	// Go 1.6 & up only
@@ -18,3 +25,58 @@ func TestBackendURLError(t *testing.T) {
 		t.Errorf("Expected an error, got %v", err)
 	}
 }
+
+func TestStoreChunkDistinctBackends(t *testing.T) {
+	backend := BackendManager{}
+	var dirs []string
+	for i := 0; i < 3; i++ {
+		dir, err := ioutil.TempDir("", "knoxite")
+		if err != nil {
+			t.Errorf("Failed creating temporary dir for backend: %s", err)
+			return
+		}
+		defer os.RemoveAll(dir)
+
+		be, err := BackendFromURL(dir)
+		if err != nil {
+			t.Errorf("Failed creating backend: %s", err)
+			return
+		}
+		backend.AddBackend(&be)
+		dirs = append(dirs, dir)
+	}
+
+	// store the three parts of many chunks at the same time
+	chunks := 300
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < chunks; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			data := [][]byte{{byte(i), 0}, {byte(i), 1}, {byte(i), 2}}
+			chunk := Chunk{
+				Hash:        fmt.Sprintf("%064x", i),
+				DataParts:   2,
+				ParityParts: 1,
+				Data:        &data,
+			}
+			if _, err := backend.StoreChunk(chunk); err != nil {
+				t.Errorf("Failed storing chunk: %s", err)
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	for i := 0; i < chunks; i++ {
+		hash := fmt.Sprintf("%064x", i)
+		for _, dir := range dirs {
+			parts, _ := filepath.Glob(filepath.Join(dir, chunksDirname, SubDirForChunk(hash), hash+".*"))
+			if len(parts) != 1 {
+				t.Errorf("Expected 1 part of chunk %d on backend %s, got %d", i, dir, len(parts))
+			}
+		}
+	}
+}
@@ -7,7 +7,11 @@
 
 package knoxite
 
-import "errors"
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
 
 const (
 	retries = 3
@@ -17,7 +21,8 @@ const (
 type BackendManager struct {
 	Backends []*Backend
 
-	lastUsedBackend int
+	lastUsedBackend uint32
+	uploads         []chan struct{} // limits concurrent uploads per backend, if set
 }
 
 // Error declarations.
@@ -31,6 +36,9 @@ var (
 	ErrStoreSnapshotFailed   = errors.New("storing snapshot failed")
 	ErrStoreChunkIndexFailed = errors.New("storing chunk-index failed")
 	ErrStoreRepositoryFailed = errors.New("storing repository failed")
+	ErrLoadLockFailed        = errors.New("unable to load lock from any storage backend")
+	ErrStoreLockFailed       = errors.New("storing lock failed")
+	ErrDeleteLockFailed      = errors.New("unable to delete lock from any storage backend")
 )
 
 // AddBackend adds a backend.
@@ -50,6 +58,10 @@ func (backend *BackendManager) Locations() []string {
 
 // LoadChunk loads a Chunk from backends.
 func (backend *BackendManager) LoadChunk(chunk Chunk, part uint) ([]byte, error) {
+	if int(part) < len(chunk.Parts) {
+		return backend.loadPackedPart(chunk.Parts[part])
+	}
+
 	for _, be := range backend.Backends {
 		for i := 0; i < retries; i++ {
 			b, err := (*be).LoadChunk(chunk.Hash, part, chunk.DataParts)
@@ -62,37 +74,81 @@ func (backend *BackendManager) LoadChunk(chunk Chunk, part uint) ([]byte, error)
 	return []byte{}, ErrLoadChunkFailed
 }
 
-// StoreChunk stores a single Chunk on backends.
+// limitUploads restricts the number of chunks being uploaded to each backend
+// at the same time.
+func (backend *BackendManager) limitUploads(n int) {
+	backend.uploads = make([]chan struct{}, len(backend.Backends))
+	for i := range backend.uploads {
+		backend.uploads[i] = make(chan struct{}, n)
+	}
+}
+
+// StoreChunk stores a single Chunk on backends. It's safe to call StoreChunk
+// concurrently, the parts of a chunk get uploaded in parallel.
 func (backend *BackendManager) StoreChunk(chunk Chunk) (size uint64, err error) {
-	for i, data := range *chunk.Data {
-		// Use storage backends in a round robin fashion to store chunks
-		backend.lastUsedBackend++
-		if backend.lastUsedBackend+1 > len(backend.Backends) {
-			backend.lastUsedBackend = 0
+	parts := *chunk.Data
+	sizes := make([]uint64, len(parts))
+	errs := make([]error, len(parts))
+
+	// Use storage backends in a round robin fashion to store chunks
+	idxs := backend.nextBackends(len(parts))
+
+	var wg sync.WaitGroup
+	for i, data := range parts {
+		wg.Add(1)
+		go func(i, idx int, data []byte) {
+			defer wg.Done()
+			sizes[i], errs[i] = backend.storeChunkPart(idx, chunk.Hash, uint(i), chunk.DataParts, data)
+		}(i, idxs[i], data)
+	}
+	wg.Wait()
+
+	for i := range parts {
+		if errs[i] != nil {
+			return 0, errs[i]
 		}
+		if sizes[i] > size {
+			size = sizes[i]
+		}
+	}
 
-		be := backend.Backends[backend.lastUsedBackend]
+	return size, nil
+}
 
-		var n uint64
-		var err error
-		for j := 0; j < retries; j++ {
-			n, err = (*be).StoreChunk(chunk.Hash, uint(i), chunk.DataParts, data)
-			if err != nil {
-				// retry
-				continue
-			}
+// nextBackends returns the indices of the backends the n parts of a chunk
+// should be stored on. The parts get a contiguous range of backends reserved,
+// so they end up on different backends even when chunks get stored
+// concurrently, as long as there are enough backends.
+func (backend *BackendManager) nextBackends(n int) []int {
+	end := atomic.AddUint32(&backend.lastUsedBackend, uint32(n))
+	start := end - uint32(n)
+
+	idxs := make([]int, n)
+	for i := range idxs {
+		idxs[i] = int((start + uint32(i)) % uint32(len(backend.Backends)))
+	}
+	return idxs
+}
 
-			if n > size {
-				size = n
-			}
+// storeChunkPart stores a part of a chunk on the backend with index idx.
+func (backend *BackendManager) storeChunkPart(idx int, shasum string, part, totalParts uint, data []byte) (n uint64, err error) {
+	if idx < len(backend.uploads) {
+		backend.uploads[idx] <- struct{}{}
+		defer func() {
+			<-backend.uploads[idx]
+		}()
+	}
+
+	be := backend.Backends[idx]
+	for j := 0; j < retries; j++ {
+		n, err = (*be).StoreChunk(shasum, part, totalParts, data)
+		if err == nil {
 			break
 		}
-		if err != nil {
-			return 0, err
-		}
+		// retry
 	}
 
-	return size, nil
+	return n, err
 }
 
 // DeleteChunk deletes a single Chunk.
@@ -216,3 +272,82 @@ func (backend *BackendManager) SaveRepository(b []byte) error {
 
 	return nil
 }
+
+// ListLocks returns the IDs of all locks found on any storage backend.
+func (backend *BackendManager) ListLocks() ([]string, error) {
+	ids := []string{}
+	found := make(map[string]bool)
+	for _, be := range backend.Backends {
+		var l []string
+		var err error
+		for i := 0; i < retries; i++ {
+			l, err = (*be).ListLocks()
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return ids, err
+		}
+
+		for _, id := range l {
+			if !found[id] {
+				found[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	return ids, nil
+}
+
+// LoadLock loads a lock.
+func (backend *BackendManager) LoadLock(id string) ([]byte, error) {
+	for _, be := range backend.Backends {
+		for i := 0; i < retries; i++ {
+			b, err := (*be).LoadLock(id)
+			if err == nil {
+				return b, err
+			}
+		}
+	}
+
+	return []byte{}, ErrLoadLockFailed
+}
+
+// SaveLock stores a lock on all storage backends.
+func (backend *BackendManager) SaveLock(id string, b []byte) error {
+	for _, be := range backend.Backends {
+		var err error
+		for i := 0; i < retries; i++ {
+			err = (*be).SaveLock(id, b)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteLock deletes a lock from all storage backends.
+func (backend *BackendManager) DeleteLock(id string) error {
+	deleted := false
+	for _, be := range backend.Backends {
+		for i := 0; i < retries; i++ {
+			err := (*be).DeleteLock(id)
+			if err == nil {
+				deleted = true
+				break
+			}
+		}
+	}
+
+	if !deleted {
+		return ErrDeleteLockFailed
+	}
+	return nil
+}
@@ -0,0 +1,565 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// Error declarations.
+var (
+	ErrChunkListingUnsupported = errors.New("storage backend can't list its chunks")
+)
+
+// A StoredChunk is a chunk part or pack file found on a storage backend.
+type StoredChunk struct {
+	Hash       string
+	Part       uint
+	TotalParts uint
+	Size       uint64
+}
+
+// BackendChunkLister can be implemented by backends which are able to list
+// all the chunk parts and pack files they store.
+type BackendChunkLister interface {
+	// ListChunks returns all stored chunk parts and pack files
+	ListChunks() ([]StoredChunk, error)
+}
+
+// CheckOptions holds all the options for checking a repository.
+type CheckOptions struct {
+	// ReadData loads and verifies the content of all chunks
+	ReadData bool
+	// Subset and Subsets limit reading data to the n-th of m subsets of all
+	// chunks, e.g. 1 and 10 to read roughly a tenth of them
+	Subset  uint
+	Subsets uint
+}
+
+// A CheckIssue is a missing, orphaned or corrupt chunk part.
+type CheckIssue struct {
+	Chunk string `json:"chunk"`
+	// Part is -1 if the issue concerns the entire chunk
+	Part       int      `json:"part"`
+	TotalParts uint     `json:"total_parts,omitempty"`
+	Pack       string   `json:"pack,omitempty"`
+	Backend    string   `json:"backend,omitempty"`
+	Snapshots  []string `json:"snapshots,omitempty"`
+	Reason     string   `json:"reason"`
+}
+
+// A CheckReport is the result of a repository check.
+type CheckReport struct {
+	Snapshots  int `json:"snapshots"`
+	Chunks     int `json:"chunks"`
+	Parts      int `json:"parts"`
+	ReadChunks int `json:"read_chunks"`
+
+	Missing  []CheckIssue `json:"missing"`
+	Orphaned []CheckIssue `json:"orphaned"`
+	Corrupt  []CheckIssue `json:"corrupt"`
+	Errors   []string     `json:"errors"`
+	// Warnings are about checks which couldn't be performed
+	Warnings []string `json:"warnings"`
+}
+
+// OK returns true if the check didn't find any problems.
+func (r *CheckReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Orphaned) == 0 && len(r.Corrupt) == 0 && len(r.Errors) == 0
+}
+
+// checkedChunk is a chunk known to the chunk-index or referenced by snapshots.
+type checkedChunk struct {
+	hash        string
+	dataParts   uint
+	parityParts uint
+	size        int
+	parts       []PackLocation
+	indexed     bool
+
+	// set for chunks referenced by snapshots
+	chunk     *Chunk
+	archive   *Archive
+	snapshots []string
+}
+
+// partName returns the name a part of the chunk is stored under, unless it
+// is packed.
+func (chunk *checkedChunk) partName(part uint) string {
+	return storedName(chunk.hash, part, chunk.dataParts)
+}
+
+// partSize returns the size of an unpacked part of the chunk.
+func (chunk *checkedChunk) partSize() uint64 {
+	if chunk.dataParts <= 1 {
+		return uint64(chunk.size)
+	}
+	// parts are as large as reedsolomon's shards
+	return uint64((chunk.size + int(chunk.dataParts) - 1) / int(chunk.dataParts))
+}
+
+// issue returns an issue concerning a part of chunk.
+func (chunk *checkedChunk) issue(part int, reason string) CheckIssue {
+	issue := CheckIssue{
+		Chunk:      chunk.hash,
+		Part:       part,
+		TotalParts: chunk.dataParts,
+		Snapshots:  chunk.snapshots,
+		Reason:     reason,
+	}
+	if part >= 0 && part < len(chunk.parts) {
+		issue.Pack = chunk.parts[part].Pack
+	}
+	return issue
+}
+
+// storedName returns the name of a stored chunk part or pack file.
+func storedName(hash string, part, totalParts uint) string {
+	return hash + "." + strconv.FormatUint(uint64(part), 10) + "_" + strconv.FormatUint(uint64(totalParts), 10)
+}
+
+// checker collects the issues found while checking a repository.
+type checker struct {
+	repository *Repository
+	opts       CheckOptions
+	report     *CheckReport
+	chunks     map[string]*checkedChunk
+
+	// chunk parts already reported as missing or corrupt
+	reported map[string]bool
+}
+
+func (c *checker) missing(issue CheckIssue) {
+	if c.markReported(issue) {
+		c.report.Missing = append(c.report.Missing, issue)
+	}
+}
+
+func (c *checker) corrupt(issue CheckIssue) {
+	if c.markReported(issue) {
+		c.report.Corrupt = append(c.report.Corrupt, issue)
+	}
+}
+
+func (c *checker) errorf(format string, a ...interface{}) {
+	c.report.Errors = append(c.report.Errors, fmt.Sprintf(format, a...))
+}
+
+// markReported returns false if the part of an issue has been reported
+// before. Issues found while reading data don't know the backend of a part,
+// so they are only reported if the part hasn't been reported on any backend.
+func (c *checker) markReported(issue CheckIssue) bool {
+	key := issue.Chunk + ":" + strconv.Itoa(issue.Part)
+	if issue.Backend == "" {
+		if c.reported[key] {
+			return false
+		}
+	} else {
+		backendKey := key + ":" + issue.Backend
+		if c.reported[backendKey] {
+			return false
+		}
+		c.reported[backendKey] = true
+	}
+
+	c.reported[key] = true
+	return true
+}
+
+// CheckRepository checks the integrity of a repository: all snapshots must be
+// loadable, every chunk they reference must be in the chunk-index, and every
+// part of the indexed chunks must be stored with the right size. Stored parts
+// nobody refers to are reported as orphaned. With opts.ReadData, the content
+// of the chunks referenced by snapshots gets verified as well, including
+// their parity parts. The returned report is complete once the progress
+// channel got closed.
+func CheckRepository(repository Repository, opts CheckOptions) (<-chan Progress, *CheckReport) {
+	prog := make(chan Progress)
+	report := &CheckReport{
+		Missing:  []CheckIssue{},
+		Orphaned: []CheckIssue{},
+		Corrupt:  []CheckIssue{},
+		Errors:   []string{},
+		Warnings: []string{},
+	}
+	c := &checker{
+		repository: &repository,
+		opts:       opts,
+		report:     report,
+		chunks:     make(map[string]*checkedChunk),
+		reported:   make(map[string]bool),
+	}
+
+	go func() {
+		defer close(prog)
+
+		c.loadMetadata()
+		c.checkStorage()
+		if opts.ReadData {
+			c.readData(prog)
+		}
+	}()
+
+	return prog, report
+}
+
+// loadMetadata loads the chunk-index and all snapshots and cross-references
+// them.
+func (c *checker) loadMetadata() {
+	var index ChunkIndex
+	b, err := c.repository.backend.LoadChunkIndex()
+	if err == nil {
+		err = c.repository.decodeMetadata(b, &index)
+	}
+	if err != nil {
+		c.errorf("unable to load chunk-index: %v", err)
+	}
+
+	for hash, item := range index.Chunks {
+		c.chunks[hash] = &checkedChunk{
+			hash:        hash,
+			dataParts:   item.DataParts,
+			parityParts: item.ParityParts,
+			size:        item.Size,
+			parts:       item.Parts,
+			indexed:     true,
+		}
+	}
+
+	snapshots := make(map[string]bool)
+	for _, volume := range c.repository.Volumes {
+		for _, id := range volume.Snapshots {
+			snapshots[id] = true
+
+			snapshot, err := volume.LoadSnapshot(id, c.repository)
+			if err != nil {
+				c.errorf("unable to load snapshot %s of volume %s: %v", id, volume.ID, err)
+				continue
+			}
+			c.report.Snapshots++
+
+			for _, archive := range snapshot.Archives {
+				for i := range archive.Chunks {
+					c.addReference(snapshot.ID, archive, &archive.Chunks[i])
+				}
+			}
+		}
+	}
+
+	for _, hash := range sortedChunkHashes(c.chunks) {
+		chunk := c.chunks[hash]
+		if !chunk.indexed {
+			c.missing(chunk.issue(-1, "not in chunk-index"))
+			continue
+		}
+
+		for _, id := range index.Chunks[hash].Snapshots {
+			if !snapshots[id] {
+				c.errorf("chunk %s: chunk-index refers to unknown snapshot %s", hash, id)
+			}
+		}
+	}
+
+	c.report.Chunks = len(c.chunks)
+}
+
+// addReference records that a snapshot refers to chunk.
+func (c *checker) addReference(snapshot string, archive *Archive, chunk *Chunk) {
+	cc, ok := c.chunks[chunk.Hash]
+	if !ok {
+		cc = &checkedChunk{
+			hash:        chunk.Hash,
+			dataParts:   chunk.DataParts,
+			parityParts: chunk.ParityParts,
+			size:        chunk.Size,
+			parts:       chunk.Parts,
+		}
+		c.chunks[chunk.Hash] = cc
+	}
+	if cc.chunk == nil {
+		cc.chunk = chunk
+		cc.archive = archive
+	}
+
+	for _, id := range cc.snapshots {
+		if id == snapshot {
+			return
+		}
+	}
+	cc.snapshots = append(cc.snapshots, snapshot)
+}
+
+// storedChunk is a chunk part or pack file found on a specific backend.
+type storedChunk struct {
+	StoredChunk
+	backend string
+}
+
+// checkStorage lists the chunks stored on all backends and compares them
+// with the expected chunk parts.
+func (c *checker) checkStorage() {
+	stored := make(map[string][]storedChunk)
+	complete := true
+	for _, be := range c.repository.backend.Backends {
+		location := (*be).Location()
+		lister, ok := (*be).(BackendChunkLister)
+		if !ok {
+			complete = false
+			c.report.Warnings = append(c.report.Warnings,
+				fmt.Sprintf("%s: %v", location, ErrChunkListingUnsupported))
+			continue
+		}
+
+		chunks, err := lister.ListChunks()
+		if err != nil {
+			complete = false
+			if errors.Is(err, ErrChunkListingUnsupported) {
+				c.report.Warnings = append(c.report.Warnings, fmt.Sprintf("%s: %v", location, err))
+			} else {
+				c.errorf("unable to list chunks on %s: %v", location, err)
+			}
+			continue
+		}
+		for _, sc := range chunks {
+			name := storedName(sc.Hash, sc.Part, sc.TotalParts)
+			stored[name] = append(stored[name], storedChunk{sc, location})
+		}
+	}
+	if !complete {
+		c.report.Warnings = append(c.report.Warnings,
+			"not all backends could be listed, missing parts are only detected when reading data")
+	}
+
+	expected := make(map[string]bool)
+	for _, hash := range sortedChunkHashes(c.chunks) {
+		chunk := c.chunks[hash]
+		if !chunk.indexed {
+			continue
+		}
+
+		for part := uint(0); part < chunk.dataParts+chunk.parityParts; part++ {
+			if int(part) < len(chunk.parts) && chunk.parts[part].Pack == "" {
+				// an unreferenced part whose pack file got deleted
+				continue
+			}
+			c.report.Parts++
+
+			if int(part) < len(chunk.parts) {
+				loc := chunk.parts[part]
+				name := storedName(loc.Pack, 0, 1)
+				expected[name] = true
+				c.checkStoredPart(chunk, part, stored[name], complete, func(size uint64) bool {
+					return loc.Offset+loc.Length <= size
+				}, "pack file too small")
+				continue
+			}
+
+			name := chunk.partName(part)
+			expected[name] = true
+			c.checkStoredPart(chunk, part, stored[name], complete, func(size uint64) bool {
+				return size == chunk.partSize()
+			}, "wrong size")
+		}
+	}
+
+	names := make([]string, 0, len(stored))
+	for name := range stored {
+		if !expected[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, sc := range stored[name] {
+			c.report.Orphaned = append(c.report.Orphaned, CheckIssue{
+				Chunk:      sc.Hash,
+				Part:       int(sc.Part),
+				TotalParts: sc.TotalParts,
+				Backend:    sc.backend,
+				Reason:     "not referenced by chunk-index",
+			})
+		}
+	}
+}
+
+// checkStoredPart checks the stored copies of a chunk part.
+func (c *checker) checkStoredPart(chunk *checkedChunk, part uint, copies []storedChunk, complete bool, valid func(size uint64) bool, reason string) {
+	if len(copies) == 0 {
+		if complete {
+			c.missing(chunk.issue(int(part), "not found on any backend"))
+		}
+		return
+	}
+
+	for _, sc := range copies {
+		if !valid(sc.Size) {
+			issue := chunk.issue(int(part), fmt.Sprintf("%s: %d bytes", reason, sc.Size))
+			issue.Backend = sc.backend
+			c.corrupt(issue)
+		}
+	}
+}
+
+// selected returns true if the data of chunk should be read.
+func (c *checker) selected(hash string) bool {
+	if c.opts.Subsets <= 1 {
+		return true
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(hash))
+	return uint(h.Sum32())%c.opts.Subsets == c.opts.Subset-1
+}
+
+// readData loads and verifies the chunks referenced by snapshots.
+func (c *checker) readData(prog chan<- Progress) {
+	var chunks []*checkedChunk
+	var total uint64
+	for _, hash := range sortedChunkHashes(c.chunks) {
+		chunk := c.chunks[hash]
+		if chunk.chunk != nil && c.selected(hash) {
+			chunks = append(chunks, chunk)
+			total += uint64(chunk.size)
+		}
+	}
+
+	p := Progress{
+		Timer: time.Now(),
+		TotalStatistics: Stats{
+			Size: total,
+		},
+	}
+	for _, chunk := range chunks {
+		p.Path = chunk.archive.Path
+		p.CurrentItemStats = Stats{
+			Size: uint64(chunk.size),
+		}
+		prog <- p
+
+		if chunk.parityParts > 0 {
+			c.readParityChunk(chunk)
+		} else {
+			c.readChunk(chunk)
+		}
+		c.report.ReadChunks++
+
+		p.CurrentItemStats.Transferred = uint64(chunk.size)
+		p.TotalStatistics.Transferred += uint64(chunk.size)
+		prog <- p
+	}
+}
+
+// readChunk verifies a chunk without parity parts.
+func (c *checker) readChunk(chunk *checkedChunk) {
+	b, err := c.repository.backend.LoadChunk(*chunk.chunk, 0)
+	if err != nil {
+		c.missing(chunk.issue(0, err.Error()))
+		return
+	}
+
+	_, err = decodeChunk(*c.repository, *chunk.archive, *chunk.chunk, b)
+	if err != nil {
+		c.corrupt(chunk.issue(0, err.Error()))
+	}
+}
+
+// readParityChunk verifies a chunk and all its parity parts. Corrupt parts
+// get identified by reconstructing the chunk without them.
+func (c *checker) readParityChunk(chunk *checkedChunk) {
+	enc, err := reedsolomon.New(int(chunk.dataParts), int(chunk.parityParts))
+	if err != nil {
+		c.corrupt(chunk.issue(-1, err.Error()))
+		return
+	}
+
+	shards := make([][]byte, chunk.dataParts+chunk.parityParts)
+	for i := range shards {
+		b, err := c.repository.backend.LoadChunk(*chunk.chunk, uint(i))
+		if err != nil {
+			c.missing(chunk.issue(i, err.Error()))
+			continue
+		}
+		if uint64(len(b)) != chunk.partSize() {
+			c.corrupt(chunk.issue(i, fmt.Sprintf("wrong size: %d bytes", len(b))))
+			continue
+		}
+		shards[i] = b
+	}
+
+	data, ok := c.joinShards(enc, chunk, shards, -1)
+	for i := 0; !ok && i < len(shards); i++ {
+		if shards[i] != nil {
+			data, ok = c.joinShards(enc, chunk, shards, i)
+		}
+	}
+	if !ok {
+		c.corrupt(chunk.issue(-1, "chunk can't be recovered"))
+		return
+	}
+
+	// compare all parts with the ones the recovered chunk results in
+	expected, err := redundantData(data, int(chunk.dataParts), int(chunk.parityParts))
+	if err != nil {
+		c.corrupt(chunk.issue(-1, err.Error()))
+		return
+	}
+	for i, shard := range shards {
+		if shard != nil && !bytes.Equal(shard, expected[i]) {
+			c.corrupt(chunk.issue(i, "content mismatch"))
+		}
+	}
+}
+
+// joinShards reconstructs and decodes a chunk from shards, leaving out the
+// shard with index skip. It returns the encoded chunk, if its content could
+// be verified.
+func (c *checker) joinShards(enc reedsolomon.Encoder, chunk *checkedChunk, shards [][]byte, skip int) ([]byte, bool) {
+	pars := make([][]byte, len(shards))
+	copy(pars, shards)
+	if skip >= 0 {
+		pars[skip] = nil
+	}
+
+	err := enc.ReconstructData(pars)
+	if err != nil {
+		return nil, false
+	}
+
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	err = enc.Join(w, pars, chunk.size)
+	if err != nil {
+		return nil, false
+	}
+	_ = w.Flush()
+
+	_, err = decodeChunk(*c.repository, *chunk.archive, *chunk.chunk, b.Bytes())
+	if err != nil {
+		return nil, false
+	}
+	return b.Bytes(), true
+}
+
+// sortedChunkHashes returns the hashes of chunks in a stable order.
+func sortedChunkHashes(chunks map[string]*checkedChunk) []string {
+	hashes := make([]string, 0, len(chunks))
+	for hash := range chunks {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
@@ -0,0 +1,215 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func checkRepository(t *testing.T, r Repository, opts CheckOptions) *CheckReport {
+	progress, report := CheckRepository(r, opts)
+	for p := range progress {
+		if p.Error != nil {
+			t.Errorf("Failed checking repository: %s", p.Error)
+		}
+	}
+	return report
+}
+
+// storedChunkFile returns the path of a chunk part stored in a local
+// repository.
+func storedChunkFile(dir, name string) string {
+	return filepath.Join(dir, chunksDirname, SubDirForChunk(name), name)
+}
+
+func flipByte(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	b[len(b)/2] ^= 0xff
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+func TestCheckRepository(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository(dir, testPassword)
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+	index, _ := OpenChunkIndex(&r)
+	snapshot := storePackedSnapshot(t, &r, vol, &index, []string{"check.go", "snapshot.go", "snapshot_test.go"})
+
+	report := checkRepository(t, r, CheckOptions{ReadData: true})
+	if !report.OK() {
+		t.Errorf("Expected an intact repository, got %+v", report)
+		return
+	}
+	if report.Snapshots != 1 || report.Chunks != len(index.Chunks) ||
+		report.Parts != len(index.Chunks) || report.ReadChunks != len(index.Chunks) {
+		t.Errorf("Unexpected counts in report %+v", report)
+	}
+
+	// every chunk gets read in exactly one subset
+	read := 0
+	for i := uint(1); i <= 3; i++ {
+		read += checkRepository(t, r, CheckOptions{ReadData: true, Subset: i, Subsets: 3}).ReadChunks
+	}
+	if read != len(index.Chunks) {
+		t.Errorf("Expected subsets to read %d chunks, got %d", len(index.Chunks), read)
+	}
+
+	files := storedChunkNames(dir)
+	if len(files) < 3 {
+		t.Errorf("Expected at least 3 chunk parts, got %d", len(files))
+		return
+	}
+	_ = os.Remove(storedChunkFile(dir, files[0]))
+	_ = ioutil.WriteFile(storedChunkFile(dir, files[1]), []byte("truncated"), 0600)
+	_ = flipByte(storedChunkFile(dir, files[2]))
+	orphan := filepath.Join(dir, chunksDirname, "ab", "cd", "abcdef.0_1")
+	_ = os.MkdirAll(filepath.Dir(orphan), 0700)
+	_ = ioutil.WriteFile(orphan, []byte("orphan"), 0600)
+
+	report = checkRepository(t, r, CheckOptions{})
+	if len(report.Missing) != 1 || !strings.HasPrefix(files[0], report.Missing[0].Chunk) {
+		t.Errorf("Expected %s to be missing, got %+v", files[0], report.Missing)
+	} else if len(report.Missing[0].Snapshots) != 1 || report.Missing[0].Snapshots[0] != snapshot.ID {
+		t.Errorf("Expected missing part to be referenced by snapshot %s, got %v", snapshot.ID, report.Missing[0].Snapshots)
+	}
+	if len(report.Corrupt) != 1 || !strings.HasPrefix(files[1], report.Corrupt[0].Chunk) {
+		t.Errorf("Expected %s to be corrupt, got %+v", files[1], report.Corrupt)
+	}
+	if len(report.Orphaned) != 1 || report.Orphaned[0].Chunk != "abcdef" {
+		t.Errorf("Expected %s to be orphaned, got %+v", orphan, report.Orphaned)
+	}
+	if report.ReadChunks != 0 {
+		t.Errorf("Expected no data to be read, got %d chunks", report.ReadChunks)
+	}
+
+	// only reading the data reveals the flipped byte
+	report = checkRepository(t, r, CheckOptions{ReadData: true})
+	if len(report.Missing) != 1 || len(report.Corrupt) != 2 {
+		t.Errorf("Expected 1 missing and 2 corrupt parts, got %+v and %+v", report.Missing, report.Corrupt)
+	}
+	if report.OK() {
+		t.Errorf("Expected check to fail")
+	}
+}
+
+func TestCheckRepositoryMetadata(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository(dir, testPassword)
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+	index, _ := OpenChunkIndex(&r)
+	storePackedSnapshot(t, &r, vol, &index, []string{"check.go"})
+
+	// a snapshot which got lost
+	vol.Snapshots = append(vol.Snapshots, "missing")
+	// chunks of a snapshot which never made it into the chunk-index
+	snapshot := storePackedSnapshot(t, &r, vol, &ChunkIndex{Chunks: make(map[string]*ChunkIndexItem)}, []string{"snapshot.go"})
+	_ = index.Save(&r)
+
+	report := checkRepository(t, r, CheckOptions{})
+	if len(report.Errors) != 1 || !strings.Contains(report.Errors[0], "missing") {
+		t.Errorf("Expected an error about the missing snapshot, got %v", report.Errors)
+	}
+	if len(report.Missing) == 0 {
+		t.Errorf("Expected chunks missing in the chunk-index")
+	}
+	for _, issue := range report.Missing {
+		if issue.Part != -1 || len(issue.Snapshots) != 1 || issue.Snapshots[0] != snapshot.ID {
+			t.Errorf("Unexpected issue %+v", issue)
+		}
+	}
+	// their parts aren't referenced by the chunk-index either
+	if len(report.Orphaned) != len(report.Missing) {
+		t.Errorf("Expected %d orphaned parts, got %+v", len(report.Missing), report.Orphaned)
+	}
+}
+
+func TestCheckRepositoryParity(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository(dir, testPassword)
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+	index, _ := OpenChunkIndex(&r)
+	storeSnapshot(t, &r, vol, &index, StoreOptions{
+		Paths:       []string{"check.go", "snapshot.go", "snapshot_test.go"},
+		Compress:    CompressionNone,
+		Encrypt:     EncryptionAES,
+		DataParts:   2,
+		ParityParts: 1,
+	})
+
+	report := checkRepository(t, r, CheckOptions{ReadData: true})
+	if !report.OK() || report.Parts != 3*len(index.Chunks) {
+		t.Errorf("Expected an intact repository, got %+v", report)
+		return
+	}
+
+	// damage a data part of one chunk and the parity part of another
+	var damaged []string
+	chunks := make(map[string]bool)
+	for _, name := range storedChunkNames(dir) {
+		hash := name[:strings.Index(name, ".")]
+		if chunks[hash] {
+			continue
+		}
+		if (len(damaged) == 0 && strings.HasSuffix(name, ".0_2")) ||
+			(len(damaged) == 1 && strings.HasSuffix(name, ".2_2")) {
+			chunks[hash] = true
+			damaged = append(damaged, name)
+			_ = flipByte(storedChunkFile(dir, name))
+		}
+	}
+	if len(damaged) != 2 {
+		t.Errorf("Expected to damage parts of 2 chunks, got %v", damaged)
+		return
+	}
+
+	report = checkRepository(t, r, CheckOptions{ReadData: true})
+	if len(report.Corrupt) != 2 {
+		t.Errorf("Expected 2 corrupt parts, got %+v", report.Corrupt)
+		return
+	}
+	for _, issue := range report.Corrupt {
+		name := storedName(issue.Chunk, uint(issue.Part), issue.TotalParts)
+		if name != damaged[0] && name != damaged[1] {
+			t.Errorf("Unexpected corrupt part %s, expected one of %v", name, damaged)
+		}
+	}
+}
@@ -11,8 +11,6 @@ import (
 	"io"
 	"os"
 	"sync"
-
-	"github.com/restic/chunker"
 )
 
 const (
@@ -29,6 +27,22 @@ type Chunk struct {
 	DecryptedHash string    `json:"decrypted_hash"`
 	Hash          string    `json:"hash"`
 	Num           uint      `json:"num"`
+	KeyGeneration uint      `json:"key_generation"`
+	Keyed         bool      `json:"keyed,omitempty"` // hashes are keyed with the repository's hash key
+
+	// Parts are the locations of the chunk's parts within pack files. Empty
+	// for chunks with each part stored on its own
+	Parts []PackLocation `json:"parts,omitempty"`
+}
+
+// chunkEncoding describes how chunks get encoded and named.
+type chunkEncoding struct {
+	Compressed    uint16
+	Encrypted     uint16
+	DataParts     uint
+	ParityParts   uint
+	KeyGeneration uint
+	HashKey       []byte // nil for repositories without a hash key
 }
 
 // ChunkResult is used to transfer either a chunk or an error down the channel.
@@ -37,79 +51,160 @@ type ChunkResult struct {
 	Error error
 }
 
-type inputChunk struct {
-	Data []byte
-	Num  uint
+// encodeJob is a piece of a file waiting to be encoded.
+type encodeJob struct {
+	Data    []byte
+	Num     uint
+	results chan<- ChunkResult
+	wg      *sync.WaitGroup
 }
 
-func processChunk(password string, opts StoreOptions, jobs <-chan inputChunk, chunks chan<- ChunkResult, wg *sync.WaitGroup) {
-	pipe, _ := NewEncodingPipeline(opts.Compress, opts.Encrypt, password)
-
-	for j := range jobs {
-		// fmt.Println("\tWorker", id, "processing job", j.Num, len(j.Data))
+// A chunkEncoder splits files into chunks and encodes them with a fixed number
+// of workers. Every chunk being processed or waiting to be stored occupies one
+// of a limited number of slots, which bounds the memory used no matter how many
+// files are being read at the same time.
+type chunkEncoder struct {
+	repository *Repository
+	enc        chunkEncoding
+	jobs       chan encodeJob
+	slots      chan struct{}
+}
 
-		b, err := pipe.Process(j.Data)
-		if err != nil {
-			chunks <- ChunkResult{Error: err}
-			wg.Done()
-			continue
-		}
+// newChunkEncoder starts the encoding workers for a store operation.
+func newChunkEncoder(repository *Repository, opts StoreOptions) (*chunkEncoder, error) {
+	opts = opts.withDefaults()
+	hashKey, err := repository.contentHashKey()
+	if err != nil {
+		return nil, err
+	}
 
-		hashsum := Hash(b, HashHighway256)
-		orighashsum := Hash(j.Data, HashHighway256)
+	// every slot holds at most one chunk's worth of data
+	maxSize := uint64(repository.Chunker.withDefaults().MaxSize)
+	slots := opts.MemoryLimit / maxSize
+	if slots < 1 {
+		slots = 1
+	}
 
-		c := Chunk{
+	e := &chunkEncoder{
+		repository: repository,
+		enc: chunkEncoding{
+			Compressed:    opts.Compress,
+			Encrypted:     opts.Encrypt,
 			DataParts:     opts.DataParts,
 			ParityParts:   opts.ParityParts,
-			OriginalSize:  len(j.Data),
-			Size:          len(b),
-			DecryptedHash: orighashsum,
-			Hash:          hashsum,
-			Num:           j.Num,
+			KeyGeneration: repository.KeyGeneration,
+			HashKey:       hashKey,
+		},
+		jobs:  make(chan encodeJob),
+		slots: make(chan struct{}, slots),
+	}
+
+	for w := 0; w < opts.EncodeJobs; w++ {
+		pipe, err := NewEncodingPipeline(opts.Compress, opts.Encrypt, repository.Key)
+		if err != nil {
+			close(e.jobs)
+			return nil, err
 		}
+		go e.work(pipe)
+	}
 
-		if opts.ParityParts > 0 {
-			pars, err := redundantData(b, int(opts.DataParts), int(opts.ParityParts))
-			if err != nil {
-				chunks <- ChunkResult{Error: err}
-				wg.Done()
-				continue
-			}
-			c.Data = &pars
+	return e, nil
+}
+
+func (e *chunkEncoder) work(pipe Pipeline) {
+	for j := range e.jobs {
+		c, err := encodeChunk(pipe, j.Data, e.enc)
+		if err != nil {
+			j.results <- ChunkResult{Error: err}
 		} else {
-			c.DataParts = 1
-			c.Data = &[][]byte{b}
+			c.Num = j.Num
+			j.results <- ChunkResult{Chunk: c}
 		}
-
-		chunks <- ChunkResult{Chunk: c}
-		wg.Done()
+		j.wg.Done()
 	}
 }
 
-// chunkFile divides filename into chunks of 1MiB each.
-func chunkFile(filename string, password string, opts StoreOptions) (<-chan ChunkResult, error) {
-	c := make(chan ChunkResult)
+// close stops the encoding workers. chunkFile must not be called afterwards.
+func (e *chunkEncoder) close() {
+	close(e.jobs)
+}
 
-	file, err := os.Open(filename)
+// release frees the slot held by a ChunkResult. It must be called exactly
+// once for every result received from chunkFile, after its data has been
+// stored or discarded.
+func (e *chunkEncoder) release() {
+	<-e.slots
+}
+
+// encodeChunk sends data through pipe and splits the result into data and
+// parity parts.
+func encodeChunk(pipe Pipeline, data []byte, enc chunkEncoding) (Chunk, error) {
+	b, err := pipe.Process(data)
 	if err != nil {
-		return c, err
+		return Chunk{}, err
 	}
 
-	wg := &sync.WaitGroup{}
-	jobs := make(chan inputChunk)
-	for w := 1; w <= 4; w++ {
-		go processChunk(password, opts, jobs, c, wg)
+	c := Chunk{
+		DataParts:     enc.DataParts,
+		ParityParts:   enc.ParityParts,
+		OriginalSize:  len(data),
+		Size:          len(b),
+		KeyGeneration: enc.KeyGeneration,
+	}
+	if enc.ParityParts == 0 {
+		c.DataParts = 1
+	}
+
+	if enc.HashKey != nil {
+		c.DecryptedHash = KeyedHash(data, enc.HashKey)
+		c.Hash = chunkName(enc.HashKey, c, enc.Compressed, enc.Encrypted)
+		c.Keyed = true
+	} else {
+		c.DecryptedHash = Hash(data, HashHighway256)
+		c.Hash = Hash(b, HashHighway256)
+	}
+
+	if enc.ParityParts > 0 {
+		pars, err := redundantData(b, int(enc.DataParts), int(enc.ParityParts))
+		if err != nil {
+			return c, err
+		}
+		c.Data = &pars
+	} else {
+		c.Data = &[][]byte{b}
+	}
+
+	return c, nil
+}
+
+// chunkFile divides filename into content-defined chunks.
+func (e *chunkEncoder) chunkFile(filename string) (<-chan ChunkResult, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return make(chan ChunkResult), err
 	}
 
+	return e.chunkReader(file), nil
+}
+
+// chunkReader splits the data read from r into chunks and encodes them. r
+// gets closed once all of it has been read.
+func (e *chunkEncoder) chunkReader(r io.ReadCloser) <-chan ChunkResult {
+	c := make(chan ChunkResult)
+
+	wg := &sync.WaitGroup{}
 	wg.Add(1)
 	go func() {
-		chunker := chunker.NewWithBoundaries(file, chunker.Pol(0x3DA3358B4DC173), chunker.MinSize, preferredChunkSize)
+		chunker := e.repository.Chunker.newChunker(r)
+		maxSize := e.repository.Chunker.withDefaults().MaxSize
 
 		i := uint(0)
 		for {
-			buf := make([]byte, preferredChunkSize)
+			e.slots <- struct{}{}
+			buf := make([]byte, maxSize)
 			chunk, err := chunker.Next(buf)
 			if err == io.EOF {
+				e.release()
 				wg.Done()
 				break
 			}
@@ -120,22 +215,21 @@ func chunkFile(filename string, password string, opts StoreOptions) (<-chan Chun
 			}
 
 			wg.Add(1)
-			j := inputChunk{
-				Data: chunk.Data,
-				Num:  i,
+			e.jobs <- encodeJob{
+				Data:    chunk.Data,
+				Num:     i,
+				results: c,
+				wg:      wg,
 			}
-
 			i++
-			jobs <- j
 		}
-		_ = file.Close()
+		_ = r.Close()
 	}()
 
 	go func() {
 		wg.Wait()
-		close(jobs)
 		close(c)
 	}()
 
-	return c, nil
+	return c
 }
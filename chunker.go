@@ -0,0 +1,110 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+
+	"github.com/restic/chunker"
+)
+
+// ChunkerParams configure how files get split into content-defined chunks.
+// Changing the sizes of an existing repository is safe, but files stored
+// before won't de-duplicate with files stored afterwards.
+type ChunkerParams struct {
+	Polynomial chunker.Pol `json:"polynomial"` // secret polynomial, so chunk boundaries don't reveal the content
+	MinSize    uint        `json:"min_size"`   // minimum chunk size
+	AvgSize    uint        `json:"avg_size"`   // average chunk size, must be a power of 2
+	MaxSize    uint        `json:"max_size"`   // maximum chunk size
+}
+
+// Const declarations.
+const (
+	// legacyPolynomial was used by all repositories created before the
+	// polynomial got stored in the repository.
+	legacyPolynomial = chunker.Pol(0x3DA3358B4DC173)
+
+	minChunkSize = 64 * 1024         // 64 KiB
+	maxChunkSize = 128 * 1024 * 1024 // 128 MiB
+)
+
+// Error declarations.
+var (
+	ErrInvalidChunkerParams = errors.New("chunk sizes must satisfy min < avg < max, with a power of 2 as avg size and 64KiB <= min, max <= 128MiB")
+)
+
+// DefaultChunkerParams returns the chunk sizes new repositories get created
+// with, using a new random polynomial.
+func DefaultChunkerParams() (ChunkerParams, error) {
+	pol, err := chunker.RandomPolynomial()
+	if err != nil {
+		return ChunkerParams{}, err
+	}
+
+	return ChunkerParams{
+		Polynomial: pol,
+		MinSize:    chunker.MinSize,
+		AvgSize:    preferredChunkSize,
+		MaxSize:    chunker.MaxSize,
+	}, nil
+}
+
+// Validate returns an error if the chunker can't be used with p.
+func (p ChunkerParams) Validate() error {
+	if p.MinSize < minChunkSize || p.MaxSize > maxChunkSize ||
+		p.MinSize >= p.AvgSize || p.AvgSize >= p.MaxSize ||
+		bits.OnesCount(p.AvgSize) != 1 {
+		return ErrInvalidChunkerParams
+	}
+	if !p.Polynomial.Irreducible() {
+		return ErrInvalidChunkerParams
+	}
+
+	return nil
+}
+
+// withDefaults returns p with the settings of repositories created before
+// the chunker became configurable filled in.
+func (p ChunkerParams) withDefaults() ChunkerParams {
+	if p.Polynomial == 0 {
+		p.Polynomial = legacyPolynomial
+	}
+	if p.MinSize == 0 {
+		p.MinSize = chunker.MinSize
+	}
+	if p.AvgSize == 0 {
+		p.AvgSize = preferredChunkSize
+	}
+	if p.MaxSize == 0 {
+		p.MaxSize = preferredChunkSize
+	}
+
+	return p
+}
+
+// newChunker returns a chunker splitting rd according to p.
+func (p ChunkerParams) newChunker(rd io.Reader) *chunker.Chunker {
+	p = p.withDefaults()
+
+	c := chunker.NewWithBoundaries(rd, p.Polynomial, p.MinSize, p.MaxSize)
+	c.SetAverageBits(bits.TrailingZeros(p.AvgSize))
+	return c
+}
+
+// SetChunkerParams changes the chunker settings of the repository. The caller
+// needs to save the repository afterwards.
+func (r *Repository) SetChunkerParams(p ChunkerParams) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	r.Chunker = p
+	return nil
+}
@@ -0,0 +1,150 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChunkerParamsValidate(t *testing.T) {
+	p, err := DefaultChunkerParams()
+	if err != nil {
+		t.Errorf("Failed generating chunker params: %s", err)
+		return
+	}
+	if err := p.Validate(); err != nil {
+		t.Errorf("Default chunker params are invalid: %s", err)
+	}
+
+	tests := []struct {
+		min, avg, max uint
+		valid         bool
+	}{
+		{64 << 10, 128 << 10, 256 << 10, true},
+		{4 << 20, 16 << 20, 64 << 20, true},
+		{32 << 10, 128 << 10, 256 << 10, false}, // min too small
+		{512 << 10, 1 << 20, 256 << 20, false},  // max too large
+		{512 << 10, 768 << 10, 1 << 20, false},  // avg not a power of 2
+		{1 << 20, 1 << 20, 2 << 20, false},      // avg not larger than min
+		{512 << 10, 1 << 20, 1 << 20, false},    // max not larger than avg
+	}
+	for _, tt := range tests {
+		p.MinSize, p.AvgSize, p.MaxSize = tt.min, tt.avg, tt.max
+		err := p.Validate()
+		if tt.valid && err != nil {
+			t.Errorf("Expected %d/%d/%d to be valid: %s", tt.min, tt.avg, tt.max, err)
+		}
+		if !tt.valid && err != ErrInvalidChunkerParams {
+			t.Errorf("Expected %v for %d/%d/%d, got %v", ErrInvalidChunkerParams, tt.min, tt.avg, tt.max, err)
+		}
+	}
+}
+
+func TestRepositoryChunker(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	dir2, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir2)
+
+	r, err := NewRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+	r2, err := NewRepository(dir2, testPassword)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+	if r.Chunker.Polynomial == r2.Chunker.Polynomial || r.Chunker.Polynomial == legacyPolynomial {
+		t.Errorf("Expected new repositories to use a random polynomial")
+	}
+
+	p := r.Chunker
+	p.MinSize, p.AvgSize, p.MaxSize = 64<<10, 128<<10, 256<<10
+	err = r.SetChunkerParams(p)
+	if err != nil {
+		t.Errorf("Failed setting chunker params: %s", err)
+		return
+	}
+	err = r.Save()
+	if err != nil {
+		t.Errorf("Failed saving repository: %s", err)
+		return
+	}
+
+	r, err = OpenRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed opening repository: %s", err)
+		return
+	}
+	if r.Chunker != p {
+		t.Errorf("Chunker params got lost: expected %+v, got %+v", p, r.Chunker)
+		return
+	}
+
+	data := make([]byte, 4<<20)
+	_, _ = rand.Read(data)
+	filename := filepath.Join(dir, "data")
+	err = ioutil.WriteFile(filename, data, 0644)
+	if err != nil {
+		t.Errorf("Failed writing test data: %s", err)
+		return
+	}
+
+	opts := StoreOptions{
+		Compress:  CompressionNone,
+		Encrypt:   EncryptionNone,
+		DataParts: 1,
+	}
+	encoder, err := newChunkEncoder(&r, opts)
+	if err != nil {
+		t.Errorf("Failed creating chunk encoder: %s", err)
+		return
+	}
+	defer encoder.close()
+	chunks, err := encoder.chunkFile(filename)
+	if err != nil {
+		t.Errorf("Failed chunking file: %s", err)
+		return
+	}
+
+	var n, size int
+	for c := range chunks {
+		encoder.release()
+		if c.Error != nil {
+			t.Errorf("Failed chunking file: %s", c.Error)
+			return
+		}
+		if c.Chunk.OriginalSize > int(p.MaxSize) {
+			t.Errorf("Chunk of %d bytes exceeds the maximum size", c.Chunk.OriginalSize)
+		}
+		n++
+		size += c.Chunk.OriginalSize
+	}
+	if size != len(data) {
+		t.Errorf("Expected %d bytes in chunks, got %d", len(data), size)
+	}
+	if n < len(data)/int(p.MaxSize) {
+		t.Errorf("Expected at least %d chunks, got %d", len(data)/int(p.MaxSize), n)
+	}
+}
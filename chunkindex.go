@@ -13,16 +13,25 @@ import (
 
 // A ChunkIndexItem links a chunk with one or many snapshots.
 type ChunkIndexItem struct {
-	Hash        string   `json:"hash"`
-	DataParts   uint     `json:"data_parts"`
-	ParityParts uint     `json:"parity_parts"`
-	Size        int      `json:"size"`
-	Snapshots   []string `json:"snapshots"`
+	Hash          string   `json:"hash"`
+	DecryptedHash string   `json:"decrypted_hash"`
+	Compressed    uint16   `json:"compressed"`
+	Encrypted     uint16   `json:"encrypted"`
+	DataParts     uint     `json:"data_parts"`
+	ParityParts   uint     `json:"parity_parts"`
+	Size          int      `json:"size"`
+	KeyGeneration uint     `json:"key_generation"`
+	Snapshots     []string `json:"snapshots"`
+
+	Parts []PackLocation `json:"parts,omitempty"` // locations within pack files, if packed
 }
 
 // A ChunkIndex links chunks with snapshots.
 type ChunkIndex struct {
 	Chunks map[string]*ChunkIndexItem `json:"chunks"`
+
+	// chunks by their decrypted content, built on demand by FindChunk
+	contents map[string]*ChunkIndexItem
 }
 
 // OpenChunkIndex opens an existing chunkindex.
@@ -46,17 +55,13 @@ func OpenChunkIndex(repository *Repository) (ChunkIndex, error) {
 		return index, err
 	}
 
-	pipe, err := NewDecodingPipeline(CompressionLZMA, EncryptionAES, repository.Key)
-	if err != nil {
-		return index, err
-	}
-	err = pipe.Decode(b, &index)
+	err = repository.decodeMetadata(b, &index)
 	return index, err
 }
 
 // Save writes a chunk-index.
 func (index *ChunkIndex) Save(repository *Repository) error {
-	pipe, err := NewEncodingPipeline(CompressionLZMA, EncryptionAES, repository.Key)
+	pipe, err := NewEncodingPipeline(CompressionLZMA, metadataEncryption, repository.Key)
 	if err != nil {
 		return err
 	}
@@ -67,13 +72,37 @@ func (index *ChunkIndex) Save(repository *Repository) error {
 	return repository.backend.SaveChunkIndex(b)
 }
 
-// Pack deletes unreferenced chunks and removes them from the index.
+// Pack deletes unreferenced chunks and removes them from the index. Pack files
+// only get deleted once none of their chunks are referenced anymore, or
+// rewritten when too much of their space is wasted on unreferenced chunks.
 func (index *ChunkIndex) Pack(repository *Repository) (freedSize uint64, err error) {
 	chunks := make(map[string]*ChunkIndexItem)
+	packs := make(map[string]*packUsage)
 
 	for _, chunk := range index.Chunks {
 		// fmt.Printf("Chunk %s referenced in Snapshots %+v\n", chunk.Hash, chunk.Snapshots)
-		if len(chunk.Snapshots) == 0 {
+		if len(chunk.Parts) > 0 {
+			// packed chunks can't be deleted on their own. Unreferenced ones
+			// stay in the index until their pack files get rewritten or
+			// deleted, so their space keeps being accounted for
+			for _, loc := range chunk.Parts {
+				if loc.Pack == "" {
+					// its pack file is gone already
+					continue
+				}
+				usage, ok := packs[loc.Pack]
+				if !ok {
+					usage = &packUsage{}
+					packs[loc.Pack] = usage
+				}
+				if len(chunk.Snapshots) == 0 {
+					usage.dead += loc.Length
+				} else {
+					usage.live += loc.Length
+				}
+			}
+			chunks[chunk.Hash] = chunk
+		} else if len(chunk.Snapshots) == 0 {
 			fmt.Printf("Chunk %s is no longer referenced by any snapshot. Deleting!\n", chunk.Hash)
 
 			for i := uint(0); i < chunk.DataParts+chunk.ParityParts; i++ {
@@ -89,6 +118,10 @@ func (index *ChunkIndex) Pack(repository *Repository) (freedSize uint64, err err
 	}
 
 	index.Chunks = chunks
+	index.contents = nil
+
+	repacked, err := index.repack(repository, packs)
+	freedSize += repacked
 	return
 }
 
@@ -114,30 +147,88 @@ func (index *ChunkIndex) AddArchive(archive *Archive, snapshot string) {
 	for _, chunk := range archive.Chunks {
 		c, ok := index.Chunks[chunk.Hash]
 		if ok {
+			if len(c.Snapshots) == 0 && len(chunk.Parts) > 0 {
+				// an unreferenced chunk got stored again, as parts of it
+				// were gone
+				c.Parts = chunk.Parts
+			}
 			c.Snapshots = append(c.Snapshots, snapshot)
 		} else {
 			chunkItem := ChunkIndexItem{
-				Hash:        chunk.Hash,
-				DataParts:   chunk.DataParts,
-				ParityParts: chunk.ParityParts,
-				Size:        chunk.Size,
-				Snapshots:   []string{snapshot},
+				Hash:          chunk.Hash,
+				DecryptedHash: chunk.DecryptedHash,
+				Compressed:    archive.Compressed,
+				Encrypted:     archive.Encrypted,
+				DataParts:     chunk.DataParts,
+				ParityParts:   chunk.ParityParts,
+				Size:          chunk.Size,
+				KeyGeneration: chunk.KeyGeneration,
+				Snapshots:     []string{snapshot},
+				Parts:         chunk.Parts,
 			}
 			index.Chunks[chunk.Hash] = &chunkItem
+			if index.contents != nil {
+				index.contents[contentKey(&chunkItem)] = &chunkItem
+			}
+		}
+	}
+}
+
+// FindChunk returns an already stored chunk with the same content and
+// encoding as chunk. Chunks sealed with a random nonce never share a storage
+// hash, so this is what keeps them deduplicated. Unreferenced chunks only get
+// re-used if they're packed and none of their parts is gone, as unpacked ones
+// may have been deleted already.
+func (index *ChunkIndex) FindChunk(chunk Chunk, compressed, encrypted uint16) (*ChunkIndexItem, bool) {
+	if index.contents == nil {
+		index.contents = make(map[string]*ChunkIndexItem)
+		for _, c := range index.Chunks {
+			if c.DecryptedHash != "" && (len(c.Snapshots) > 0 || c.packed()) {
+				index.contents[contentKey(c)] = c
+			}
 		}
 	}
+
+	c, ok := index.contents[contentKey(&ChunkIndexItem{
+		DecryptedHash: chunk.DecryptedHash,
+		Compressed:    compressed,
+		Encrypted:     encrypted,
+		DataParts:     chunk.DataParts,
+		ParityParts:   chunk.ParityParts,
+	})]
+	return c, ok
 }
 
-// RemoveSnapshot removes all references to snapshot from the chunk-index.
-func (index *ChunkIndex) RemoveSnapshot(snapshot string) {
+// packed returns true if all parts of the chunk are stored in pack files.
+func (c *ChunkIndexItem) packed() bool {
+	for _, loc := range c.Parts {
+		if loc.Pack == "" {
+			return false
+		}
+	}
+	return len(c.Parts) > 0
+}
+
+func contentKey(c *ChunkIndexItem) string {
+	return fmt.Sprintf("%s:%d:%d:%d:%d", c.DecryptedHash, c.Compressed, c.Encrypted, c.DataParts, c.ParityParts)
+}
+
+// RemoveSnapshot removes all references to one or many snapshots from the
+// chunk-index.
+func (index *ChunkIndex) RemoveSnapshot(snapshots ...string) {
+	remove := make(map[string]bool, len(snapshots))
+	for _, s := range snapshots {
+		remove[s] = true
+	}
+
 	for _, chunk := range index.Chunks {
-		snapshots := []string{}
+		refs := []string{}
 		for _, s := range chunk.Snapshots {
-			if s != snapshot {
-				snapshots = append(snapshots, s)
+			if !remove[s] {
+				refs = append(refs, s)
 			}
 		}
 
-		chunk.Snapshots = snapshots
+		chunk.Snapshots = refs
 	}
 }
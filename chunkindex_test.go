@@ -123,3 +123,51 @@ func TestChunkIndexPack(t *testing.T) {
 		t.Errorf("Packing chunk index failed: %s", err)
 	}
 }
+
+func TestChunkIndexDeduplication(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository(dir, testPassword)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	opts := StoreOptions{
+		CWD:         wd,
+		Paths:       []string{"snapshot_test.go", "snapshot.go"},
+		Excludes:    []string{},
+		Compress:    CompressionNone,
+		Encrypt:     EncryptionAESGCM,
+		Pedantic:    false,
+		DataParts:   1,
+		ParityParts: 0,
+	}
+
+	chunks := 0
+	for i := 0; i < 2; i++ {
+		snapshot, _ := NewSnapshot("test_snapshot")
+		progress := snapshot.Add(r, &index, opts)
+		for p := range progress {
+			if p.Error != nil {
+				t.Errorf("Failed adding to snapshot: %s", p.Error)
+			}
+		}
+
+		if i == 0 {
+			chunks = len(index.Chunks)
+			continue
+		}
+		if len(index.Chunks) != chunks {
+			t.Errorf("Expected %d chunks in index after storing the same data twice, got %d", chunks, len(index.Chunks))
+		}
+		if snapshot.Stats.StorageSize != 0 {
+			t.Errorf("Expected no data to be stored for the second snapshot, got %d bytes", snapshot.Stats.StorageSize)
+		}
+	}
+}
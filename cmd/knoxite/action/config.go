@@ -37,10 +37,20 @@ func ActionConfigKeys(cmd *cobra.Command) carapace.Action {
 				"url", "Repository directory to backup to/restore from",
 				"compression", "Compression algo to use: none (default), flate, gzip, lzma, zlib, zstd",
 				"tolerance", "Failure tolerance against n backend failures",
-				"encryption", "Encryption algo to use: aes (default), none",
+				"encryption", "Encryption algo to use: aes-gcm (default), chacha20-poly1305, aes-cfb (legacy), none",
 				"pedantic", "Stop backup operation after the first error occurred",
-				"store_excludes", "Specify excludes for the store operation",
-				"restore_excludes", "Specify excludes for the restore operation",
+				"store_excludes", "Specify gitignore-style excludes for the store operation",
+				"restore_excludes", "Specify gitignore-style excludes for the restore operation",
+				"keep_last", "Forget policy: keep the n most recent snapshots",
+				"keep_hourly", "Forget policy: keep the most recent snapshot of the last n hours",
+				"keep_daily", "Forget policy: keep the most recent snapshot of the last n days",
+				"keep_weekly", "Forget policy: keep the most recent snapshot of the last n weeks",
+				"keep_monthly", "Forget policy: keep the most recent snapshot of the last n months",
+				"keep_yearly", "Forget policy: keep the most recent snapshot of the last n years",
+				"keep_within", "Forget policy: keep all snapshots within this duration of the latest one, e.g. 1y6m",
+				"jobs", "Number of files to read at the same time",
+				"encode_jobs", "Number of chunks to compress & encrypt at the same time",
+				"upload_jobs", "Number of chunks to upload to each backend at the same time",
 			)
 		default:
 			return carapace.ActionValues()
@@ -56,7 +66,7 @@ func ActionConfigValues(key string) carapace.Action {
 		case "compression":
 			return carapace.ActionValues("none", "flate", "gzip", "lzma", "zlib", "zstd")
 		case "encryption":
-			return carapace.ActionValues("aes", "none")
+			return carapace.ActionValues("aes-gcm", "chacha20-poly1305", "aes-cfb", "none")
 		case "pedantic":
 			return carapace.ActionValues("true", "false")
 		default:
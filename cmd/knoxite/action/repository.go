@@ -6,6 +6,7 @@ import (
 
 	"github.com/knoxite/knoxite"
 	"github.com/knoxite/knoxite/cmd/knoxite/config"
+	"github.com/knoxite/knoxite/cmd/knoxite/utils"
 	"github.com/rsteube/carapace"
 	"github.com/spf13/cobra"
 )
@@ -14,12 +15,23 @@ func actionRepository(cmd *cobra.Command, f func(repository knoxite.Repository)
 	return carapace.ActionCallback(func(c carapace.Context) carapace.Action {
 		repo := os.Getenv("KNOXITE_REPOSITORY")
 		password := os.Getenv("KNOXITE_PASSWORD")
+		keyfile := os.Getenv("KNOXITE_KEYFILE")
 		if f := cmd.Flag("repo"); f.Changed {
 			repo = f.Value.String()
 		}
 		if f := cmd.Flag("password"); f.Changed {
 			password = f.Value.String()
 		}
+		if f := cmd.Flag("keyfile"); f.Changed {
+			keyfile = f.Value.String()
+		}
+		if keyfile != "" {
+			var err error
+			password, err = utils.ReadKeyFile(keyfile)
+			if err != nil {
+				return carapace.ActionMessage(err.Error())
+			}
+		}
 
 		// We dont allow both flags to be set as this can lead to unclear instructions.
 		if cmd.Flags().Changed("repo") && cmd.Flags().Changed("alias") {
@@ -57,3 +69,13 @@ func actionRepository(cmd *cobra.Command, f func(repository knoxite.Repository)
 		return f(repository)
 	})
 }
+
+func ActionKeySlots(cmd *cobra.Command) carapace.Action {
+	return actionRepository(cmd, func(repository knoxite.Repository) carapace.Action {
+		vals := make([]string, 0)
+		for _, slot := range repository.KeySlots() {
+			vals = append(vals, slot.ID, slot.Description)
+		}
+		return carapace.ActionValuesDescribed(vals...)
+	})
+}
@@ -22,7 +22,8 @@ var (
 	catCmd = &cobra.Command{
 		Use:   "cat [snapshot] [file]",
 		Short: "print file",
-		Long:  `The cat command prints a file on the standard output`,
+		Long: `The cat command prints a file on the standard output. This includes streams
+stored with 'knoxite store --stdin'`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if len(args) != 2 {
 				return fmt.Errorf("cat needs a snapshot ID and filename")
@@ -48,19 +49,22 @@ func executeCat(snapshotID string, file string) error {
 	if err != nil {
 		return err
 	}
+	repoLock, err := lockRepository(&repository, false)
+	if err != nil {
+		return err
+	}
+	defer repoLock.Unlock()
 	_, snapshot, err := repository.FindSnapshot(snapshotID)
 	if err != nil {
 		return err
 	}
 
 	if archive, ok := snapshot.Archives[file]; ok {
-		b, _, err := knoxite.DecodeArchiveData(repository, *archive)
+		archive, err = snapshot.ContentArchive(archive)
 		if err != nil {
 			return err
 		}
-
-		_, err = os.Stdout.Write(b)
-		return err
+		return knoxite.WriteArchiveData(os.Stdout, repository, *archive)
 	}
 
 	return fmt.Errorf("%s: No such file or directory", file)
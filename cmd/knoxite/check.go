@@ -0,0 +1,199 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/muesli/goprogressbar"
+	"github.com/rsteube/carapace"
+	"github.com/spf13/cobra"
+
+	"github.com/knoxite/knoxite"
+)
+
+// CheckOptions holds all the options that can be set for the 'check' command.
+type CheckOptions struct {
+	ReadData       bool
+	ReadDataSubset string
+	JSON           bool
+	Report         string
+}
+
+var (
+	checkOpts = CheckOptions{}
+
+	checkCmd = &cobra.Command{
+		Use:   "check",
+		Short: "check the integrity of the repository",
+		Long: `The check command verifies the structure of the entire repository: all
+snapshots must be loadable, every chunk they reference must be in the
+chunk-index, and every part of the indexed chunks, including parity parts and
+pack files, must be stored with the right size. Stored chunk parts nobody
+refers to are reported as orphaned.
+
+With --read-data the content of all chunks gets loaded and verified as well,
+which also detects corrupt parity parts. --read-data-subset n/m only reads the
+n-th of m subsets of all chunks, so the data of a large repository can be
+checked in several runs.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return executeCheck(checkOpts)
+		},
+	}
+)
+
+func init() {
+	checkCmd.Flags().BoolVar(&checkOpts.ReadData, "read-data", false, "load and verify the content of all chunks")
+	checkCmd.Flags().StringVar(&checkOpts.ReadDataSubset, "read-data-subset", "", "only read the data of a subset of all chunks, e.g. 1/10")
+	checkCmd.Flags().BoolVar(&checkOpts.JSON, "json", false, "print the report as JSON")
+	checkCmd.Flags().StringVar(&checkOpts.Report, "report", "", "write the report as JSON to this file")
+	RootCmd.AddCommand(checkCmd)
+
+	carapace.Gen(checkCmd).FlagCompletion(carapace.ActionMap{
+		"report": carapace.ActionFiles(),
+	})
+}
+
+// checkOptions returns the options for knoxite.CheckRepository.
+func (opts CheckOptions) checkOptions() (knoxite.CheckOptions, error) {
+	co := knoxite.CheckOptions{
+		ReadData: opts.ReadData,
+	}
+	if opts.ReadDataSubset == "" {
+		return co, nil
+	}
+
+	co.ReadData = true
+	invalid := fmt.Errorf("invalid subset %s, use n/m with 1 <= n <= m", opts.ReadDataSubset)
+	s := strings.SplitN(opts.ReadDataSubset, "/", 2)
+	if len(s) != 2 {
+		return co, invalid
+	}
+	n, err := strconv.ParseUint(s[0], 10, 32)
+	if err != nil {
+		return co, invalid
+	}
+	m, err := strconv.ParseUint(s[1], 10, 32)
+	if err != nil || n < 1 || n > m {
+		return co, invalid
+	}
+
+	co.Subset = uint(n)
+	co.Subsets = uint(m)
+	return co, nil
+}
+
+func executeCheck(opts CheckOptions) error {
+	co, err := opts.checkOptions()
+	if err != nil {
+		return err
+	}
+
+	repository, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil {
+		return err
+	}
+	repoLock, err := lockRepository(&repository, false)
+	if err != nil {
+		return err
+	}
+	defer repoLock.Unlock()
+
+	progress, report := knoxite.CheckRepository(repository, co)
+	pb := &goprogressbar.ProgressBar{Total: 1000, Width: 40}
+	for p := range progress {
+		if opts.JSON {
+			continue
+		}
+
+		pb.Total = int64(p.TotalStatistics.Size)
+		pb.Current = int64(p.TotalStatistics.Transferred)
+		pb.PrependText = fmt.Sprintf("%s / %s",
+			knoxite.SizeToString(uint64(pb.Current)),
+			knoxite.SizeToString(uint64(pb.Total)))
+		pb.Text = p.Path
+		pb.LazyPrint()
+	}
+	if co.ReadData && !opts.JSON {
+		fmt.Println()
+	}
+
+	if opts.Report != "" {
+		b, err := json.MarshalIndent(report, "", "    ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(opts.Report, b, 0644); err != nil {
+			return err
+		}
+	}
+
+	if opts.JSON {
+		if err := printJSON(report); err != nil {
+			return err
+		}
+	} else {
+		printCheckReport(report)
+	}
+
+	if !report.OK() {
+		return fmt.Errorf("check found %d missing, %d orphaned and %d corrupt parts, and %d other errors",
+			len(report.Missing), len(report.Orphaned), len(report.Corrupt), len(report.Errors))
+	}
+	return nil
+}
+
+func printCheckReport(report *knoxite.CheckReport) {
+	for _, w := range report.Warnings {
+		fmt.Printf("warning: %s\n", w)
+	}
+	for _, e := range report.Errors {
+		fmt.Printf("error: %s\n", e)
+	}
+	for _, issue := range report.Missing {
+		printCheckIssue("missing", issue)
+	}
+	for _, issue := range report.Corrupt {
+		printCheckIssue("corrupt", issue)
+	}
+	for _, issue := range report.Orphaned {
+		printCheckIssue("orphaned", issue)
+	}
+
+	fmt.Printf("Checked %d snapshots and %d chunks with %d parts", report.Snapshots, report.Chunks, report.Parts)
+	if report.ReadChunks > 0 {
+		fmt.Printf(", read %d chunks", report.ReadChunks)
+	}
+	fmt.Println()
+	if report.OK() {
+		fmt.Println("No problems found.")
+	}
+}
+
+func printCheckIssue(kind string, issue knoxite.CheckIssue) {
+	part := "chunk " + issue.Chunk
+	if issue.Part >= 0 {
+		part += fmt.Sprintf(" part %d", issue.Part)
+	}
+	if issue.Pack != "" {
+		part += " in pack " + issue.Pack
+	}
+	if issue.Backend != "" {
+		part += " on " + issue.Backend
+	}
+
+	fmt.Printf("%-9s %s: %s", kind, part, issue.Reason)
+	if len(issue.Snapshots) > 0 {
+		fmt.Printf(" (snapshots %s)", strings.Join(issue.Snapshots, ", "))
+	}
+	fmt.Println()
+}
@@ -72,6 +72,11 @@ func executeClone(snapshotID string, args []string, opts StoreOptions) error {
 	if err != nil {
 		return err
 	}
+	repoLock, err := lockRepository(&repository, true)
+	if err != nil {
+		return err
+	}
+	defer repoLock.Unlock()
 	volume, s, err := repository.FindSnapshot(snapshotID)
 	if err != nil {
 		return err
@@ -84,10 +89,18 @@ func executeClone(snapshotID string, args []string, opts StoreOptions) error {
 	if err != nil {
 		return err
 	}
+	// files which didn't change since the cloned snapshot can be skipped
+	parent := s
+	if opts.Parent != "" || opts.ForceRehash {
+		parent, err = findParentSnapshot(&repository, volume, targets, opts)
+		if err != nil {
+			return err
+		}
+	}
 	// release the shutdown lock
 	lock()
 
-	err = store(&repository, &chunkIndex, snapshot, targets, opts)
+	err = store(&repository, &chunkIndex, snapshot, parent, targets, opts)
 	if err != nil {
 		return err
 	}
@@ -103,7 +116,7 @@ func executeClone(snapshotID string, args []string, opts StoreOptions) error {
 	if err != nil {
 		return err
 	}
-	err = volume.AddSnapshot(snapshot.ID)
+	err = volume.AddSnapshotWithDate(snapshot)
 	if err != nil {
 		return err
 	}
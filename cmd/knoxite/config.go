@@ -133,7 +133,7 @@ func executeConfigAlias(alias string) error {
 		Url:         globalOpts.Repo,
 		Compression: utils.CompressionText(knoxite.CompressionNone),
 		// Tolerance:   0,
-		Encryption: utils.EncryptionText(knoxite.EncryptionAES),
+		Encryption: utils.EncryptionText(knoxite.EncryptionAESGCM),
 	}
 
 	return cfg.Save()
@@ -177,6 +177,43 @@ func executeConfigSet(option string, values []string) error {
 			return err
 		}
 		repo.Pedantic = b
+	case "keep_last", "keep_hourly", "keep_daily", "keep_weekly", "keep_monthly", "keep_yearly":
+		n, err := strconv.Atoi(values[0])
+		if err != nil {
+			return fmt.Errorf("failed to convert %s to int for the %s option: %v", values[0], opt, err)
+		}
+		switch opt {
+		case "keep_last":
+			repo.KeepLast = n
+		case "keep_hourly":
+			repo.KeepHourly = n
+		case "keep_daily":
+			repo.KeepDaily = n
+		case "keep_weekly":
+			repo.KeepWeekly = n
+		case "keep_monthly":
+			repo.KeepMonthly = n
+		case "keep_yearly":
+			repo.KeepYearly = n
+		}
+	case "keep_within":
+		if _, err := knoxite.ParseRetentionDuration(values[0]); err != nil {
+			return err
+		}
+		repo.KeepWithin = values[0]
+	case "jobs", "encode_jobs", "upload_jobs":
+		n, err := strconv.Atoi(values[0])
+		if err != nil {
+			return fmt.Errorf("failed to convert %s to int for the %s option: %v", values[0], opt, err)
+		}
+		switch opt {
+		case "jobs":
+			repo.Jobs = n
+		case "encode_jobs":
+			repo.EncodeJobs = n
+		case "upload_jobs":
+			repo.UploadJobs = n
+		}
 
 	default:
 		return fmt.Errorf("unknown configuration option: %s", opt)
@@ -33,10 +33,20 @@ type RepoConfig struct {
 	Url             string   `toml:"url" comment:"Repository directory to backup to/restore from"`
 	Compression     string   `toml:"compression" comment:"Compression algo to use: none (default), flate, gzip, lzma, zlib, zstd"`
 	Tolerance       uint     `toml:"tolerance" comment:"Failure tolerance against n backend failures"`
-	Encryption      string   `toml:"encryption" comment:"Encryption algo to use: aes (default), none"`
+	Encryption      string   `toml:"encryption" comment:"Encryption algo to use: aes-gcm (default), chacha20-poly1305, aes-cfb (legacy), none"`
 	Pedantic        bool     `toml:"pedantic" comment:"Stop backup operation after the first error occurred"`
-	StoreExcludes   []string `toml:"store_excludes" comment:"Specify excludes for the store operation"`
-	RestoreExcludes []string `toml:"restore_excludes" comment:"Specify excludes for the restore operation"`
+	StoreExcludes   []string `toml:"store_excludes" comment:"Specify gitignore-style excludes for the store operation"`
+	RestoreExcludes []string `toml:"restore_excludes" comment:"Specify gitignore-style excludes for the restore operation"`
+	KeepLast        int      `toml:"keep_last" comment:"Forget policy: keep the n most recent snapshots"`
+	KeepHourly      int      `toml:"keep_hourly" comment:"Forget policy: keep the most recent snapshot of the last n hours"`
+	KeepDaily       int      `toml:"keep_daily" comment:"Forget policy: keep the most recent snapshot of the last n days"`
+	KeepWeekly      int      `toml:"keep_weekly" comment:"Forget policy: keep the most recent snapshot of the last n weeks"`
+	KeepMonthly     int      `toml:"keep_monthly" comment:"Forget policy: keep the most recent snapshot of the last n months"`
+	KeepYearly      int      `toml:"keep_yearly" comment:"Forget policy: keep the most recent snapshot of the last n years"`
+	KeepWithin      string   `toml:"keep_within" comment:"Forget policy: keep all snapshots within this duration of the latest one, e.g. 1y6m"`
+	Jobs            int      `toml:"jobs" comment:"Number of files to read at the same time"`
+	EncodeJobs      int      `toml:"encode_jobs" comment:"Number of chunks to compress & encrypt at the same time"`
+	UploadJobs      int      `toml:"upload_jobs" comment:"Number of chunks to upload to each backend at the same time"`
 }
 
 type Config struct {
@@ -0,0 +1,235 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/rsteube/carapace"
+	"github.com/spf13/cobra"
+
+	"github.com/knoxite/knoxite"
+	"github.com/knoxite/knoxite/cmd/knoxite/action"
+)
+
+// DiffOptions holds all the options that can be set for the 'diff' command.
+type DiffOptions struct {
+	JSON bool
+	Stat bool
+}
+
+// diffArchive is the JSON representation of an archive's metadata.
+type diffArchive struct {
+	Type     string `json:"type"`
+	Mode     string `json:"mode"`
+	UID      uint32 `json:"uid"`
+	GID      uint32 `json:"gid"`
+	Size     uint64 `json:"size"`
+	ModTime  int64  `json:"modtime"`
+	PointsTo string `json:"pointsto,omitempty"`
+}
+
+// diffChange is the JSON representation of a change.
+type diffChange struct {
+	Path          string       `json:"path"`
+	Change        string       `json:"change"`
+	Modifications []string     `json:"modifications,omitempty"`
+	Old           *diffArchive `json:"old,omitempty"`
+	New           *diffArchive `json:"new,omitempty"`
+}
+
+var (
+	diffOpts = DiffOptions{}
+
+	diffCmd = &cobra.Command{
+		Use:   "diff [snapshot] [snapshot] [path]",
+		Short: "show differences between two snapshots",
+		Long: `The diff command lists all files which have been added, removed or modified
+between two snapshots, optionally limited to a path. Contents get compared by
+their chunk hashes, so no data needs to be downloaded`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 2 {
+				return fmt.Errorf("diff needs two snapshot IDs")
+			}
+			if len(args) > 3 {
+				return fmt.Errorf("diff accepts a single path only")
+			}
+			path := ""
+			if len(args) == 3 {
+				path = args[2]
+			}
+			return executeDiff(args[0], args[1], path, diffOpts)
+		},
+	}
+)
+
+func init() {
+	diffCmd.Flags().BoolVar(&diffOpts.JSON, "json", false, "print the differences as JSON")
+	diffCmd.Flags().BoolVar(&diffOpts.Stat, "stat", false, "only print a summary of the differences")
+	RootCmd.AddCommand(diffCmd)
+
+	carapace.Gen(diffCmd).PositionalCompletion(
+		action.ActionSnapshots(diffCmd, ""),
+		action.ActionSnapshots(diffCmd, ""),
+	)
+}
+
+func executeDiff(olderID, newerID, path string, opts DiffOptions) error {
+	repository, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil {
+		return err
+	}
+	repoLock, err := lockRepository(&repository, false)
+	if err != nil {
+		return err
+	}
+	defer repoLock.Unlock()
+
+	_, older, err := repository.FindSnapshot(olderID)
+	if err != nil {
+		return err
+	}
+	_, newer, err := repository.FindSnapshot(newerID)
+	if err != nil {
+		return err
+	}
+
+	diff := knoxite.DiffSnapshots(older, newer, path)
+
+	switch {
+	case opts.JSON && opts.Stat:
+		return printJSON(diff.Stats)
+	case opts.JSON:
+		changes := []diffChange{}
+		for _, c := range diff.Changes {
+			changes = append(changes, diffChange{
+				Path:          c.Path,
+				Change:        c.Type.String(),
+				Modifications: modificationNames(c.Modifications),
+				Old:           newDiffArchive(c.Old),
+				New:           newDiffArchive(c.New),
+			})
+		}
+		return printJSON(struct {
+			Changes []diffChange      `json:"changes"`
+			Stats   knoxite.DiffStats `json:"stats"`
+		}{changes, diff.Stats})
+	case opts.Stat:
+		printDiffStats(diff.Stats)
+		return nil
+	}
+
+	for _, c := range diff.Changes {
+		switch c.Type {
+		case knoxite.ChangeAdded:
+			fmt.Printf("+  %s\n", c.Path)
+		case knoxite.ChangeRemoved:
+			fmt.Printf("-  %s\n", c.Path)
+		case knoxite.ChangeModified:
+			fmt.Printf("M  %s (%s)\n", c.Path, strings.Join(modificationDetails(c), ", "))
+		}
+	}
+	if len(diff.Changes) > 0 {
+		fmt.Println()
+	}
+	printDiffStats(diff.Stats)
+
+	return nil
+}
+
+func printDiffStats(stats knoxite.DiffStats) {
+	fmt.Printf("%d added, %d removed, %d modified\n", stats.Added, stats.Removed, stats.Modified)
+	fmt.Printf("Data: +%s, -%s\n", knoxite.SizeToString(stats.AddedSize), knoxite.SizeToString(stats.RemovedSize))
+}
+
+func printJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(b))
+	return nil
+}
+
+func modificationNames(mods []knoxite.Modification) []string {
+	var names []string
+	for _, m := range mods {
+		names = append(names, m.String())
+	}
+	return names
+}
+
+// modificationDetails describes the modifications of a change, including the
+// old and new values where they are short enough.
+func modificationDetails(c knoxite.Change) []string {
+	var details []string
+	for _, m := range c.Modifications {
+		switch m {
+		case knoxite.ModifiedType:
+			details = append(details, fmt.Sprintf("type %s → %s", archiveTypeName(c.Old.Type), archiveTypeName(c.New.Type)))
+		case knoxite.ModifiedContent:
+			details = append(details, fmt.Sprintf("content %s → %s",
+				knoxite.SizeToString(c.Old.Size), knoxite.SizeToString(c.New.Size)))
+		case knoxite.ModifiedMode:
+			details = append(details, fmt.Sprintf("mode %s → %s", c.Old.Mode, c.New.Mode))
+		case knoxite.ModifiedOwner:
+			details = append(details, fmt.Sprintf("owner %d:%d → %d:%d", c.Old.UID, c.Old.GID, c.New.UID, c.New.GID))
+		case knoxite.ModifiedTarget:
+			if c.New.Type == knoxite.File {
+				details = append(details, fmt.Sprintf("hardlink %s → %s", c.Old.LinkTo, c.New.LinkTo))
+			} else {
+				details = append(details, fmt.Sprintf("target %s → %s", c.Old.PointsTo, c.New.PointsTo))
+			}
+		case knoxite.ModifiedDevice:
+			details = append(details, fmt.Sprintf("device %d,%d → %d,%d",
+				c.Old.DevMajor, c.Old.DevMinor, c.New.DevMajor, c.New.DevMinor))
+		default:
+			details = append(details, m.String())
+		}
+	}
+	return details
+}
+
+func archiveTypeName(t uint8) string {
+	switch t {
+	case knoxite.File:
+		return "file"
+	case knoxite.Directory:
+		return "dir"
+	case knoxite.SymLink:
+		return "symlink"
+	case knoxite.CharDevice:
+		return "chardev"
+	case knoxite.BlockDevice:
+		return "blockdev"
+	case knoxite.FIFO:
+		return "fifo"
+	case knoxite.Socket:
+		return "socket"
+	}
+	return "unknown"
+}
+
+func newDiffArchive(arc *knoxite.Archive) *diffArchive {
+	if arc == nil {
+		return nil
+	}
+
+	return &diffArchive{
+		Type:     archiveTypeName(arc.Type),
+		Mode:     arc.Mode.String(),
+		UID:      arc.UID,
+		GID:      arc.GID,
+		Size:     arc.Size,
+		ModTime:  arc.ModTime,
+		PointsTo: arc.PointsTo,
+	}
+}
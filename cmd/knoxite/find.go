@@ -0,0 +1,173 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/muesli/gotable"
+	"github.com/rsteube/carapace"
+	"github.com/spf13/cobra"
+
+	"github.com/knoxite/knoxite"
+)
+
+// FindOptions holds all the options that can be set for the 'find' command.
+type FindOptions struct {
+	Regex          bool
+	IgnoreCase     bool
+	MinSize        string
+	MaxSize        string
+	ModifiedAfter  string
+	ModifiedBefore string
+	Types          []string
+	Jobs           int
+}
+
+var (
+	findOpts = FindOptions{}
+
+	findCmd = &cobra.Command{
+		Use:   "find [pattern]",
+		Short: "find files in all snapshots",
+		Long: `The find command searches all snapshots of all volumes for files matching a
+glob pattern. Patterns without a path separator get matched against file names,
+otherwise against the entire path`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("find needs a pattern to search for")
+			}
+			return executeFind(args[0], findOpts)
+		},
+	}
+)
+
+func init() {
+	findCmd.Flags().BoolVar(&findOpts.Regex, "regex", false, "treat the pattern as a regular expression, matched against the entire path")
+	findCmd.Flags().BoolVarP(&findOpts.IgnoreCase, "ignore-case", "i", false, "match the pattern case-insensitively")
+	findCmd.Flags().StringVar(&findOpts.MinSize, "min-size", "", "only find files of at least this size, e.g. 10MiB")
+	findCmd.Flags().StringVar(&findOpts.MaxSize, "max-size", "", "only find files of at most this size, e.g. 1GiB")
+	findCmd.Flags().StringVar(&findOpts.ModifiedAfter, "modified-after", "", "only find files modified after this date (YYYY-MM-DD [HH:MM:SS])")
+	findCmd.Flags().StringVar(&findOpts.ModifiedBefore, "modified-before", "", "only find files modified before this date (YYYY-MM-DD [HH:MM:SS])")
+	findCmd.Flags().StringSliceVar(&findOpts.Types, "type", []string{}, "only find files of these types: file, dir, symlink, chardev, blockdev, fifo, socket")
+	findCmd.Flags().IntVarP(&findOpts.Jobs, "jobs", "j", 0, "number of snapshots to load at the same time (default 4)")
+	RootCmd.AddCommand(findCmd)
+
+	carapace.Gen(findCmd).FlagCompletion(carapace.ActionMap{
+		"type": carapace.ActionValues("file", "dir", "symlink", "chardev", "blockdev", "fifo", "socket"),
+	})
+}
+
+func (opts FindOptions) findOptions(pattern string) (knoxite.FindOptions, error) {
+	fo := knoxite.FindOptions{
+		Pattern:    pattern,
+		Regex:      opts.Regex,
+		IgnoreCase: opts.IgnoreCase,
+		Jobs:       opts.Jobs,
+	}
+
+	var err error
+	if opts.MinSize != "" {
+		if fo.MinSize, err = humanize.ParseBytes(opts.MinSize); err != nil {
+			return fo, err
+		}
+	}
+	if opts.MaxSize != "" {
+		if fo.MaxSize, err = humanize.ParseBytes(opts.MaxSize); err != nil {
+			return fo, err
+		}
+	}
+	if opts.ModifiedAfter != "" {
+		if fo.ModifiedAfter, err = knoxite.ParseDate(opts.ModifiedAfter); err != nil {
+			return fo, err
+		}
+	}
+	if opts.ModifiedBefore != "" {
+		if fo.ModifiedBefore, err = knoxite.ParseDate(opts.ModifiedBefore); err != nil {
+			return fo, err
+		}
+	}
+	for _, t := range opts.Types {
+		found := false
+		for typ := uint8(knoxite.File); typ <= knoxite.Socket; typ++ {
+			if archiveTypeName(typ) == t {
+				fo.Types = append(fo.Types, typ)
+				found = true
+			}
+		}
+		if !found {
+			return fo, fmt.Errorf("unknown file type %s, use file, dir, symlink, chardev, blockdev, fifo or socket", t)
+		}
+	}
+
+	return fo, nil
+}
+
+func executeFind(pattern string, opts FindOptions) error {
+	fo, err := opts.findOptions(pattern)
+	if err != nil {
+		return err
+	}
+
+	repository, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil {
+		return err
+	}
+	repoLock, err := lockRepository(&repository, false)
+	if err != nil {
+		return err
+	}
+	defer repoLock.Unlock()
+
+	results, err := repository.FindArchives(fo)
+	if err != nil {
+		return err
+	}
+
+	var found []knoxite.FindResult
+	for r := range results {
+		if r.Error != nil {
+			// keep going, so the search can finish
+			if err == nil {
+				err = r.Error
+			}
+			continue
+		}
+		found = append(found, r)
+	}
+	if err != nil {
+		return err
+	}
+
+	// list all versions of a file in chronological order
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Archive.Path != found[j].Archive.Path {
+			return found[i].Archive.Path < found[j].Archive.Path
+		}
+		return found[i].Snapshot.Date.Before(found[j].Snapshot.Date)
+	})
+
+	tab := gotable.NewTable([]string{"Snapshot", "Date", "Perms", "Size", "ModTime", "Path"},
+		[]int64{-8, -19, -10, 12, -19, -48},
+		"No files found.")
+	for _, r := range found {
+		tab.AppendRow([]interface{}{
+			r.Snapshot.ID,
+			r.Snapshot.Date.Format(timeFormat),
+			r.Archive.Mode,
+			knoxite.SizeToString(r.Archive.Size),
+			time.Unix(r.Archive.ModTime, 0).Format(timeFormat),
+			r.Archive.Path})
+	}
+
+	_ = tab.Print()
+	return nil
+}
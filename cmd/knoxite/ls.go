@@ -48,6 +48,12 @@ func init() {
 func executeLs(snapshotID string) error {
 	repository, err := openRepository(globalOpts.Repo, globalOpts.Password)
 	if err == nil {
+		repoLock, err := lockRepository(&repository, false)
+		if err != nil {
+			return err
+		}
+		defer repoLock.Unlock()
+
 		tab := gotable.NewTable([]string{"Perms", "User", "Group", "Size", "ModTime", "Name"},
 			[]int64{-10, -8, -5, 12, -19, -48},
 			"No files found.")
@@ -64,11 +70,15 @@ func executeLs(snapshotID string) error {
 				username = u.Username
 			}
 			groupname := strconv.FormatInt(int64(archive.GID), 10)
+			size := knoxite.SizeToString(archive.Size)
+			if archive.Type == knoxite.CharDevice || archive.Type == knoxite.BlockDevice {
+				size = fmt.Sprintf("%d, %d", archive.DevMajor, archive.DevMinor)
+			}
 			tab.AppendRow([]interface{}{
 				archive.Mode,
 				username,
 				groupname,
-				knoxite.SizeToString(archive.Size),
+				size,
 				time.Unix(archive.ModTime, 0).Format(timeFormat),
 				archive.Path})
 		}
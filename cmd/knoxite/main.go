@@ -40,6 +40,7 @@ type GlobalOptions struct {
 	Repo      string
 	Alias     string
 	Password  string
+	KeyFile   string
 	ConfigURL string
 	Verbose   int
 	LogLevel  string
@@ -75,17 +76,20 @@ func main() {
 	RootCmd.PersistentFlags().StringVarP(&globalOpts.Repo, "repo", "r", "", "Repository directory to backup to/restore from (default: current working dir)")
 	RootCmd.PersistentFlags().StringVarP(&globalOpts.Alias, "alias", "R", "", "Repository alias to backup to/restore from")
 	RootCmd.PersistentFlags().StringVar(&globalOpts.Password, "password", "", "Password to use for data encryption")
+	RootCmd.PersistentFlags().StringVar(&globalOpts.KeyFile, "keyfile", "", "Key file to unlock the repository with instead of a password")
 	RootCmd.PersistentFlags().StringVarP(&globalOpts.ConfigURL, "configURL", "C", config.DefaultPath(), "Path to the configuration file")
 	RootCmd.PersistentFlags().StringVar(&globalOpts.LogLevel, "loglevel", "Print", "Verbose output. Possible levels are Debug, Info, Warning and Fatal")
 	RootCmd.PersistentFlags().CountVarP(&globalOpts.Verbose, "verbose", "v", "Verbose output on log level Info (-v) or Debug (-vv). Use --loglevel to choose between Debug, Info, Warning and Fatal")
 
 	globalOpts.Repo = os.Getenv("KNOXITE_REPOSITORY")
 	globalOpts.Password = os.Getenv("KNOXITE_PASSWORD")
+	globalOpts.KeyFile = os.Getenv("KNOXITE_KEYFILE")
 
 	// add the `completion` command via carapace
 	carapace.Gen(RootCmd).FlagCompletion(carapace.ActionMap{
 		"alias":     action.ActionAliases(RootCmd),
 		"repo":      action.ActionRepo(),
+		"keyfile":   carapace.ActionFiles(),
 		"configURL": carapace.ActionFiles(),
 		"loglevel":  carapace.ActionValues("Debug", "Info", "Warning", "Fatal"),
 	})
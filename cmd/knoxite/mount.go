@@ -15,6 +15,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"syscall"
 
@@ -59,6 +60,11 @@ func executeMount(snapshotID, mountpoint string) error {
 	if err != nil {
 		return err
 	}
+	repoLock, err := lockRepository(&repository, false)
+	if err != nil {
+		return err
+	}
+	defer repoLock.Unlock()
 	_, snapshot, err := repository.FindSnapshot(snapshotID)
 	if err != nil {
 		return err
@@ -176,11 +182,28 @@ func updateIndex(repository *knoxite.Repository, snapshot *knoxite.Snapshot) {
 			// Strip the leading slash for mounting
 			path = path[1:]
 		}
+		// hardlinks share the data of the archive they're linked to
+		if content, err := snapshot.ContentArchive(arc); err == nil && content != arc {
+			c := *content
+			c.Path = arc.Path
+			arc = &c
+		}
+
 		fmt.Println("Adding to index:", path)
 		node(path, *arc, repository)
 	}
 }
 
+// fuseRdev returns the device number of a CharDevice or BlockDevice in the 32
+// bit encoding FUSE expects on this platform.
+func fuseRdev(arc *knoxite.Archive) uint32 {
+	major, minor := arc.DevMajor, arc.DevMinor
+	if runtime.GOOS == "darwin" {
+		return major<<24 | minor&0xffffff
+	}
+	return minor&0xff | major<<8 | (minor&^0xff)<<12
+}
+
 // Attr returns this node's filesystem attributes.
 func (node *Node) Attr(ctx context.Context, a *fuse.Attr) error {
 	// fmt.Println("Attr:", node.Item.Path)
@@ -193,6 +216,16 @@ func (node *Node) Attr(ctx context.Context, a *fuse.Attr) error {
 		a.Mode |= os.ModeSymlink
 	case knoxite.Directory:
 		a.Mode |= os.ModeDir
+	case knoxite.CharDevice:
+		a.Mode |= os.ModeDevice | os.ModeCharDevice
+		a.Rdev = fuseRdev(&node.Archive)
+	case knoxite.BlockDevice:
+		a.Mode |= os.ModeDevice
+		a.Rdev = fuseRdev(&node.Archive)
+	case knoxite.FIFO:
+		a.Mode |= os.ModeNamedPipe
+	case knoxite.Socket:
+		a.Mode |= os.ModeSocket
 	}
 
 	return nil
@@ -223,6 +256,14 @@ func (node *Node) ReadDirAll(_ context.Context) ([]fuse.Dirent, error) {
 			ent.Type = fuse.DT_Dir
 		case knoxite.SymLink:
 			ent.Type = fuse.DT_Link
+		case knoxite.CharDevice:
+			ent.Type = fuse.DT_Char
+		case knoxite.BlockDevice:
+			ent.Type = fuse.DT_Block
+		case knoxite.FIFO:
+			ent.Type = fuse.DT_FIFO
+		case knoxite.Socket:
+			ent.Type = fuse.DT_Socket
 		}
 
 		entries = append(entries, ent)
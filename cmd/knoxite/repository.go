@@ -10,9 +10,12 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 
+	humanize "github.com/dustin/go-humanize"
 	shutdown "github.com/klauspost/shutdown2"
+	"github.com/muesli/goprogressbar"
 	"github.com/muesli/gotable"
 	"github.com/rsteube/carapace"
 	"github.com/spf13/cobra"
@@ -22,7 +25,36 @@ import (
 	"github.com/knoxite/knoxite/cmd/knoxite/utils"
 )
 
+// RepoInitOptions holds all the options that can be set for the 'repo init' command.
+type RepoInitOptions struct {
+	ChunkMinSize string
+	ChunkAvgSize string
+	ChunkMaxSize string
+	PackSize     string
+}
+
+// RepoKeyAddOptions holds all the options that can be set for the 'repo key add' command.
+type RepoKeyAddOptions struct {
+	Description string
+}
+
+// RepoUnlockOptions holds all the options that can be set for the 'repo unlock' command.
+type RepoUnlockOptions struct {
+	All bool
+}
+
+// RepoRotateKeyOptions holds all the options that can be set for the 'repo rotate-key' command.
+type RepoRotateKeyOptions struct {
+	Resume    bool
+	MaxChunks int
+}
+
 var (
+	repoInitOpts      = RepoInitOptions{}
+	repoKeyAddOpts    = RepoKeyAddOptions{}
+	repoUnlockOpts    = RepoUnlockOptions{}
+	repoRotateKeyOpts = RepoRotateKeyOptions{}
+
 	repoCmd = &cobra.Command{
 		Use:   "repo",
 		Short: "manage repository",
@@ -34,7 +66,7 @@ var (
 		Short: "initialize a new repository",
 		Long:  `The init command initializes a new repository`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return executeRepoInit()
+			return executeRepoInit(repoInitOpts)
 		},
 	}
 	repoChangePasswordCmd = &cobra.Command{
@@ -72,10 +104,69 @@ var (
 			return executeRepoAdd(args[0])
 		},
 	}
+	repoKeyCmd = &cobra.Command{
+		Use:   "key",
+		Short: "manage repository keys",
+		Long:  `The key command manages the key slots granting access to a repository`,
+		RunE:  nil,
+	}
+	repoKeyAddCmd = &cobra.Command{
+		Use:   "add [keyfile]",
+		Short: "add a password or key file to a repository",
+		Long:  `The add command adds a key slot unlocking the repository with another password or key file`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 1 {
+				return fmt.Errorf("add accepts at most one key file")
+			}
+			keyfile := ""
+			if len(args) == 1 {
+				keyfile = args[0]
+			}
+			return executeRepoKeyAdd(keyfile, repoKeyAddOpts)
+		},
+	}
+	repoKeyListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "list all key slots of a repository",
+		Long:  `The list command lists all key slots granting access to a repository`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return executeRepoKeyList()
+		},
+	}
+	repoKeyRemoveCmd = &cobra.Command{
+		Use:   "remove [key]",
+		Short: "remove a key slot from a repository",
+		Long:  `The remove command revokes access to a repository by removing a key slot`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("remove needs a key slot ID to work on")
+			}
+			return executeRepoKeyRemove(args[0])
+		},
+	}
+	repoUnlockCmd = &cobra.Command{
+		Use:   "unlock",
+		Short: "remove stale locks from a repository",
+		Long: `The unlock command removes locks left behind by knoxite processes which aren't running anymore.
+Use --all to also remove locks of processes which might still be running`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return executeRepoUnlock(repoUnlockOpts)
+		},
+	}
+	repoRotateKeyCmd = &cobra.Command{
+		Use:   "rotate-key",
+		Short: "replace the data key of a repository",
+		Long: `The rotate-key command replaces the key all data in a repository is encrypted with.
+Chunks get re-encrypted incrementally, an interrupted rotation can be continued with --resume.
+Chunks stored before their names got derived from a secret key get renamed as well`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return executeRepoRotateKey(repoRotateKeyOpts)
+		},
+	}
 	repoPackCmd = &cobra.Command{
 		Use:   "pack",
 		Short: "pack repository and release redundant data",
-		Long:  `The pack command deletes all unused data chunks from storage`,
+		Long:  `The pack command deletes all unused data chunks from storage. Pack files get deleted once none of their chunks are used anymore, or rewritten when too much of their space is wasted on unused chunks`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return executeRepoPack()
 		},
@@ -89,14 +180,74 @@ func init() {
 	repoCmd.AddCommand(repoInfoCmd)
 	repoCmd.AddCommand(repoAddCmd)
 	repoCmd.AddCommand(repoPackCmd)
+	repoCmd.AddCommand(repoRotateKeyCmd)
+	repoCmd.AddCommand(repoUnlockCmd)
 	RootCmd.AddCommand(repoCmd)
 
+	repoInitCmd.Flags().StringVar(&repoInitOpts.ChunkMinSize, "chunk-min-size", "", "minimum size of data chunks (default 512KiB)")
+	repoInitCmd.Flags().StringVar(&repoInitOpts.ChunkAvgSize, "chunk-avg-size", "", "average size of data chunks, must be a power of 2 (default 1MiB)")
+	repoInitCmd.Flags().StringVar(&repoInitOpts.ChunkMaxSize, "chunk-max-size", "", "maximum size of data chunks (default 8MiB)")
+	repoInitCmd.Flags().StringVar(&repoInitOpts.PackSize, "pack-size", "", "bundle data chunks into pack files of this size, e.g. 16MiB (default: store each chunk on its own)")
+
+	repoUnlockCmd.Flags().BoolVar(&repoUnlockOpts.All, "all", false, "remove all locks, even if their holders are still running")
+
+	repoRotateKeyCmd.Flags().BoolVar(&repoRotateKeyOpts.Resume, "resume", false, "continue re-encrypting the chunks of a previous rotation")
+	repoRotateKeyCmd.Flags().IntVar(&repoRotateKeyOpts.MaxChunks, "max-chunks", 0, "maximum number of chunks to re-encrypt in this run (0 for all)")
+
+	repoKeyAddCmd.Flags().StringVarP(&repoKeyAddOpts.Description, "desc", "d", "", "a description or comment for this key")
+	repoKeyCmd.AddCommand(repoKeyAddCmd)
+	repoKeyCmd.AddCommand(repoKeyListCmd)
+	repoKeyCmd.AddCommand(repoKeyRemoveCmd)
+	repoCmd.AddCommand(repoKeyCmd)
+
 	carapace.Gen(repoAddCmd).PositionalCompletion(
 		action.ActionRepo(),
 	)
+
+	carapace.Gen(repoKeyAddCmd).PositionalCompletion(
+		carapace.ActionFiles(),
+	)
+
+	carapace.Gen(repoKeyRemoveCmd).PositionalCompletion(
+		action.ActionKeySlots(repoKeyRemoveCmd),
+	)
 }
 
-func executeRepoInit() error {
+func executeRepoInit(opts RepoInitOptions) error {
+	chunker, err := knoxite.DefaultChunkerParams()
+	if err != nil {
+		return err
+	}
+	for _, size := range []struct {
+		value string
+		size  *uint
+	}{
+		{opts.ChunkMinSize, &chunker.MinSize},
+		{opts.ChunkAvgSize, &chunker.AvgSize},
+		{opts.ChunkMaxSize, &chunker.MaxSize},
+	} {
+		if size.value == "" {
+			continue
+		}
+		n, err := humanize.ParseBytes(size.value)
+		if err != nil {
+			return err
+		}
+		*size.size = uint(n)
+	}
+	// check the sizes before creating anything
+	err = chunker.Validate()
+	if err != nil {
+		return err
+	}
+	var packSize uint64
+	if opts.PackSize != "" {
+		packSize, err = humanize.ParseBytes(opts.PackSize)
+		if err != nil {
+			return err
+		}
+	}
+
 	// acquire a shutdown lock. we don't want these next calls to be interrupted
 	lock := shutdown.Lock()
 	if lock == nil {
@@ -109,6 +260,19 @@ func executeRepoInit() error {
 		return fmt.Errorf("creating repository at %s failed: %v", globalOpts.Repo, err)
 	}
 
+	if chunker.MinSize != r.Chunker.MinSize || chunker.AvgSize != r.Chunker.AvgSize || chunker.MaxSize != r.Chunker.MaxSize || packSize > 0 {
+		chunker.Polynomial = r.Chunker.Polynomial
+		err = r.SetChunkerParams(chunker)
+		if err != nil {
+			return err
+		}
+		r.PackSize = packSize
+		err = r.Save()
+		if err != nil {
+			return err
+		}
+	}
+
 	fmt.Printf("Created new repository at %s\n", (*r.BackendManager().Backends[0]).Location())
 	return nil
 }
@@ -118,6 +282,11 @@ func executeRepoChangePassword() error {
 	if err != nil {
 		return err
 	}
+	repoLock, err := lockRepository(&r, true)
+	if err != nil {
+		return err
+	}
+	defer repoLock.Unlock()
 
 	password, err := utils.ReadPasswordTwice("Enter new password:", "Confirm password:")
 	if err != nil {
@@ -133,6 +302,220 @@ func executeRepoChangePassword() error {
 	return nil
 }
 
+func executeRepoKeyAdd(keyfile string, opts RepoKeyAddOptions) error {
+	// acquire a shutdown lock. we don't want these next calls to be interrupted
+	lock := shutdown.Lock()
+	if lock == nil {
+		return nil
+	}
+	defer lock()
+
+	r, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil {
+		return err
+	}
+	repoLock, err := lockRepository(&r, true)
+	if err != nil {
+		return err
+	}
+	defer repoLock.Unlock()
+
+	var password string
+	if keyfile != "" {
+		password, err = utils.ReadKeyFile(keyfile)
+	} else {
+		password, err = utils.ReadPasswordTwice("Enter password for the new key:", "Confirm password:")
+	}
+	if err != nil {
+		return err
+	}
+
+	slot, err := r.AddKey(password, opts.Description)
+	if err != nil {
+		return err
+	}
+
+	err = r.Save()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added key %s to repository\n", slot.ID)
+	return nil
+}
+
+func executeRepoKeyList() error {
+	r, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil {
+		return err
+	}
+
+	tab := gotable.NewTable([]string{"ID", "Created", "KDF", "Description"},
+		[]int64{-9, -19, -8, -48},
+		"No keys found.")
+
+	for _, slot := range r.KeySlots() {
+		id := slot.ID
+		if id == r.KeySlot() {
+			id += "*"
+		}
+		tab.AppendRow([]interface{}{
+			id,
+			slot.Created.Format(timeFormat),
+			slot.KDF.Algorithm,
+			slot.Description})
+	}
+
+	_ = tab.Print()
+	return nil
+}
+
+func executeRepoKeyRemove(id string) error {
+	// acquire a shutdown lock. we don't want these next calls to be interrupted
+	lock := shutdown.Lock()
+	if lock == nil {
+		return nil
+	}
+	defer lock()
+
+	r, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil {
+		return err
+	}
+	repoLock, err := lockRepository(&r, true)
+	if err != nil {
+		return err
+	}
+	defer repoLock.Unlock()
+
+	err = r.RemoveKey(id)
+	if err != nil {
+		return err
+	}
+
+	err = r.Save()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed key %s from repository\n", id)
+	return nil
+}
+
+func executeRepoRotateKey(opts RepoRotateKeyOptions) error {
+	// acquire a shutdown lock. we don't want these next calls to be interrupted
+	lock := shutdown.Lock()
+	if lock == nil {
+		return nil
+	}
+	defer lock()
+
+	r, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil {
+		return err
+	}
+	repoLock, err := lockRepository(&r, true)
+	if err != nil {
+		return err
+	}
+	defer repoLock.Unlock()
+	index, err := knoxite.OpenChunkIndex(&r)
+	if err != nil {
+		return err
+	}
+
+	if opts.Resume {
+		if !r.IsRotating() {
+			return fmt.Errorf("there is no key rotation in progress")
+		}
+	} else {
+		err = r.RotateKey(&index)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Rotated repository key to generation %d\n", r.KeyGeneration)
+	}
+
+	progress, err := knoxite.RotateChunks(&r, &index, opts.MaxChunks)
+	if err != nil {
+		return err
+	}
+
+	pb := &goprogressbar.ProgressBar{Total: 1000, Width: 40}
+	for p := range progress {
+		if p.Error != nil {
+			fmt.Println()
+			return p.Error
+		}
+
+		pb.Total = int64(p.TotalStatistics.Size)
+		pb.Current = int64(p.TotalStatistics.Transferred)
+		pb.PrependText = fmt.Sprintf("%s / %s",
+			knoxite.SizeToString(uint64(pb.Current)),
+			knoxite.SizeToString(uint64(pb.Total)))
+		pb.Text = "Re-encrypting chunks"
+		pb.LazyPrint()
+	}
+	fmt.Println()
+
+	if r.IsRotating() {
+		fmt.Printf("Some chunks still use a retired key, continue with 'repo rotate-key --resume'\n")
+	} else {
+		fmt.Printf("All chunks are encrypted with the new key\n")
+	}
+	return nil
+}
+
+func executeRepoUnlock(opts RepoUnlockOptions) error {
+	r, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil && !errors.Is(err, knoxite.ErrRepositoryLocked) {
+		// a lock left behind keeps the repository from getting migrated, but
+		// can still be removed
+		return err
+	}
+
+	locks, err := r.Locks()
+	if err != nil {
+		return err
+	}
+
+	tab := gotable.NewTable([]string{"ID", "Type", "Holder", "Host", "PID", "Created", "Status"},
+		[]int64{-9, -9, -12, -16, 7, -19, -8},
+		"No stale locks found.")
+
+	for _, l := range locks {
+		stale := l.IsStale()
+		if !stale && !opts.All {
+			continue
+		}
+		if err := r.RemoveLock(l.ID); err != nil {
+			return err
+		}
+
+		kind := "shared"
+		if l.Exclusive {
+			kind = "exclusive"
+		}
+		status := "active"
+		if stale {
+			status = "stale"
+		}
+		created := ""
+		if !l.Created.IsZero() {
+			created = l.Created.Format(timeFormat)
+		}
+		tab.AppendRow([]interface{}{
+			l.ID,
+			kind,
+			l.Holder,
+			l.Host,
+			l.PID,
+			created,
+			status})
+	}
+
+	_ = tab.Print()
+	return nil
+}
+
 func executeRepoAdd(url string) error {
 	// acquire a shutdown lock. we don't want these next calls to be interrupted
 	lock := shutdown.Lock()
@@ -145,6 +528,11 @@ func executeRepoAdd(url string) error {
 	if err != nil {
 		return err
 	}
+	repoLock, err := lockRepository(&r, true)
+	if err != nil {
+		return err
+	}
+	defer repoLock.Unlock()
 
 	backend, err := knoxite.BackendFromURL(url)
 	if err != nil {
@@ -185,6 +573,11 @@ func executeRepoPack() error {
 	if err != nil {
 		return err
 	}
+	repoLock, err := lockRepository(&r, true)
+	if err != nil {
+		return err
+	}
+	defer repoLock.Unlock()
 	index, err := knoxite.OpenChunkIndex(&r)
 	if err != nil {
 		return err
@@ -222,10 +615,41 @@ func executeRepoInfo() error {
 	}
 
 	_ = tab.Print()
+
+	fmt.Printf("\nChunk sizes: min %s, avg %s, max %s\n",
+		knoxite.SizeToString(uint64(r.Chunker.MinSize)),
+		knoxite.SizeToString(uint64(r.Chunker.AvgSize)),
+		knoxite.SizeToString(uint64(r.Chunker.MaxSize)))
+	if r.PackSize > 0 {
+		fmt.Printf("Pack size: %s\n", knoxite.SizeToString(r.PackSize))
+	}
 	return nil
 }
 
+// lockRepository locks the repository, so no other knoxite process can
+// interfere. Operations which only read from a repository can share a lock.
+func lockRepository(r *knoxite.Repository, exclusive bool) (*knoxite.Lock, error) {
+	lock, err := r.Lock(exclusive)
+	return lock, explainLocked(err)
+}
+
+// explainLocked tells the user how to get rid of a lock, which might have been
+// left behind.
+func explainLocked(err error) error {
+	if errors.Is(err, knoxite.ErrRepositoryLocked) {
+		return fmt.Errorf("%w\nIf no other knoxite process is using this repository, remove the lock with 'knoxite repo unlock'", err)
+	}
+	return err
+}
+
 func openRepository(path, password string) (knoxite.Repository, error) {
+	if globalOpts.KeyFile != "" {
+		var err error
+		password, err = utils.ReadKeyFile(globalOpts.KeyFile)
+		if err != nil {
+			return knoxite.Repository{}, err
+		}
+	}
 	if password == "" {
 		var err error
 		password, err = utils.ReadPassword("Enter password:")
@@ -234,7 +658,10 @@ func openRepository(path, password string) (knoxite.Repository, error) {
 		}
 	}
 
-	return knoxite.OpenRepository(path, password)
+	// repositories get migrated while opening them, which needs an exclusive
+	// lock
+	repository, err := knoxite.OpenRepository(path, password)
+	return repository, explainLocked(err)
 }
 
 func newRepository(path, password string) (knoxite.Repository, error) {
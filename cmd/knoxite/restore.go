@@ -19,6 +19,7 @@ import (
 
 	"github.com/knoxite/knoxite"
 	"github.com/knoxite/knoxite/cmd/knoxite/action"
+	"github.com/knoxite/knoxite/cmd/knoxite/utils"
 )
 
 // Error declarations.
@@ -27,8 +28,14 @@ var (
 )
 
 type RestoreOptions struct {
-	Excludes []string
-	Pedantic bool
+	SnapshotFilterOptions
+	Excludes        []string
+	Includes        []string
+	StripComponents int
+	Mode            string
+	Pedantic        bool
+	XAttrs          bool
+	NoXAttrs        bool
 }
 
 var (
@@ -37,7 +44,11 @@ var (
 	restoreCmd = &cobra.Command{
 		Use:   "restore [snapshot] [destination]",
 		Short: "restore a snapshot",
-		Long:  `The restore command restores a snapshot to a directory`,
+		Long: `The restore command restores a snapshot to a directory. Use --include to
+only restore matching files and directories, using the same gitignore-style
+patterns as --excludes, e.g. 'home/alice/' or '*.txt'. When restoring
+a reference like 'latest' or '@2021-10-01', --host, --tag and --path limit which
+snapshots are considered`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if len(args) < 1 {
 				return fmt.Errorf("restore needs to know which snapshot to work on")
@@ -68,8 +79,14 @@ func configureRestoreOpts(cmd *cobra.Command, opts *RestoreOptions) {
 }
 
 func initRestoreFlags(f func() *pflag.FlagSet) {
-	f().StringArrayVarP(&restoreOpts.Excludes, "excludes", "x", []string{}, "list of excludes")
+	f().StringArrayVarP(&restoreOpts.Excludes, "excludes", "x", []string{}, "list of gitignore-style excludes")
+	f().StringArrayVar(&restoreOpts.Includes, "include", []string{}, "only restore files & directories matching these patterns")
+	f().IntVar(&restoreOpts.StripComponents, "strip-components", 0, "remove this many leading path elements when restoring")
+	f().StringVar(&restoreOpts.Mode, "mode", "overwrite", "how to handle existing files: overwrite, skip-existing, if-newer, resume")
 	f().BoolVar(&restoreOpts.Pedantic, "pedantic", false, "exit on first error")
+	f().BoolVar(&restoreOpts.XAttrs, "xattrs", true, "restore extended attributes, ACLs & file capabilities")
+	f().BoolVar(&restoreOpts.NoXAttrs, "no-xattrs", false, "don't restore extended attributes, ACLs & file capabilities")
+	initSnapshotFilterFlags(f(), &restoreOpts.SnapshotFilterOptions)
 }
 
 func init() {
@@ -80,20 +97,48 @@ func init() {
 		action.ActionSnapshots(restoreCmd, ""),
 		carapace.ActionDirectories(),
 	)
+	carapace.Gen(restoreCmd).FlagCompletion(carapace.ActionMap{
+		"mode": carapace.ActionValuesDescribed(
+			"overwrite", "replace existing files",
+			"skip-existing", "leave existing files untouched",
+			"if-newer", "only replace files older than the snapshot's version",
+			"resume", "only fetch missing or mismatching parts of existing files",
+		),
+	})
 }
 
 func executeRestore(snapshotID, target string, opts RestoreOptions) error {
+	if opts.StripComponents < 0 {
+		return fmt.Errorf("--strip-components can't be negative")
+	}
+	mode, err := utils.RestoreModeFromString(opts.Mode)
+	if err != nil {
+		return err
+	}
+
 	repository, err := openRepository(globalOpts.Repo, globalOpts.Password)
 	if err != nil {
 		return err
 	}
+	repoLock, err := lockRepository(&repository, false)
+	if err != nil {
+		return err
+	}
+	defer repoLock.Unlock()
 
-	_, snapshot, err := repository.FindSnapshot(snapshotID)
+	_, snapshot, err := repository.ResolveSnapshot(snapshotID, opts.filter())
 	if err != nil {
 		return err
 	}
 
-	progress, err := knoxite.DecodeSnapshot(repository, snapshot, target, opts.Excludes, opts.Pedantic)
+	progress, err := knoxite.DecodeSnapshot(repository, snapshot, target, knoxite.RestoreOptions{
+		Excludes:        opts.Excludes,
+		Includes:        opts.Includes,
+		StripComponents: opts.StripComponents,
+		Mode:            mode,
+		Pedantic:        opts.Pedantic,
+		XAttrs:          opts.XAttrs && !opts.NoXAttrs,
+	})
 	if err != nil {
 		return err
 	}
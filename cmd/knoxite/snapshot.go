@@ -9,20 +9,58 @@ package main
 
 import (
 	"fmt"
+	"path/filepath"
+	"strings"
 
 	"github.com/muesli/gotable"
 	"github.com/rsteube/carapace"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 
 	"github.com/knoxite/knoxite"
 	"github.com/knoxite/knoxite/cmd/knoxite/action"
 )
 
+// SnapshotFilterOptions holds the options selecting snapshots by their
+// metadata.
+type SnapshotFilterOptions struct {
+	Hosts []string
+	Tags  []string
+	Paths []string
+}
+
+// SnapshotForgetOptions holds all the options that can be set for the 'snapshot forget' command.
+type SnapshotForgetOptions struct {
+	SnapshotFilterOptions
+
+	KeepLast    int
+	KeepHourly  int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	KeepYearly  int
+	KeepWithin  string
+	DryRun      bool
+	Pack        bool
+}
+
 var (
+	snapshotListOpts   = SnapshotFilterOptions{}
+	snapshotForgetOpts = SnapshotForgetOptions{}
+
 	snapshotCmd = &cobra.Command{
 		Use:   "snapshot",
 		Short: "manage snapshots",
-		Long:  `The snapshot command manages snapshots`,
+		Long: `The snapshot command manages snapshots.
+
+Wherever a snapshot is expected, it can be referred to by its ID or relative
+to other snapshots, optionally limited to a volume given by its ID or name:
+
+  latest                  the most recent snapshot
+  vol:latest              the most recent snapshot of volume vol
+  latest~2                two snapshots before the most recent one
+  @2021-10-01             the most recent snapshot made on that day or before
+  @"2021-10-01 12:00:00"  the most recent snapshot made at that time or before`,
 		RunE:  nil,
 	}
 	snapshotListCmd = &cobra.Command{
@@ -33,7 +71,7 @@ var (
 			if len(args) != 1 {
 				return fmt.Errorf("list needs a volume ID to work on")
 			}
-			return executeSnapshotList(args[0])
+			return executeSnapshotList(args[0], snapshotListOpts)
 		},
 	}
 	snapshotRemoveCmd = &cobra.Command{
@@ -47,13 +85,124 @@ var (
 			return executeSnapshotRemove(args[0])
 		},
 	}
+	snapshotTagCmd = &cobra.Command{
+		Use:   "tag",
+		Short: "manage snapshot tags",
+		Long:  `The tag command manages the tags of a snapshot`,
+		RunE:  nil,
+	}
+	snapshotTagAddCmd = &cobra.Command{
+		Use:   "add [snapshot] [tag] [...]",
+		Short: "add tags to a snapshot",
+		Long:  `The add command adds tags to a snapshot`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 2 {
+				return fmt.Errorf("add needs a snapshot ID and at least one tag")
+			}
+			return executeSnapshotTag(args[0], args[1:], nil)
+		},
+	}
+	snapshotTagRemoveCmd = &cobra.Command{
+		Use:   "remove [snapshot] [tag] [...]",
+		Short: "remove tags from a snapshot",
+		Long:  `The remove command removes tags from a snapshot`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 2 {
+				return fmt.Errorf("remove needs a snapshot ID and at least one tag")
+			}
+			return executeSnapshotTag(args[0], nil, args[1:])
+		},
+	}
+	snapshotForgetCmd = &cobra.Command{
+		Use:   "forget [volume]",
+		Short: "remove snapshots according to a retention policy",
+		Long: `The forget command removes all snapshots of a volume which aren't kept by the retention policy.
+If no volume is given, the policy gets applied to all volumes`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 1 {
+				return fmt.Errorf("forget needs at most one volume ID to work on")
+			}
+			configureSnapshotForgetOpts(cmd, &snapshotForgetOpts)
+			return executeSnapshotForget(args, snapshotForgetOpts)
+		},
+	}
 )
 
+// initSnapshotFilterFlags adds the flags selecting snapshots by their
+// metadata to a command.
+func initSnapshotFilterFlags(f *pflag.FlagSet, opts *SnapshotFilterOptions) {
+	f.StringArrayVar(&opts.Hosts, "host", []string{}, "only consider snapshots created on this host")
+	f.StringArrayVar(&opts.Tags, "tag", []string{}, "only consider snapshots with this tag")
+	f.StringArrayVar(&opts.Paths, "path", []string{}, "only consider snapshots containing this source path")
+}
+
+// filter returns the snapshot filter described by opts.
+func (opts SnapshotFilterOptions) filter() knoxite.SnapshotFilter {
+	var paths []string
+	for _, path := range opts.Paths {
+		if absPath, err := filepath.Abs(path); err == nil {
+			path = absPath
+		}
+		paths = append(paths, path)
+	}
+
+	return knoxite.SnapshotFilter{
+		Hosts: opts.Hosts,
+		Tags:  opts.Tags,
+		Paths: paths,
+	}
+}
+
+// configureSnapshotForgetOpts fills in the retention policy stored in the
+// configuration file for all flags the user didn't set.
+func configureSnapshotForgetOpts(cmd *cobra.Command, opts *SnapshotForgetOptions) {
+	if rep, ok := cfg.Repositories[globalOpts.Alias]; ok {
+		if !cmd.Flags().Changed("keep-last") {
+			opts.KeepLast = rep.KeepLast
+		}
+		if !cmd.Flags().Changed("keep-hourly") {
+			opts.KeepHourly = rep.KeepHourly
+		}
+		if !cmd.Flags().Changed("keep-daily") {
+			opts.KeepDaily = rep.KeepDaily
+		}
+		if !cmd.Flags().Changed("keep-weekly") {
+			opts.KeepWeekly = rep.KeepWeekly
+		}
+		if !cmd.Flags().Changed("keep-monthly") {
+			opts.KeepMonthly = rep.KeepMonthly
+		}
+		if !cmd.Flags().Changed("keep-yearly") {
+			opts.KeepYearly = rep.KeepYearly
+		}
+		if !cmd.Flags().Changed("keep-within") {
+			opts.KeepWithin = rep.KeepWithin
+		}
+	}
+}
+
 func init() {
 	snapshotCmd.AddCommand(snapshotListCmd)
 	snapshotCmd.AddCommand(snapshotRemoveCmd)
+	snapshotCmd.AddCommand(snapshotForgetCmd)
+	snapshotCmd.AddCommand(snapshotTagCmd)
+	snapshotTagCmd.AddCommand(snapshotTagAddCmd)
+	snapshotTagCmd.AddCommand(snapshotTagRemoveCmd)
 	RootCmd.AddCommand(snapshotCmd)
 
+	initSnapshotFilterFlags(snapshotListCmd.Flags(), &snapshotListOpts)
+	initSnapshotFilterFlags(snapshotForgetCmd.Flags(), &snapshotForgetOpts.SnapshotFilterOptions)
+
+	snapshotForgetCmd.Flags().IntVar(&snapshotForgetOpts.KeepLast, "keep-last", 0, "keep the n most recent snapshots")
+	snapshotForgetCmd.Flags().IntVar(&snapshotForgetOpts.KeepHourly, "keep-hourly", 0, "keep the most recent snapshot of the last n hours")
+	snapshotForgetCmd.Flags().IntVar(&snapshotForgetOpts.KeepDaily, "keep-daily", 0, "keep the most recent snapshot of the last n days")
+	snapshotForgetCmd.Flags().IntVar(&snapshotForgetOpts.KeepWeekly, "keep-weekly", 0, "keep the most recent snapshot of the last n weeks")
+	snapshotForgetCmd.Flags().IntVar(&snapshotForgetOpts.KeepMonthly, "keep-monthly", 0, "keep the most recent snapshot of the last n months")
+	snapshotForgetCmd.Flags().IntVar(&snapshotForgetOpts.KeepYearly, "keep-yearly", 0, "keep the most recent snapshot of the last n years")
+	snapshotForgetCmd.Flags().StringVar(&snapshotForgetOpts.KeepWithin, "keep-within", "", "keep all snapshots made within this duration of the latest snapshot, e.g. 1y6m2w3d4h")
+	snapshotForgetCmd.Flags().BoolVarP(&snapshotForgetOpts.DryRun, "dry-run", "n", false, "only show which snapshots would be removed")
+	snapshotForgetCmd.Flags().BoolVar(&snapshotForgetOpts.Pack, "pack", false, "delete un-referenced chunks afterwards")
+
 	carapace.Gen(snapshotListCmd).PositionalCompletion(
 		action.ActionVolumes(snapshotListCmd),
 	)
@@ -61,6 +210,124 @@ func init() {
 	carapace.Gen(snapshotRemoveCmd).PositionalCompletion(
 		action.ActionSnapshots(snapshotRemoveCmd, ""),
 	)
+
+	carapace.Gen(snapshotForgetCmd).PositionalCompletion(
+		action.ActionVolumes(snapshotForgetCmd),
+	)
+
+	carapace.Gen(snapshotTagAddCmd).PositionalCompletion(
+		action.ActionSnapshots(snapshotTagAddCmd, ""),
+	)
+
+	carapace.Gen(snapshotTagRemoveCmd).PositionalCompletion(
+		action.ActionSnapshots(snapshotTagRemoveCmd, ""),
+	)
+}
+
+func executeSnapshotForget(args []string, opts SnapshotForgetOptions) error {
+	policy := knoxite.RetentionPolicy{
+		KeepLast:    opts.KeepLast,
+		KeepHourly:  opts.KeepHourly,
+		KeepDaily:   opts.KeepDaily,
+		KeepWeekly:  opts.KeepWeekly,
+		KeepMonthly: opts.KeepMonthly,
+		KeepYearly:  opts.KeepYearly,
+	}
+	if opts.KeepWithin != "" {
+		d, err := knoxite.ParseRetentionDuration(opts.KeepWithin)
+		if err != nil {
+			return err
+		}
+		policy.KeepWithin = d
+	}
+	if policy.IsEmpty() {
+		return fmt.Errorf("forget needs a retention policy, e.g. --keep-last 7")
+	}
+
+	repository, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil {
+		return err
+	}
+	repoLock, err := lockRepository(&repository, true)
+	if err != nil {
+		return err
+	}
+	defer repoLock.Unlock()
+	chunkIndex, err := knoxite.OpenChunkIndex(&repository)
+	if err != nil {
+		return err
+	}
+
+	volumes := repository.Volumes
+	if len(args) > 0 {
+		volume, err := repository.FindVolume(args[0])
+		if err != nil {
+			return err
+		}
+		volumes = []*knoxite.Volume{volume}
+	}
+
+	removed := 0
+	for _, volume := range volumes {
+		decisions, err := volume.Forget(&repository, &chunkIndex, policy, opts.filter(), opts.DryRun)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Volume %s: %s\n", volume.ID, volume.Name)
+		tab := gotable.NewTable([]string{"ID", "Date", "Action", "Reasons"},
+			[]int64{-8, -19, -6, -48}, "No snapshots found. This volume is empty.")
+		for _, d := range decisions {
+			act := "keep"
+			if !d.Keep {
+				act = "remove"
+				removed++
+			}
+			tab.AppendRow([]interface{}{
+				d.Snapshot.ID,
+				d.Snapshot.Date.Format(timeFormat),
+				act,
+				strings.Join(d.Reasons, ", ")})
+		}
+		_ = tab.Print()
+		fmt.Println()
+	}
+
+	if opts.DryRun {
+		fmt.Printf("Would remove %d snapshots.\n", removed)
+		return nil
+	}
+	if removed == 0 {
+		fmt.Println("No snapshots removed.")
+		return nil
+	}
+
+	err = chunkIndex.Save(&repository)
+	if err != nil {
+		return err
+	}
+	err = repository.Save()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed %d snapshots.\n", removed)
+
+	if !opts.Pack {
+		fmt.Println("Do not forget to run 'repo pack' to delete un-referenced chunks and free up storage space!")
+		return nil
+	}
+
+	freedSize, err := chunkIndex.Pack(&repository)
+	if err != nil {
+		return err
+	}
+	err = chunkIndex.Save(&repository)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Freed storage space: %s\n", knoxite.SizeToString(freedSize))
+	return nil
 }
 
 func executeSnapshotRemove(snapshotID string) error {
@@ -68,6 +335,11 @@ func executeSnapshotRemove(snapshotID string) error {
 	if err != nil {
 		return err
 	}
+	repoLock, err := lockRepository(&repository, true)
+	if err != nil {
+		return err
+	}
+	defer repoLock.Unlock()
 	chunkIndex, err := knoxite.OpenChunkIndex(&repository)
 	if err != nil {
 		return err
@@ -99,7 +371,34 @@ func executeSnapshotRemove(snapshotID string) error {
 	return nil
 }
 
-func executeSnapshotList(volID string) error {
+func executeSnapshotTag(snapshotID string, add, remove []string) error {
+	repository, err := openRepository(globalOpts.Repo, globalOpts.Password)
+	if err != nil {
+		return err
+	}
+	repoLock, err := lockRepository(&repository, true)
+	if err != nil {
+		return err
+	}
+	defer repoLock.Unlock()
+
+	_, snapshot, err := repository.FindSnapshot(snapshotID)
+	if err != nil {
+		return err
+	}
+
+	snapshot.AddTags(add...)
+	snapshot.RemoveTags(remove...)
+	err = snapshot.Save(&repository)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Snapshot %s tags: %s\n", snapshot.ID, strings.Join(snapshot.Tags, ", "))
+	return nil
+}
+
+func executeSnapshotList(volID string, opts SnapshotFilterOptions) error {
 	repository, err := openRepository(globalOpts.Repo, globalOpts.Password)
 	if err != nil {
 		return err
@@ -110,19 +409,26 @@ func executeSnapshotList(volID string) error {
 		return err
 	}
 
-	tab := gotable.NewTable([]string{"ID", "Date", "Original Size", "Storage Size", "Description"},
-		[]int64{-8, -19, 13, 12, -48}, "No snapshots found. This volume is empty.")
+	tab := gotable.NewTable([]string{"ID", "Date", "Host", "Tags", "Original Size", "Storage Size", "Description"},
+		[]int64{-8, -19, -12, -16, 13, 12, -32}, "No snapshots found. This volume is empty.")
 	totalSize := uint64(0)
 	totalStorageSize := uint64(0)
 
+	filter := opts.filter()
 	for _, snapshotID := range volume.Snapshots {
 		snapshot, err := volume.LoadSnapshot(snapshotID, &repository)
 		if err != nil {
 			return err
 		}
+		if !filter.Match(snapshot) {
+			continue
+		}
+
 		tab.AppendRow([]interface{}{
 			snapshot.ID,
 			snapshot.Date.Format(timeFormat),
+			snapshot.Hostname,
+			strings.Join(snapshot.Tags, ","),
 			knoxite.SizeToString(snapshot.Stats.Size),
 			knoxite.SizeToString(snapshot.Stats.StorageSize),
 			snapshot.Description})
@@ -130,7 +436,7 @@ func executeSnapshotList(volID string) error {
 		totalStorageSize += snapshot.Stats.StorageSize
 	}
 
-	tab.SetSummary([]interface{}{"", "", knoxite.SizeToString(totalSize), knoxite.SizeToString(totalStorageSize), ""})
+	tab.SetSummary([]interface{}{"", "", "", "", knoxite.SizeToString(totalSize), knoxite.SizeToString(totalStorageSize), ""})
 	_ = tab.Print()
 	return nil
 }
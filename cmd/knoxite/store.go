@@ -10,8 +10,13 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"time"
 
 	humanize "github.com/dustin/go-humanize"
@@ -32,12 +37,30 @@ var (
 
 // StoreOptions holds all the options that can be set for the 'store' command.
 type StoreOptions struct {
-	Description      string
-	Compression      string
-	Encryption       string
-	FailureTolerance uint
-	Excludes         []string
-	Pedantic         bool
+	Description       string
+	Tags              []string
+	Compression       string
+	Encryption        string
+	FailureTolerance  uint
+	Excludes          []string
+	ExcludeFiles      []string
+	ExcludeIfPresent  []string
+	ExcludeCaches     bool
+	OneFileSystem     bool
+	ExcludeLargerThan string
+	NewerThan         string
+	OlderThan         string
+	Pedantic          bool
+	Parent            string
+	ForceRehash       bool
+	Jobs              int
+	EncodeJobs        int
+	UploadJobs        int
+	XAttrs            bool
+	NoXAttrs          bool
+	Stdin             bool
+	StdinFilename     string
+	StdinCommand      string
 }
 
 var (
@@ -46,12 +69,13 @@ var (
 	storeCmd = &cobra.Command{
 		Use:   "store [volume] [dir/file] [...]",
 		Short: "store files/directories",
-		Long:  `The store command creates a snapshot of a file or directory`,
+		Long: `The store command creates a snapshot of a file or directory. With --stdin,
+data read from the standard input gets stored as a file, e.g. a database dump`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if len(args) < 1 {
 				return fmt.Errorf("store needs to know which volume to create a snapshot in")
 			}
-			if len(args) < 2 {
+			if len(args) < 2 && !storeOpts.Stdin && storeOpts.StdinCommand == "" {
 				return fmt.Errorf("store needs to know which files and/or directories to work on")
 			}
 
@@ -82,20 +106,49 @@ func configureStoreOpts(cmd *cobra.Command, opts *StoreOptions) {
 		if !cmd.Flags().Changed("pedantic") {
 			opts.Pedantic = rep.Pedantic
 		}
+		if !cmd.Flags().Changed("jobs") {
+			opts.Jobs = rep.Jobs
+		}
+		if !cmd.Flags().Changed("encode-jobs") {
+			opts.EncodeJobs = rep.EncodeJobs
+		}
+		if !cmd.Flags().Changed("upload-jobs") {
+			opts.UploadJobs = rep.UploadJobs
+		}
 	}
 }
 
 func initStoreFlags(cmd *cobra.Command, opts *StoreOptions) {
 	cmd.Flags().StringVarP(&opts.Description, "desc", "d", "", "a description or comment for this volume")
+	cmd.Flags().StringArrayVar(&opts.Tags, "tag", []string{}, "tag the snapshot, can be given multiple times")
 	cmd.Flags().StringVarP(&opts.Compression, "compression", "c", "", "compression algo to use: none (default), flate, gzip, lzma, zlib, zstd")
-	cmd.Flags().StringVarP(&opts.Encryption, "encryption", "e", "", "encryption algo to use: aes (default), none")
+	cmd.Flags().StringVarP(&opts.Encryption, "encryption", "e", "", "encryption algo to use: aes-gcm (default), chacha20-poly1305, aes-cfb (legacy), none")
 	cmd.Flags().UintVarP(&opts.FailureTolerance, "tolerance", "t", 0, "failure tolerance against n backend failures")
-	cmd.Flags().StringArrayVarP(&opts.Excludes, "excludes", "x", []string{}, "list of excludes")
+	cmd.Flags().StringArrayVarP(&opts.Excludes, "excludes", "x", []string{}, "list of gitignore-style excludes")
+	cmd.Flags().StringArrayVar(&opts.ExcludeFiles, "exclude-file", []string{}, "read gitignore-style excludes from a file")
+	cmd.Flags().StringArrayVar(&opts.ExcludeIfPresent, "exclude-if-present", []string{}, "exclude directories containing a file with this name, e.g. .nobackup")
+	cmd.Flags().BoolVar(&opts.ExcludeCaches, "exclude-caches", false, "exclude directories containing a CACHEDIR.TAG file")
+	cmd.Flags().BoolVar(&opts.OneFileSystem, "one-file-system", false, "don't descend into directories on other file systems")
+	cmd.Flags().StringVar(&opts.ExcludeLargerThan, "exclude-larger-than", "", "skip files larger than this size, e.g. 1GiB")
+	cmd.Flags().StringVar(&opts.NewerThan, "newer-than", "", "only store files modified after this date (YYYY-MM-DD [HH:MM:SS]) or duration ago, e.g. 7d")
+	cmd.Flags().StringVar(&opts.OlderThan, "older-than", "", "only store files modified before this date (YYYY-MM-DD [HH:MM:SS]) or duration ago, e.g. 7d")
 	cmd.Flags().BoolVar(&opts.Pedantic, "pedantic", false, "exit on first error")
+	cmd.Flags().StringVar(&opts.Parent, "parent", "", "snapshot to compare against to skip unchanged files (default: the latest snapshot)")
+	cmd.Flags().BoolVar(&opts.ForceRehash, "force-rehash", false, "read all files, even if they haven't changed since the parent snapshot")
+	cmd.Flags().IntVarP(&opts.Jobs, "jobs", "j", 0, "number of files to read at the same time (default 1)")
+	cmd.Flags().IntVar(&opts.EncodeJobs, "encode-jobs", 0, "number of chunks to compress & encrypt at the same time (default 4)")
+	cmd.Flags().IntVar(&opts.UploadJobs, "upload-jobs", 0, "number of chunks to upload to each backend at the same time (default 1)")
+	cmd.Flags().BoolVar(&opts.XAttrs, "xattrs", true, "store extended attributes, ACLs & file capabilities")
+	cmd.Flags().BoolVar(&opts.NoXAttrs, "no-xattrs", false, "don't store extended attributes, ACLs & file capabilities")
+	cmd.Flags().BoolVar(&opts.Stdin, "stdin", false, "store data read from stdin as a file")
+	cmd.Flags().StringVar(&opts.StdinFilename, "stdin-filename", "stdin", "file name to store data read from stdin as")
+	cmd.Flags().StringVar(&opts.StdinCommand, "stdin-from-command", "", "store the output of this shell command as a file, failing if the command does")
 
 	carapace.Gen(cmd).FlagCompletion(carapace.ActionMap{
-		"compression": carapace.ActionValues("none", "flate", "gzip", "lzma", "zlib", "zstd"),
-		"encryption":  carapace.ActionValues("aes", "none"),
+		"compression":  carapace.ActionValues("none", "flate", "gzip", "lzma", "zlib", "zstd"),
+		"encryption":   carapace.ActionValues("aes-gcm", "chacha20-poly1305", "aes-cfb", "none"),
+		"exclude-file": carapace.ActionFiles(),
+		"parent":       action.ActionSnapshots(cmd, ""),
 	})
 }
 
@@ -112,7 +165,33 @@ func init() {
 	)
 }
 
-func store(repository *knoxite.Repository, chunkIndex *knoxite.ChunkIndex, snapshot *knoxite.Snapshot, targets []string, opts StoreOptions) error {
+// findParentSnapshot returns the snapshot unchanged files get compared
+// against: either the one set with --parent or the volume's latest snapshot
+// of the same targets made on this host.
+func findParentSnapshot(repository *knoxite.Repository, volume *knoxite.Volume, targets []string, opts StoreOptions) (*knoxite.Snapshot, error) {
+	if opts.ForceRehash {
+		return nil, nil
+	}
+	if opts.Parent != "" {
+		_, parent, err := repository.FindSnapshot(opts.Parent)
+		return parent, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	_, parent, err := repository.ResolveSnapshot(volume.ID+":latest", knoxite.SnapshotFilter{
+		Hosts: []string{hostname},
+		Paths: targets,
+	})
+	if errors.Is(err, knoxite.ErrSnapshotNotFound) {
+		return nil, nil
+	}
+	return parent, err
+}
+
+func store(repository *knoxite.Repository, chunkIndex *knoxite.ChunkIndex, snapshot *knoxite.Snapshot, parent *knoxite.Snapshot, targets []string, opts StoreOptions) error {
 	// we want to be notified during the first phase of a shutdown
 	cancel := shutdown.First()
 
@@ -134,14 +213,55 @@ func store(repository *knoxite.Repository, chunkIndex *knoxite.ChunkIndex, snaps
 	}
 
 	so := knoxite.StoreOptions{
-		CWD:         wd,
-		Paths:       targets,
-		Excludes:    opts.Excludes,
-		Compress:    compression,
-		Encrypt:     encryption,
-		Pedantic:    opts.Pedantic,
-		DataParts:   uint(len(repository.BackendManager().Backends) - int(opts.FailureTolerance)),
-		ParityParts: opts.FailureTolerance,
+		CWD:              wd,
+		Paths:            targets,
+		Excludes:         opts.Excludes,
+		ExcludeFiles:     opts.ExcludeFiles,
+		ExcludeIfPresent: opts.ExcludeIfPresent,
+		ExcludeCaches:    opts.ExcludeCaches,
+		OneFileSystem:    opts.OneFileSystem,
+		Compress:         compression,
+		Encrypt:          encryption,
+		Pedantic:         opts.Pedantic,
+		DataParts:        uint(len(repository.BackendManager().Backends) - int(opts.FailureTolerance)),
+		ParityParts:      opts.FailureTolerance,
+		Parent:           parent,
+		Jobs:             opts.Jobs,
+		EncodeJobs:       opts.EncodeJobs,
+		UploadJobs:       opts.UploadJobs,
+		XAttrs:           opts.XAttrs && !opts.NoXAttrs,
+	}
+
+	snapshot.AddTags(opts.Tags...)
+
+	if opts.ExcludeLargerThan != "" {
+		if so.ExcludeLargerThan, err = humanize.ParseBytes(opts.ExcludeLargerThan); err != nil {
+			return err
+		}
+	}
+	if opts.NewerThan != "" {
+		if so.NewerThan, err = parseAge(opts.NewerThan); err != nil {
+			return err
+		}
+	}
+	if opts.OlderThan != "" {
+		if so.OlderThan, err = parseAge(opts.OlderThan); err != nil {
+			return err
+		}
+	}
+
+	var stdinCmd *commandReader
+	if opts.StdinCommand != "" {
+		stdinCmd, err = newCommandReader(opts.StdinCommand)
+		if err != nil {
+			return err
+		}
+		defer stdinCmd.Close()
+		so.Stdin = stdinCmd
+		so.StdinFilename = opts.StdinFilename
+	} else if opts.Stdin {
+		so.Stdin = os.Stdin
+		so.StdinFilename = opts.StdinFilename
 	}
 
 	startTime := time.Now()
@@ -162,7 +282,8 @@ func store(repository *knoxite.Repository, chunkIndex *knoxite.ChunkIndex, snaps
 	pb.AddProgressBar(overallProgressBar)
 	lastPath := ""
 
-	items := int64(1)
+	// with multiple jobs the progress of several files is interleaved
+	seen := make(map[string]bool)
 	errs := make(map[string]error)
 	for p := range progress {
 		select {
@@ -181,9 +302,9 @@ func store(repository *knoxite.Repository, chunkIndex *knoxite.ChunkIndex, snaps
 				snapshot.Stats.Errors++
 			}
 			if p.Path != lastPath && lastPath != "" {
-				items++
 				fmt.Println()
 			}
+			seen[p.Path] = true
 			fileProgressBar.Total = int64(p.CurrentItemStats.Size)
 			fileProgressBar.Current = int64(p.CurrentItemStats.Transferred)
 			fileProgressBar.PrependText = fmt.Sprintf("%s  %s/s",
@@ -195,7 +316,7 @@ func store(repository *knoxite.Repository, chunkIndex *knoxite.ChunkIndex, snaps
 			overallProgressBar.Text = fmt.Sprintf("%s / %s (%s of %s)",
 				knoxite.SizeToString(uint64(overallProgressBar.Current)),
 				knoxite.SizeToString(uint64(overallProgressBar.Total)),
-				humanize.Comma(items),
+				humanize.Comma(int64(len(seen))),
 				humanize.Comma(int64(p.TotalStatistics.Files+p.TotalStatistics.Dirs+p.TotalStatistics.SymLinks)))
 
 			if p.Path != lastPath {
@@ -207,6 +328,14 @@ func store(repository *knoxite.Repository, chunkIndex *knoxite.ChunkIndex, snaps
 		}
 	}
 
+	if stdinCmd != nil {
+		// don't create a snapshot containing incomplete output
+		if err := stdinCmd.Close(); err != nil {
+			fmt.Println()
+			return err
+		}
+	}
+
 	fmt.Printf("\nSnapshot %s created: %s\n", snapshot.ID, snapshot.Stats.String())
 	for file, err := range errs {
 		fmt.Printf("'%s': failed to store: %v\n", file, err)
@@ -214,6 +343,86 @@ func store(repository *knoxite.Repository, chunkIndex *knoxite.ChunkIndex, snaps
 	return nil
 }
 
+// parseAge parses a date like knoxite.ParseDate does, or a duration relative to now.
+// Besides the units of time.ParseDuration, durations can be given in days,
+// e.g. 7d.
+func parseAge(s string) (time.Time, error) {
+	if t, err := knoxite.ParseDate(s); err == nil {
+		return t, nil
+	}
+
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.ParseUint(days, 10, 32)
+		if err == nil {
+			return time.Now().AddDate(0, 0, -int(n)), nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date or duration %s", s)
+	}
+	return time.Now().Add(-d), nil
+}
+
+// commandReader reads the output of a shell command. Once all output has been
+// read, a failing command results in an error.
+type commandReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	done   bool
+	err    error
+}
+
+func newCommandReader(command string) (*commandReader, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Stderr = os.Stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	return &commandReader{cmd: cmd, stdout: stdout}, nil
+}
+
+func (c *commandReader) Read(p []byte) (int, error) {
+	n, err := c.stdout.Read(p)
+	if err == io.EOF {
+		if werr := c.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// Close stops the command, unless it already finished, and returns an error
+// if it failed.
+func (c *commandReader) Close() error {
+	if !c.done && c.cmd.Process != nil {
+		_ = c.cmd.Process.Kill()
+	}
+	return c.wait()
+}
+
+func (c *commandReader) wait() error {
+	if !c.done {
+		c.done = true
+		if err := c.cmd.Wait(); err != nil {
+			c.err = fmt.Errorf("command '%s' failed: %w", strings.Join(c.cmd.Args[2:], " "), err)
+		}
+	}
+	return c.err
+}
+
 func executeStore(volumeID string, args []string, opts StoreOptions) error {
 	targets := []string{}
 	for _, target := range args {
@@ -232,6 +441,11 @@ func executeStore(volumeID string, args []string, opts StoreOptions) error {
 	if err != nil {
 		return err
 	}
+	repoLock, err := lockRepository(&repository, true)
+	if err != nil {
+		return err
+	}
+	defer repoLock.Unlock()
 	volume, err := repository.FindVolume(volumeID)
 	if err != nil {
 		return err
@@ -244,10 +458,14 @@ func executeStore(volumeID string, args []string, opts StoreOptions) error {
 	if err != nil {
 		return err
 	}
+	parent, err := findParentSnapshot(&repository, volume, targets, opts)
+	if err != nil {
+		return err
+	}
 	// release the shutdown lock
 	lock()
 
-	err = store(&repository, &chunkIndex, snapshot, targets, opts)
+	err = store(&repository, &chunkIndex, snapshot, parent, targets, opts)
 	if err != nil {
 		return err
 	}
@@ -263,7 +481,7 @@ func executeStore(volumeID string, args []string, opts StoreOptions) error {
 	if err != nil {
 		return err
 	}
-	err = volume.AddSnapshot(snapshot.ID)
+	err = volume.AddSnapshotWithDate(snapshot)
 	if err != nil {
 		return err
 	}
@@ -12,6 +12,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"strings"
@@ -28,6 +29,7 @@ var (
 	ErrEncryptionUnknown  = errors.New("unknown encryption format")
 	ErrCompressionUnknown = errors.New("unknown compression format")
 	ErrLogLevelUnknown    = errors.New("unknown log level")
+	ErrRestoreModeUnknown = errors.New("unknown restore mode")
 )
 
 func ReadPassword(prompt string) (string, error) {
@@ -80,6 +82,17 @@ func ReadPasswordTwice(prompt, promptConfirm string) (string, error) {
 	return pw, nil
 }
 
+// ReadKeyFile reads a key file, whose entire content is used as password.
+func ReadKeyFile(path string) (string, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := ioutil.ReadFile(path)
+	return string(b), err
+}
+
 // CompressionTypeFromString returns the compression type from a user-specified string.
 func CompressionTypeFromString(s string) (uint16, error) {
 	switch strings.ToLower(s) {
@@ -128,9 +141,13 @@ func CompressionText(enum int) string {
 func EncryptionTypeFromString(s string) (uint16, error) {
 	switch strings.ToLower(s) {
 	case "":
-		// default is AES
+		// default is AES-GCM
 		fallthrough
-	case "aes":
+	case "aes", "aes-gcm":
+		return knoxite.EncryptionAESGCM, nil
+	case "chacha20-poly1305", "chacha20poly1305":
+		return knoxite.EncryptionChaCha20Poly1305, nil
+	case "aes-cfb":
 		return knoxite.EncryptionAES, nil
 	case "none":
 		return knoxite.EncryptionNone, nil
@@ -145,7 +162,11 @@ func EncryptionText(enum int) string {
 	case knoxite.EncryptionNone:
 		return "none"
 	case knoxite.EncryptionAES:
-		return "AES"
+		return "AES-CFB"
+	case knoxite.EncryptionAESGCM:
+		return "AES-GCM"
+	case knoxite.EncryptionChaCha20Poly1305:
+		return "ChaCha20-Poly1305"
 	}
 
 	return "unknown"
@@ -212,3 +233,22 @@ func LogLevelFromString(s string) (knoxite.LogLevel, error) {
 		return knoxite.LogLevelPrint, ErrLogLevelUnknown
 	}
 }
+
+// RestoreModeFromString returns the restore mode from a user-specified string.
+func RestoreModeFromString(s string) (knoxite.RestoreMode, error) {
+	switch strings.ToLower(s) {
+	case "":
+		// default is overwrite
+		fallthrough
+	case "overwrite":
+		return knoxite.RestoreOverwrite, nil
+	case "skip-existing":
+		return knoxite.RestoreSkipExisting, nil
+	case "if-newer":
+		return knoxite.RestoreIfNewer, nil
+	case "resume":
+		return knoxite.RestoreResume, nil
+	}
+
+	return 0, ErrRestoreModeUnknown
+}
@@ -63,6 +63,11 @@ func executeVerifyRepo(opts VerifyOptions) error {
 	if err != nil {
 		return err
 	}
+	repoLock, err := lockRepository(&repository, false)
+	if err != nil {
+		return err
+	}
+	defer repoLock.Unlock()
 
 	progress, err := knoxite.VerifyRepo(repository, opts.Percentage)
 	if err != nil {
@@ -81,6 +86,11 @@ func executeVerifyVolume(volumeId string, opts VerifyOptions) error {
 	if err != nil {
 		return err
 	}
+	repoLock, err := lockRepository(&repository, false)
+	if err != nil {
+		return err
+	}
+	defer repoLock.Unlock()
 
 	progress, err := knoxite.VerifyVolume(repository, volumeId, opts.Percentage)
 	if err != nil {
@@ -99,6 +109,11 @@ func executeVerifySnapshot(snapshotId string, opts VerifyOptions) error {
 	if err != nil {
 		return err
 	}
+	repoLock, err := lockRepository(&repository, false)
+	if err != nil {
+		return err
+	}
+	defer repoLock.Unlock()
 
 	progress, err := knoxite.VerifySnapshot(repository, snapshotId, opts.Percentage)
 	if err != nil {
@@ -91,6 +91,11 @@ func executeVolumeInit(name, description string) error {
 	if err != nil {
 		return err
 	}
+	repoLock, err := lockRepository(&repository, true)
+	if err != nil {
+		return err
+	}
+	defer repoLock.Unlock()
 
 	vol, err := knoxite.NewVolume(name, description)
 	if err != nil {
@@ -115,6 +120,11 @@ func executeVolumeRemove(volumeID string) error {
 	if err != nil {
 		return err
 	}
+	repoLock, err := lockRepository(&repo, true)
+	if err != nil {
+		return err
+	}
+	defer repoLock.Unlock()
 
 	chunkIndex, err := knoxite.OpenChunkIndex(&repo)
 	if err != nil {
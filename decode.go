@@ -10,11 +10,13 @@ package knoxite
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"runtime"
-	"strings"
+	"sort"
 	"sync"
 	"time"
 
@@ -65,49 +67,206 @@ func (e *DataReconstructionError) Error() string {
 	return fmt.Sprintf("Could not reconstruct data, got %d out of %d chunks (%d backends missing data)", e.BlocksFound, e.Chunk.DataParts, e.FailedBackends)
 }
 
-// DecodeSnapshot restores an entire snapshot to dst.
-func DecodeSnapshot(repository Repository, snapshot *Snapshot, dst string, excludes []string, pedantic bool) (<-chan Progress, error) {
+// RestoreMode decides what happens to files already existing at the
+// destination of a restore.
+type RestoreMode int
+
+const (
+	// RestoreOverwrite replaces existing files
+	RestoreOverwrite RestoreMode = iota
+	// RestoreSkipExisting leaves existing files untouched
+	RestoreSkipExisting
+	// RestoreIfNewer only replaces files older than their archived version
+	RestoreIfNewer
+	// RestoreResume verifies the content of existing files and only fetches
+	// chunks which are missing or don't match
+	RestoreResume
+)
+
+func (m RestoreMode) String() string {
+	return [...]string{"overwrite", "skip-existing", "if-newer", "resume"}[m]
+}
+
+// RestoreOptions holds all the settings for a restore operation.
+type RestoreOptions struct {
+	// Excludes are gitignore-style patterns of archives which don't get
+	// restored, see StoreOptions.Excludes
+	Excludes []string
+	// Includes are gitignore-style patterns limiting the restore to matching
+	// archives and their content. Empty to restore all archives
+	Includes []string
+	// StripComponents is the number of leading path elements removed from
+	// archive paths. Archives without any remaining elements get skipped
+	StripComponents int
+	Mode            RestoreMode
+	Pedantic        bool
+
+	// XAttrs restores extended attributes, including ACLs & file capabilities
+	XAttrs bool
+}
+
+// restoreArchives returns the archives of snapshot selected by opts, ordered
+// by path so directories get restored before their content. Parent
+// directories of included archives are part of the result, so they get
+// recreated with their archived metadata.
+func (snapshot *Snapshot) restoreArchives(opts RestoreOptions) ([]*Archive, error) {
+	excludes, err := newExcludeMatcher(opts.Excludes)
+	if err != nil {
+		return nil, err
+	}
+	// includes share the syntax of excludes, an archive gets selected if
+	// the rules match it or one of its parent directories
+	includes, err := newExcludeMatcher(opts.Includes)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := make(map[string]*Archive)
+	for path, arc := range snapshot.Archives {
+		if len(opts.Includes) > 0 && !includes.excludedTree(path, arc.Type == Directory) {
+			continue
+		}
+		if excludes.excludedTree(path, arc.Type == Directory) {
+			continue
+		}
+
+		selected[path] = arc
+	}
+
+	var archives []*Archive
+	for _, arc := range selected {
+		archives = append(archives, arc)
+	}
+	if len(opts.Includes) > 0 {
+		for _, arc := range archives {
+			for path := filepath.Dir(arc.Path); path != "." && path != filepath.Dir(path); path = filepath.Dir(path) {
+				if _, ok := selected[path]; ok {
+					break
+				}
+				if dir, ok := snapshot.Archives[path]; ok && dir.Type == Directory {
+					selected[path] = dir
+					archives = append(archives, dir)
+				}
+			}
+		}
+	}
+
+	sort.Slice(archives, func(i, j int) bool {
+		return archives[i].Path < archives[j].Path
+	})
+	return archives, nil
+}
+
+// stripComponents removes the first n elements from path. It returns false
+// if no elements remain.
+func stripComponents(path string, n int) (string, bool) {
+	if n <= 0 {
+		return path, true
+	}
+
+	elems := splitPath(path)
+	if len(elems) <= n {
+		return "", false
+	}
+	return filepath.Join(elems[n:]...), true
+}
+
+// DecodeSnapshot restores the archives of a snapshot selected by opts to dst.
+func DecodeSnapshot(repository Repository, snapshot *Snapshot, dst string, opts RestoreOptions) (<-chan Progress, error) {
+	archives, err := snapshot.restoreArchives(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	type restoredArchive struct {
+		arc  *Archive
+		path string
+	}
+
 	prog := make(chan Progress)
 	go func() {
 		defer close(prog)
-		for _, arc := range snapshot.Archives {
-			path := filepath.Join(dst, arc.Path)
 
-			match := false
-			for _, exclude := range excludes {
-				var err error
-				match, err = filepath.Match(strings.ToLower(exclude), strings.ToLower(arc.Path))
-				if err != nil {
-					fmt.Println("Invalid exclude filter:", exclude)
-					return
-				}
-				if match {
-					break
-				}
+		// reports err and returns whether the restore should be aborted
+		fail := func(arc *Archive, err error) bool {
+			p := newProgressError(err)
+			p.Path = arc.Path
+			prog <- p
+			return opts.Pedantic
+		}
+
+		var dirs, links []restoredArchive
+		files := make(map[string]string)
+		for _, arc := range archives {
+			path, ok := stripComponents(arc.Path, opts.StripComponents)
+			if !ok {
+				continue
 			}
+			path = filepath.Join(dst, path)
 
-			if match {
+			if arc.LinkTo != "" {
+				// hardlinks get restored once all files are in place
+				links = append(links, restoredArchive{arc, path})
 				continue
 			}
 
-			err := DecodeArchive(prog, repository, *arc, path)
+			err := DecodeArchive(prog, repository, *arc, path, opts)
 			if err != nil {
-				p := newProgressError(err)
-				p.Path = arc.Path
-				prog <- p
-				if pedantic {
-					break
+				if fail(arc, err) {
+					return
 				}
 				continue
 			}
+			switch arc.Type {
+			case Directory:
+				dirs = append(dirs, restoredArchive{arc, path})
+			case File:
+				files[arc.Path] = path
+			}
+		}
+
+		for _, l := range links {
+			err := restoreHardlink(prog, repository, snapshot, files, *l.arc, l.path, opts)
+			if err != nil && fail(l.arc, err) {
+				return
+			}
+		}
+
+		// apply the metadata of directories once their content got restored,
+		// children first, so read-only directories don't get in the way
+		for i := len(dirs) - 1; i >= 0; i-- {
+			err := restoreMetadata(*dirs[i].arc, dirs[i].path, opts.XAttrs)
+			if err != nil && fail(dirs[i].arc, err) {
+				return
+			}
 		}
 	}()
 
 	return prog, nil
 }
 
+// contentHash returns the hash of a chunk's decoded data.
+func contentHash(repository Repository, chunk Chunk, b []byte) (string, error) {
+	if !chunk.Keyed {
+		return Hash(b, HashHighway256), nil
+	}
+
+	hashKey, err := repository.contentHashKey()
+	if err != nil {
+		return "", err
+	}
+	if hashKey == nil {
+		return "", ErrHashKeyMissing
+	}
+	return KeyedHash(b, hashKey), nil
+}
+
 func decodeChunk(repository Repository, archive Archive, chunk Chunk, b []byte) ([]byte, error) {
-	pipe, err := NewDecodingPipeline(archive.Compressed, archive.Encrypted, repository.Key)
+	key, err := repository.DataKey(chunk.KeyGeneration)
+	if err != nil && archive.Encrypted != EncryptionNone {
+		return []byte{}, err
+	}
+	pipe, err := NewDecodingPipeline(archive.Compressed, archive.Encrypted, key)
 	if err != nil {
 		return []byte{}, err
 	}
@@ -116,7 +275,10 @@ func decodeChunk(repository Repository, archive Archive, chunk Chunk, b []byte)
 		return []byte{}, err
 	}
 
-	hashsum := Hash(b, HashHighway256)
+	hashsum, err := contentHash(repository, chunk, b)
+	if err != nil {
+		return []byte{}, err
+	}
 	if chunk.DecryptedHash != hashsum {
 		return []byte{}, &CheckSumError{"highwayhash", chunk.DecryptedHash, hashsum}
 	}
@@ -177,93 +339,338 @@ func loadChunk(repository Repository, archive Archive, chunk Chunk) ([]byte, err
 	return decodeChunk(repository, archive, chunk, b)
 }
 
-// DecodeArchive restores a single archive to path.
-func DecodeArchive(progress chan<- Progress, repository Repository, arc Archive, path string) error {
+// keepExisting reports whether a file existing at path should be left
+// untouched instead of restoring arc, according to mode.
+func keepExisting(arc Archive, path string, mode RestoreMode) (bool, error) {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	switch mode {
+	case RestoreSkipExisting:
+		return true, nil
+	case RestoreIfNewer:
+		return !time.Unix(arc.ModTime, 0).After(fi.ModTime()), nil
+	}
+	return false, nil
+}
+
+// skipExisting reports whether a file existing at path should be left
+// untouched, and reports the archive as done in that case.
+func skipExisting(progress chan<- Progress, arc Archive, path string, mode RestoreMode) (bool, error) {
+	keep, err := keepExisting(arc, path, mode)
+	if err != nil || !keep {
+		return false, err
+	}
+
 	p := newProgress(&arc)
+	p.CurrentItemStats.Transferred = p.CurrentItemStats.Size
+	p.TotalStatistics = Stats{}
+	progress <- p
+	return true, nil
+}
 
-	if arc.Type == Directory {
-		//fmt.Printf("Creating directory %s\n", path)
-		err := os.MkdirAll(path, arc.Mode)
+// restoreHardlink links path to the restored file arc is linked to. If that
+// file didn't get restored, its data gets restored to path instead.
+func restoreHardlink(progress chan<- Progress, repository Repository, snapshot *Snapshot, files map[string]string, arc Archive, path string, opts RestoreOptions) error {
+	target, ok := files[arc.LinkTo]
+	if !ok {
+		content, err := snapshot.ContentArchive(&arc)
 		if err != nil {
 			return err
 		}
-		p.TotalStatistics.Dirs++
-		progress <- p
-	} else if arc.Type == SymLink {
-		//fmt.Printf("Creating symlink %s -> %s\n", path, arc.PointsTo)
-		err := os.Symlink(arc.PointsTo, path)
-		if err != nil {
-			return err
+		c := *content
+		c.Path = arc.Path
+		err = DecodeArchive(progress, repository, c, path, opts)
+		if err == nil {
+			// the remaining links of this group can now point here
+			files[arc.LinkTo] = path
 		}
-		p.TotalStatistics.SymLinks++
-		progress <- p
-	} else if arc.Type == File {
-		parts := uint(len(arc.Chunks))
-		//fmt.Printf("Creating file %s (%d chunks).\n", path, parts)
+		return err
+	}
 
-		p.TotalStatistics.Files++
-		p.TotalStatistics.Size = arc.Size
-		p.TotalStatistics.StorageSize = arc.StorageSize
-		progress <- p
+	keep, err := skipExisting(progress, arc, path, opts.Mode)
+	if err != nil || keep {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
 
-		// FIXME: we don't always need to create the path
-		// this is just a safety measure for now
-		err := os.MkdirAll(filepath.Dir(path), 0755)
-		if err != nil {
-			return err
+	tmp := tempPath(path)
+	err = os.Remove(tmp)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Link(target, tmp)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, path)
+	// renaming onto another link of the same file leaves tmp in place
+	_ = os.Remove(tmp)
+	if err != nil {
+		return err
+	}
+
+	p := newProgress(&arc)
+	p.CurrentItemStats.Transferred = p.CurrentItemStats.Size
+	p.TotalStatistics = Stats{Files: 1}
+	progress <- p
+	return nil
+}
+
+// readChunkAt returns the content of chunk if f already contains it at
+// offset, nil otherwise.
+func readChunkAt(repository Repository, f *os.File, chunk Chunk, offset int64) ([]byte, error) {
+	b := make([]byte, chunk.OriginalSize)
+	_, err := f.ReadAt(b, offset)
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	hashsum, err := contentHash(repository, chunk, b)
+	if err != nil {
+		return nil, err
+	}
+	if hashsum != chunk.DecryptedHash {
+		return nil, nil
+	}
+	return b, nil
+}
+
+// tempPath returns the path files get restored to, before being renamed to
+// path.
+func tempPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".knoxite-tmp")
+}
+
+// restoreMetadata applies the ownership, mode, modification time and
+// optionally extended attributes of arc to path. Everything gets applied even
+// if some of it fails, in which case the first error gets returned. Unless
+// running as root, not being permitted to change the ownership only causes a
+// warning.
+func restoreMetadata(arc Archive, path string, xattrs bool) error {
+	var firstErr error
+	if runtime.GOOS != "windows" {
+		err := os.Lchown(path, int(arc.UID), int(arc.GID))
+		if err != nil && os.Geteuid() != 0 && errors.Is(err, os.ErrPermission) {
+			// only root may give files away
+			log.Warnf("Could not restore ownership of %s: %v", arc.Path, err)
+		} else if err != nil {
+			firstErr = err
 		}
+	}
 
-		// write to disk
-		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, arc.Mode)
+	// changing the owner may clear setuid & setgid bits as well as file
+	// capabilities, and changing the mode may change the ACL, so they get
+	// applied in this order
+	if arc.Type != SymLink {
+		// symlinks don't have a mode of their own
+		err := os.Chmod(path, arc.Mode)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if xattrs {
+		err := writeXAttrs(path, arc.XAttrs)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	mtime := time.Unix(arc.ModTime, 0)
+	var err error
+	if arc.Type == SymLink {
+		err = lutimes(path, mtime)
+	} else {
+		err = os.Chtimes(path, mtime, mtime)
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return err
+}
+
+// restoreFile writes the content of arc to tmp. When resuming, chunks already
+// contained in tmp or the existing file at path don't get fetched again.
+func restoreFile(progress chan<- Progress, p Progress, repository Repository, arc Archive, path, tmp string, mode RestoreMode) error {
+	flags := os.O_CREATE | os.O_RDWR | os.O_TRUNC
+	var existing *os.File
+	if mode == RestoreResume {
+		if _, err := os.Lstat(tmp); err == nil {
+			// continue an interrupted restore
+			flags &^= os.O_TRUNC
+		} else if existing, err = os.Open(path); err == nil {
+			defer existing.Close()
+		}
+	}
+
+	f, err := os.OpenFile(tmp, flags, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	src := f
+	if existing != nil {
+		src = existing
+	}
+
+	var offset int64
+	for i := uint(0); i < uint(len(arc.Chunks)); i++ {
+		idx, err := arc.IndexOfChunk(i)
 		if err != nil {
 			return err
 		}
 
-		for i := uint(0); i < parts; i++ {
-			idx, err := arc.IndexOfChunk(i)
+		chunk := arc.Chunks[idx]
+		var b []byte
+		if mode == RestoreResume {
+			b, err = readChunkAt(repository, src, chunk, offset)
 			if err != nil {
 				return err
 			}
+		}
+		if b != nil && src == f {
+			// already in place
+			offset += int64(len(b))
+			p.CurrentItemStats.Transferred += uint64(len(b))
+			progress <- p
+			continue
+		}
 
-			chunk := arc.Chunks[idx]
-			b, err := loadChunk(repository, arc, chunk)
+		fetched := b == nil
+		if fetched {
+			b, err = loadChunk(repository, arc, chunk)
 			if err != nil {
 				return err
 			}
+		}
 
-			_, err = f.Write(b)
-			if err != nil {
-				return err
-			}
+		_, err = f.WriteAt(b, offset)
+		if err != nil {
+			return err
+		}
+		offset += int64(len(b))
 
+		if fetched {
 			p.TotalStatistics.Transferred += uint64(len(b))
-			p.CurrentItemStats.Transferred += uint64(len(b))
-			progress <- p
-			// fmt.Printf("Chunk OK: %d bytes, hash: %s\n", size, chunk.DecryptedHash)
 		}
+		p.CurrentItemStats.Transferred += uint64(len(b))
+		progress <- p
+		// fmt.Printf("Chunk OK: %d bytes, hash: %s\n", size, chunk.DecryptedHash)
+	}
+
+	// cut off anything left over from a previous, longer file
+	err = f.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
 
-		err = f.Sync()
+// DecodeArchive restores a single archive to path. Existing files get handled
+// according to opts.Mode. Files and symlinks get restored to a temporary file first,
+// which only replaces path once it's complete. Directories get created without
+// applying their metadata, which DecodeSnapshot does after restoring their
+// content.
+func DecodeArchive(progress chan<- Progress, repository Repository, arc Archive, path string, opts RestoreOptions) error {
+	p := newProgress(&arc)
+	mode := opts.Mode
+
+	if arc.Type == Directory {
+		//fmt.Printf("Creating directory %s\n", path)
+		err := os.MkdirAll(path, 0700)
 		if err != nil {
 			return err
 		}
-		err = f.Close()
+		p.TotalStatistics.Dirs++
+		progress <- p
+		return nil
+	}
+
+	keep, err := skipExisting(progress, arc, path, mode)
+	if err != nil || keep {
+		return err
+	}
+
+	// FIXME: we don't always need to create the path
+	// this is just a safety measure for now
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp := tempPath(path)
+	if arc.Type == SymLink {
+		//fmt.Printf("Creating symlink %s -> %s\n", path, arc.PointsTo)
+		err = os.Remove(tmp)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		err = os.Symlink(arc.PointsTo, tmp)
 		if err != nil {
 			return err
 		}
+		p.TotalStatistics.SymLinks++
+		progress <- p
+	} else if arc.Type == File {
+		//fmt.Printf("Creating file %s (%d chunks).\n", path, len(arc.Chunks))
+		p.TotalStatistics.Files++
+		p.TotalStatistics.Size = arc.Size
+		p.TotalStatistics.StorageSize = arc.StorageSize
+		progress <- p
 
-		// Restore modification time
-		err = os.Chtimes(path, time.Unix(arc.ModTime, 0), time.Unix(arc.ModTime, 0))
+		err = restoreFile(progress, p, repository, arc, path, tmp, mode)
 		if err != nil {
+			// keep partially restored files around for resuming
+			if mode != RestoreResume {
+				_ = os.Remove(tmp)
+			}
 			return err
 		}
-	}
+	} else if arc.IsSpecial() {
+		if (arc.Type == CharDevice || arc.Type == BlockDevice) && os.Geteuid() != 0 {
+			log.Warnf("Skipping device node %s, restoring device nodes requires root privileges", arc.Path)
+			p.TotalStatistics = Stats{}
+			progress <- p
+			return nil
+		}
 
-	if runtime.GOOS == "windows" {
+		err = os.Remove(tmp)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		err = mknod(tmp, arc)
+		if err != nil {
+			return err
+		}
+		progress <- p
+	} else {
 		return nil
 	}
 
-	// Restore ownerships
-	return os.Lchown(path, int(arc.UID), int(arc.GID))
+	// the restored content is complete, so it replaces path even if its
+	// metadata couldn't be applied entirely
+	metaErr := restoreMetadata(arc, tmp, opts.XAttrs)
+	err = os.Rename(tmp, path)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return metaErr
 }
 
 var (
@@ -275,6 +682,32 @@ func init() {
 	cache = make(map[string][]byte)
 }
 
+// WriteArchiveData writes the content of a single archive to w, one chunk at
+// a time, so even large archives don't need to fit into memory.
+func WriteArchiveData(w io.Writer, repository Repository, arc Archive) error {
+	if arc.Type != File {
+		return nil
+	}
+
+	for i := uint(0); i < uint(len(arc.Chunks)); i++ {
+		idx, err := arc.IndexOfChunk(i)
+		if err != nil {
+			return err
+		}
+
+		b, err := loadChunk(repository, arc, arc.Chunks[idx])
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // DecodeArchiveData returns the content of a single archive.
 func DecodeArchiveData(repository Repository, arc Archive) ([]byte, Stats, error) {
 	var b []byte
@@ -0,0 +1,526 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestIncludePatterns(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		path     string
+		isDir    bool
+		match    bool
+	}{
+		{[]string{"*.go"}, "decode.go", false, true},
+		{[]string{"*.go"}, "cmd/knoxite/main.go", false, true},
+		{[]string{"*.GO"}, "Decode.go", false, foldCase},
+		{[]string{"cmd/*"}, "cmd/knoxite", true, true},
+		{[]string{"cmd/*"}, "cmd/knoxite/main.go", false, true},
+		{[]string{"cmd/*"}, "cmd", true, false},
+		{[]string{"cmd/**"}, "cmd", true, true},
+		{[]string{"**/main.go"}, "cmd/knoxite/main.go", false, true},
+		{[]string{"cmd/**/main.go"}, "cmd/main.go", false, true},
+		{[]string{"cmd/**/*.go"}, "cmd/knoxite/action/config.go", false, true},
+		{[]string{"home/alice/**"}, "/home/alice/docs", true, true},
+		{[]string{"home/alice/**"}, "home/bob/docs", true, false},
+		{[]string{"docs/"}, "home/alice/docs/a.txt", false, true},
+		{[]string{"docs/"}, "home/alice/docs", false, false},
+		{[]string{"*.txt", "!b.txt"}, "home/alice/b.txt", false, false},
+		{[]string{"*.txt", "!b.txt"}, "home/alice/a.txt", false, true},
+	}
+	for _, tt := range tests {
+		m, err := newExcludeMatcher(tt.patterns)
+		if err != nil {
+			t.Errorf("Failed parsing %v: %s", tt.patterns, err)
+			continue
+		}
+		if match := m.excludedTree(tt.path, tt.isDir); match != tt.match {
+			t.Errorf("Expected %v matching %s to be %v, got %v", tt.patterns, tt.path, tt.match, match)
+		}
+	}
+
+	snapshot := &Snapshot{Archives: map[string]*Archive{}}
+	if _, err := snapshot.restoreArchives(RestoreOptions{Includes: []string{"**/[a"}}); err == nil {
+		t.Errorf("Expected invalid pattern to fail")
+	}
+}
+
+func TestRestoreArchives(t *testing.T) {
+	snapshot := &Snapshot{Archives: map[string]*Archive{}}
+	for path, typ := range map[string]uint8{
+		"home":                  Directory,
+		"home/alice":            Directory,
+		"home/alice/docs":       Directory,
+		"home/alice/docs/a.txt": File,
+		"home/alice/docs/b.log": File,
+		"home/alice/c.txt":      File,
+		"home/bob":              Directory,
+		"home/bob/d.txt":        File,
+	} {
+		snapshot.Archives[path] = &Archive{Path: path, Type: typ}
+	}
+
+	tests := []struct {
+		opts     RestoreOptions
+		expected []string
+	}{
+		{RestoreOptions{Includes: []string{"home/alice/**"}, Excludes: []string{"*.log"}},
+			[]string{"home", "home/alice", "home/alice/c.txt", "home/alice/docs", "home/alice/docs/a.txt"}},
+		{RestoreOptions{Includes: []string{"docs"}},
+			[]string{"home", "home/alice", "home/alice/docs", "home/alice/docs/a.txt", "home/alice/docs/b.log"}},
+		{RestoreOptions{Includes: []string{"d.txt"}},
+			[]string{"home", "home/bob", "home/bob/d.txt"}},
+		{RestoreOptions{Excludes: []string{"alice"}},
+			[]string{"home", "home/bob", "home/bob/d.txt"}},
+	}
+	for _, tt := range tests {
+		archives, err := snapshot.restoreArchives(tt.opts)
+		if err != nil {
+			t.Errorf("Failed selecting archives: %s", err)
+			continue
+		}
+
+		var paths []string
+		for _, arc := range archives {
+			paths = append(paths, arc.Path)
+		}
+		if !reflect.DeepEqual(paths, tt.expected) {
+			t.Errorf("Options %+v: expected %v, got %v", tt.opts, tt.expected, paths)
+		}
+	}
+
+	for _, tt := range []struct {
+		path     string
+		n        int
+		expected string
+		ok       bool
+	}{
+		{"home/alice/c.txt", 0, "home/alice/c.txt", true},
+		{"home/alice/c.txt", 2, "c.txt", true},
+		{"/home/alice/c.txt", 2, "c.txt", true},
+		{"home/alice", 2, "", false},
+	} {
+		path, ok := stripComponents(tt.path, tt.n)
+		if path != tt.expected || ok != tt.ok {
+			t.Errorf("Expected stripping %d elements from %s to be %s, got %s", tt.n, tt.path, tt.expected, path)
+		}
+	}
+}
+
+func TestRestoreModes(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	sourcedir, err := ioutil.TempDir("", "knoxite.source")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for source: %s", err)
+		return
+	}
+	defer os.RemoveAll(sourcedir)
+	targetdir, err := ioutil.TempDir("", "knoxite.target")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for restore: %s", err)
+		return
+	}
+	defer os.RemoveAll(targetdir)
+
+	data := make([]byte, 256*1024)
+	_, _ = rand.Read(data)
+	if err := ioutil.WriteFile(filepath.Join(sourcedir, "a"), data, 0644); err != nil {
+		t.Errorf("Failed writing source file: %s", err)
+		return
+	}
+
+	// archive paths are relative to the working dir
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Failed getting working dir: %s", err)
+		return
+	}
+	err = os.Chdir(sourcedir)
+	if err != nil {
+		t.Errorf("Failed changing working dir: %s", err)
+		return
+	}
+	defer func() {
+		_ = os.Chdir(wd)
+	}()
+
+	r, _ := NewRepository(dir, testPassword)
+	index, _ := OpenChunkIndex(&r)
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+	snapshot := storePackedSnapshot(t, &r, vol, &index, []string{"a"})
+
+	restore := func(mode RestoreMode) Stats {
+		var stats Stats
+		progress, err := DecodeSnapshot(r, snapshot, targetdir, RestoreOptions{Mode: mode})
+		if err != nil {
+			t.Errorf("Failed restoring snapshot: %s", err)
+			return stats
+		}
+		for p := range progress {
+			if p.Error != nil {
+				t.Errorf("Failed restoring snapshot: %s", p.Error)
+			}
+			stats = p.TotalStatistics
+		}
+		return stats
+	}
+	target := filepath.Join(targetdir, "a")
+	setContent := func(b []byte, modTime time.Time) {
+		_ = ioutil.WriteFile(target, b, 0644)
+		_ = os.Chtimes(target, modTime, modTime)
+	}
+	restored := func() bool {
+		b, _ := ioutil.ReadFile(target)
+		return bytes.Equal(b, data)
+	}
+	past := time.Unix(snapshot.Archives["a"].ModTime, 0).Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+
+	// existing, longer files get truncated
+	setContent(append(append([]byte{}, data...), data...), past)
+	restore(RestoreOverwrite)
+	if !restored() {
+		t.Errorf("Expected file to be overwritten")
+	}
+
+	setContent([]byte("existing"), past)
+	restore(RestoreSkipExisting)
+	if restored() {
+		t.Errorf("Expected existing file to be skipped")
+	}
+
+	setContent([]byte("existing"), future)
+	restore(RestoreIfNewer)
+	if restored() {
+		t.Errorf("Expected newer file to be kept")
+	}
+	setContent([]byte("existing"), past)
+	restore(RestoreIfNewer)
+	if !restored() {
+		t.Errorf("Expected older file to be overwritten")
+	}
+
+	// intact files don't get fetched again
+	if stats := restore(RestoreResume); !restored() || stats.Transferred != 0 {
+		t.Errorf("Expected intact file to be verified without transfers, got %d bytes", stats.Transferred)
+	}
+	partial := append([]byte{}, data[:len(data)/2]...)
+	partial[0] ^= 0xff
+	setContent(partial, past)
+	if stats := restore(RestoreResume); !restored() || stats.Transferred == 0 {
+		t.Errorf("Expected partial file to be resumed")
+	}
+}
+
+func TestRestoreMetadata(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	sourcedir, err := ioutil.TempDir("", "knoxite.source")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for source: %s", err)
+		return
+	}
+	defer os.RemoveAll(sourcedir)
+	targetdir, err := ioutil.TempDir("", "knoxite.target")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for restore: %s", err)
+		return
+	}
+	defer os.RemoveAll(targetdir)
+
+	// a read-only directory, containing a file and a symlink
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+	ro := filepath.Join(sourcedir, "ro")
+	_ = os.Mkdir(ro, 0755)
+	_ = ioutil.WriteFile(filepath.Join(ro, "file"), []byte("content"), 0640)
+	_ = os.Symlink("file", filepath.Join(ro, "link"))
+	for _, path := range []string{filepath.Join(ro, "file"), ro} {
+		_ = os.Chtimes(path, mtime, mtime)
+	}
+	_ = lutimes(filepath.Join(ro, "link"), mtime)
+	_ = os.Chmod(ro, 0555)
+	defer func() {
+		_ = os.Chmod(ro, 0755)
+		_ = os.Chmod(filepath.Join(targetdir, "ro"), 0755)
+	}()
+
+	// archive paths are relative to the working dir
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Failed getting working dir: %s", err)
+		return
+	}
+	err = os.Chdir(sourcedir)
+	if err != nil {
+		t.Errorf("Failed changing working dir: %s", err)
+		return
+	}
+	defer func() {
+		_ = os.Chdir(wd)
+	}()
+
+	r, _ := NewRepository(dir, testPassword)
+	index, _ := OpenChunkIndex(&r)
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+	snapshot := storePackedSnapshot(t, &r, vol, &index, []string{"ro"})
+
+	progress, err := DecodeSnapshot(r, snapshot, targetdir, RestoreOptions{})
+	if err != nil {
+		t.Errorf("Failed restoring snapshot: %s", err)
+		return
+	}
+	for p := range progress {
+		if p.Error != nil {
+			t.Errorf("Failed restoring snapshot: %s", p.Error)
+		}
+	}
+
+	for path, mode := range map[string]os.FileMode{
+		"ro":      os.ModeDir | 0555,
+		"ro/file": 0640,
+		"ro/link": os.ModeSymlink,
+	} {
+		fi, err := os.Lstat(filepath.Join(targetdir, path))
+		if err != nil {
+			t.Errorf("Failed to stat %s: %s", path, err)
+			continue
+		}
+		if mode != os.ModeSymlink && fi.Mode() != mode {
+			t.Errorf("Expected mode of %s to be %s, got %s", path, mode, fi.Mode())
+		}
+		if fi.Mode()&os.ModeType != mode&os.ModeType {
+			t.Errorf("Expected type of %s to be %s, got %s", path, mode.Type(), fi.Mode().Type())
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("Expected mtime of %s to be %s, got %s", path, mtime, fi.ModTime())
+		}
+	}
+
+	// no temporary files left behind
+	entries, _ := ioutil.ReadDir(filepath.Join(targetdir, "ro"))
+	if len(entries) != 2 {
+		t.Errorf("Expected 2 entries in restored directory, got %d", len(entries))
+	}
+}
+
+func TestRestoreForeignOwner(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("restoring files owned by other users only fails without root privileges")
+	}
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	sourcedir, err := ioutil.TempDir("", "knoxite.source")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for source: %s", err)
+		return
+	}
+	defer os.RemoveAll(sourcedir)
+	targetdir, err := ioutil.TempDir("", "knoxite.target")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for restore: %s", err)
+		return
+	}
+	defer os.RemoveAll(targetdir)
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+	d := filepath.Join(sourcedir, "dir")
+	_ = os.Mkdir(d, 0750)
+	_ = ioutil.WriteFile(filepath.Join(d, "file"), []byte("content"), 0640)
+	_ = os.Chtimes(filepath.Join(d, "file"), mtime, mtime)
+	_ = os.Chtimes(d, mtime, mtime)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Failed getting working dir: %s", err)
+		return
+	}
+	err = os.Chdir(sourcedir)
+	if err != nil {
+		t.Errorf("Failed changing working dir: %s", err)
+		return
+	}
+	defer func() {
+		_ = os.Chdir(wd)
+	}()
+
+	r, _ := NewRepository(dir, testPassword)
+	index, _ := OpenChunkIndex(&r)
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+	snapshot := storePackedSnapshot(t, &r, vol, &index, []string{"dir"})
+
+	// pretend everything belongs to another user
+	for _, arc := range snapshot.Archives {
+		arc.UID = uint32(os.Getuid() + 1)
+		arc.GID = uint32(os.Getgid() + 1)
+	}
+
+	progress, err := DecodeSnapshot(r, snapshot, targetdir, RestoreOptions{})
+	if err != nil {
+		t.Errorf("Failed restoring snapshot: %s", err)
+		return
+	}
+	for p := range progress {
+		if p.Error != nil {
+			t.Errorf("Failed restoring snapshot: %s", p.Error)
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(targetdir, "dir", "file"))
+	if err != nil || string(b) != "content" {
+		t.Errorf("Expected file to be restored, got %q, %v", b, err)
+	}
+	for path, mode := range map[string]os.FileMode{
+		"dir":      os.ModeDir | 0750,
+		"dir/file": 0640,
+	} {
+		fi, err := os.Lstat(filepath.Join(targetdir, path))
+		if err != nil {
+			t.Errorf("Failed to stat %s: %s", path, err)
+			continue
+		}
+		if fi.Mode() != mode {
+			t.Errorf("Expected mode of %s to be %s, got %s", path, mode, fi.Mode())
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("Expected mtime of %s to be %s, got %s", path, mtime, fi.ModTime())
+		}
+	}
+}
+
+func TestRestoreHardlinks(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	sourcedir, err := ioutil.TempDir("", "knoxite.source")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for source: %s", err)
+		return
+	}
+	defer os.RemoveAll(sourcedir)
+
+	_ = ioutil.WriteFile(filepath.Join(sourcedir, "a"), []byte("content"), 0644)
+	_ = os.Mkdir(filepath.Join(sourcedir, "dir"), 0755)
+	for _, link := range []string{"b", "dir/c"} {
+		if err := os.Link(filepath.Join(sourcedir, "a"), filepath.Join(sourcedir, link)); err != nil {
+			t.Skipf("Filesystem doesn't support hardlinks: %s", err)
+		}
+	}
+
+	// archive paths are relative to the working dir
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Failed getting working dir: %s", err)
+		return
+	}
+	err = os.Chdir(sourcedir)
+	if err != nil {
+		t.Errorf("Failed changing working dir: %s", err)
+		return
+	}
+	defer func() {
+		_ = os.Chdir(wd)
+	}()
+
+	r, _ := NewRepository(dir, testPassword)
+	index, _ := OpenChunkIndex(&r)
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+	snapshot := storePackedSnapshot(t, &r, vol, &index, []string{"dir", "a", "b"})
+
+	// the first path found holds the data
+	if arc := snapshot.Archives["dir/c"]; arc.LinkTo != "" || len(arc.Chunks) == 0 {
+		t.Errorf("Expected dir/c to contain the data, got link to %q", arc.LinkTo)
+	}
+	for _, link := range []string{"a", "b"} {
+		if arc := snapshot.Archives[link]; arc.LinkTo != "dir/c" || len(arc.Chunks) != 0 {
+			t.Errorf("Expected %s to be a hardlink to dir/c, got %q", link, arc.LinkTo)
+		}
+	}
+
+	for _, tt := range []struct {
+		includes []string
+		paths    []string
+	}{
+		{nil, []string{"a", "b", "dir/c"}},
+		{[]string{"a", "b"}, []string{"a", "b"}},
+	} {
+		targetdir, err := ioutil.TempDir("", "knoxite.target")
+		if err != nil {
+			t.Errorf("Failed creating temporary dir for restore: %s", err)
+			return
+		}
+		defer os.RemoveAll(targetdir)
+
+		progress, err := DecodeSnapshot(r, snapshot, targetdir, RestoreOptions{Includes: tt.includes})
+		if err != nil {
+			t.Errorf("Failed restoring snapshot: %s", err)
+			return
+		}
+		for p := range progress {
+			if p.Error != nil {
+				t.Errorf("Failed restoring snapshot: %s", p.Error)
+			}
+		}
+
+		first, err := os.Stat(filepath.Join(targetdir, tt.paths[0]))
+		if err != nil {
+			t.Errorf("Failed to stat %s: %s", tt.paths[0], err)
+			continue
+		}
+		for _, path := range tt.paths {
+			fi, err := os.Stat(filepath.Join(targetdir, path))
+			if err != nil {
+				t.Errorf("Failed to stat %s: %s", path, err)
+				continue
+			}
+			if !os.SameFile(first, fi) {
+				t.Errorf("Expected %s to be linked to %s", path, tt.paths[0])
+			}
+			if b, _ := ioutil.ReadFile(filepath.Join(targetdir, path)); string(b) != "content" {
+				t.Errorf("Expected %s to contain the data, got %q", path, b)
+			}
+		}
+	}
+}
@@ -0,0 +1,242 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ChangeType describes how an archive changed between two snapshots.
+type ChangeType uint8
+
+// Types of changes.
+const (
+	ChangeAdded    ChangeType = iota // The archive only exists in the newer snapshot
+	ChangeRemoved                    // The archive only exists in the older snapshot
+	ChangeModified                   // The archive exists in both snapshots, but differs
+)
+
+// String returns a human-readable name for the change type.
+func (t ChangeType) String() string {
+	switch t {
+	case ChangeAdded:
+		return "added"
+	case ChangeRemoved:
+		return "removed"
+	case ChangeModified:
+		return "modified"
+	}
+	return "unknown"
+}
+
+// Modification describes what differs between two versions of an archive.
+type Modification uint8
+
+// Kinds of modifications.
+const (
+	ModifiedType    Modification = iota // File, Directory or SymLink
+	ModifiedContent                     // Data chunks of a file
+	ModifiedMode                        // Permission bits
+	ModifiedOwner                       // UID or GID
+	ModifiedTarget                      // Where a SymLink or hardlink points to
+	ModifiedTime                        // Modification time of a file or SymLink
+	ModifiedDevice                      // Device number of a CharDevice or BlockDevice
+)
+
+// String returns a human-readable name for the modification.
+func (m Modification) String() string {
+	switch m {
+	case ModifiedType:
+		return "type"
+	case ModifiedContent:
+		return "content"
+	case ModifiedMode:
+		return "mode"
+	case ModifiedOwner:
+		return "owner"
+	case ModifiedTarget:
+		return "target"
+	case ModifiedTime:
+		return "mtime"
+	case ModifiedDevice:
+		return "device"
+	}
+	return "unknown"
+}
+
+// A Change is a single difference between two snapshots.
+type Change struct {
+	Path          string
+	Type          ChangeType
+	Modifications []Modification // only set for ChangeModified
+	Old           *Archive       // nil for ChangeAdded
+	New           *Archive       // nil for ChangeRemoved
+}
+
+// DiffStats summarizes the differences between two snapshots.
+type DiffStats struct {
+	Added       uint64 `json:"added"`        // number of added archives
+	Removed     uint64 `json:"removed"`      // number of removed archives
+	Modified    uint64 `json:"modified"`     // number of modified archives
+	AddedSize   uint64 `json:"added_size"`   // size of data only found in the newer snapshot
+	RemovedSize uint64 `json:"removed_size"` // size of data only found in the older snapshot
+}
+
+// A Diff contains all differences between two snapshots.
+type Diff struct {
+	Changes []Change
+	Stats   DiffStats
+}
+
+// DiffSnapshots compares the archives of two snapshots. If path isn't empty,
+// only archives at or below path are taken into account. File contents get
+// compared by their chunk hashes, so no data needs to be loaded.
+func DiffSnapshots(older, newer *Snapshot, path string) Diff {
+	var diff Diff
+	path = filepath.Clean(path)
+	included := func(p string) bool {
+		return path == "." || p == path || strings.HasPrefix(p, path+string(filepath.Separator))
+	}
+
+	for p, arc := range newer.Archives {
+		if !included(p) {
+			continue
+		}
+		prev, ok := older.Archives[p]
+		if !ok {
+			diff.Changes = append(diff.Changes, Change{Path: p, Type: ChangeAdded, New: arc})
+			diff.Stats.Added++
+			continue
+		}
+
+		if mods := compareArchives(older, newer, prev, arc); len(mods) > 0 {
+			diff.Changes = append(diff.Changes, Change{Path: p, Type: ChangeModified, Modifications: mods, Old: prev, New: arc})
+			diff.Stats.Modified++
+		}
+	}
+	for p, arc := range older.Archives {
+		if !included(p) {
+			continue
+		}
+		if _, ok := newer.Archives[p]; !ok {
+			diff.Changes = append(diff.Changes, Change{Path: p, Type: ChangeRemoved, Old: arc})
+			diff.Stats.Removed++
+		}
+	}
+
+	sort.Slice(diff.Changes, func(i, j int) bool {
+		return diff.Changes[i].Path < diff.Changes[j].Path
+	})
+
+	oldChunks := chunkContents(older, included)
+	newChunks := chunkContents(newer, included)
+	for hash, size := range newChunks {
+		if _, ok := oldChunks[hash]; !ok {
+			diff.Stats.AddedSize += size
+		}
+	}
+	for hash, size := range oldChunks {
+		if _, ok := newChunks[hash]; !ok {
+			diff.Stats.RemovedSize += size
+		}
+	}
+
+	return diff
+}
+
+// compareArchives returns all modifications between two versions of an
+// archive. Modification times of directories are ignored, as they change
+// whenever their content does.
+func compareArchives(older, newer *Snapshot, a, b *Archive) []Modification {
+	var mods []Modification
+	if a.Type != b.Type {
+		return []Modification{ModifiedType}
+	}
+
+	if a.Type == File && !sameContent(contentArchive(older, a), contentArchive(newer, b)) {
+		mods = append(mods, ModifiedContent)
+	}
+	if a.Mode != b.Mode {
+		mods = append(mods, ModifiedMode)
+	}
+	if a.UID != b.UID || a.GID != b.GID {
+		mods = append(mods, ModifiedOwner)
+	}
+	if (a.Type == SymLink && a.PointsTo != b.PointsTo) || a.LinkTo != b.LinkTo {
+		mods = append(mods, ModifiedTarget)
+	}
+	if (a.Type == CharDevice || a.Type == BlockDevice) && (a.DevMajor != b.DevMajor || a.DevMinor != b.DevMinor) {
+		mods = append(mods, ModifiedDevice)
+	}
+	if a.Type != Directory && a.ModTime != b.ModTime {
+		mods = append(mods, ModifiedTime)
+	}
+
+	return mods
+}
+
+// contentArchive returns the archive containing the data of arc, or arc itself
+// if it's a hardlink to a missing archive.
+func contentArchive(snapshot *Snapshot, arc *Archive) *Archive {
+	content, err := snapshot.ContentArchive(arc)
+	if err != nil {
+		return arc
+	}
+	return content
+}
+
+// sameContent compares the content of two files by the hashes of their
+// chunks. Hashes created with and without the repository's hash key can't be
+// compared, in which case the files' sizes and modification times decide.
+func sameContent(a, b *Archive) bool {
+	if a.Size != b.Size || len(a.Chunks) != len(b.Chunks) {
+		return false
+	}
+
+	ac := sortedChunks(a)
+	bc := sortedChunks(b)
+	for i := range ac {
+		if ac[i].Keyed != bc[i].Keyed {
+			return a.ModTime == b.ModTime
+		}
+		if ac[i].DecryptedHash != bc[i].DecryptedHash {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sortedChunks returns the chunks of an archive in the order of their data.
+func sortedChunks(arc *Archive) []Chunk {
+	chunks := make([]Chunk, len(arc.Chunks))
+	copy(chunks, arc.Chunks)
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Num < chunks[j].Num
+	})
+
+	return chunks
+}
+
+// chunkContents returns the original sizes of all chunks of the included
+// archives, by their content hash.
+func chunkContents(snapshot *Snapshot, included func(string) bool) map[string]uint64 {
+	chunks := make(map[string]uint64)
+	for p, arc := range snapshot.Archives {
+		if !included(p) {
+			continue
+		}
+		for _, chunk := range arc.Chunks {
+			chunks[chunk.DecryptedHash] = uint64(chunk.OriginalSize)
+		}
+	}
+
+	return chunks
+}
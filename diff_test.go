@@ -0,0 +1,97 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	file := func(path string, chunks ...string) *Archive {
+		arc := &Archive{Path: path, Type: File, Mode: 0644, ModTime: 1}
+		// chunks are deliberately stored out of order
+		for i := len(chunks) - 1; i >= 0; i-- {
+			arc.Chunks = append(arc.Chunks, Chunk{Num: uint(i), DecryptedHash: chunks[i], OriginalSize: 10, Keyed: true})
+			arc.Size += 10
+		}
+		return arc
+	}
+
+	older := &Snapshot{Archives: map[string]*Archive{
+		"a":          file("a", "1", "2"),
+		"b":          file("b", "3"),
+		"c":          file("c", "4"),
+		"dir":        {Path: "dir", Type: Directory, Mode: 0755, ModTime: 1},
+		"dir/link":   {Path: "dir/link", Type: SymLink, PointsTo: "a"},
+		"dir/same":   file("dir/same", "5"),
+		"dir/chmod":  file("dir/chmod", "6"),
+		"dir/chown":  file("dir/chown", "7"),
+		"dir/dev":    {Path: "dir/dev", Type: CharDevice, DevMajor: 1, DevMinor: 3},
+		"removed":    file("removed", "8"),
+		"typechange": file("typechange", "9"),
+	}}
+	newer := &Snapshot{Archives: map[string]*Archive{
+		"a":          file("a", "1", "2"),
+		"b":          file("b", "3", "10"),
+		"c":          file("c", "11"),
+		"dir":        {Path: "dir", Type: Directory, Mode: 0755, ModTime: 2},
+		"dir/link":   {Path: "dir/link", Type: SymLink, PointsTo: "b"},
+		"dir/same":   file("dir/same", "5"),
+		"dir/chmod":  file("dir/chmod", "6"),
+		"dir/chown":  file("dir/chown", "7"),
+		"dir/dev":    {Path: "dir/dev", Type: CharDevice, DevMajor: 1, DevMinor: 5},
+		"added":      file("added", "12"),
+		"typechange": {Path: "typechange", Type: Directory},
+	}}
+	newer.Archives["dir/chmod"].Mode = 0600
+	newer.Archives["dir/chown"].UID = 1000
+	newer.Archives["c"].ModTime = 2
+
+	diff := DiffSnapshots(older, newer, "")
+	expected := []struct {
+		path string
+		typ  ChangeType
+		mods []Modification
+	}{
+		{"added", ChangeAdded, nil},
+		{"b", ChangeModified, []Modification{ModifiedContent}},
+		{"c", ChangeModified, []Modification{ModifiedContent, ModifiedTime}},
+		{"dir/chmod", ChangeModified, []Modification{ModifiedMode}},
+		{"dir/chown", ChangeModified, []Modification{ModifiedOwner}},
+		{"dir/dev", ChangeModified, []Modification{ModifiedDevice}},
+		{"dir/link", ChangeModified, []Modification{ModifiedTarget}},
+		{"removed", ChangeRemoved, nil},
+		{"typechange", ChangeModified, []Modification{ModifiedType}},
+	}
+	if len(diff.Changes) != len(expected) {
+		t.Errorf("Expected %d changes, got %d: %+v", len(expected), len(diff.Changes), diff.Changes)
+		return
+	}
+	for i, e := range expected {
+		c := diff.Changes[i]
+		if c.Path != e.path || c.Type != e.typ || !reflect.DeepEqual(c.Modifications, e.mods) {
+			t.Errorf("Expected %s to be %s %v, got %s %s %v", e.path, e.typ, e.mods, c.Path, c.Type, c.Modifications)
+		}
+	}
+
+	stats := DiffStats{Added: 1, Removed: 1, Modified: 7, AddedSize: 30, RemovedSize: 30}
+	if diff.Stats != stats {
+		t.Errorf("Expected stats %+v, got %+v", stats, diff.Stats)
+	}
+
+	// limited to a path
+	diff = DiffSnapshots(older, newer, "dir/")
+	if len(diff.Changes) != 4 || diff.Stats.Modified != 4 {
+		t.Errorf("Expected 4 changes below dir, got %+v", diff.Changes)
+	}
+	diff = DiffSnapshots(older, newer, "dir/same")
+	if len(diff.Changes) != 0 {
+		t.Errorf("Expected no changes for an unchanged file, got %+v", diff.Changes)
+	}
+}
@@ -8,21 +8,46 @@
 package knoxite
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"crypto/sha256"
 	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 // Available encryption algos.
 const (
 	EncryptionNone = iota
-	EncryptionAES
+	EncryptionAES  // legacy AES-CFB without authentication
+	EncryptionAESGCM
+	EncryptionChaCha20Poly1305
+)
+
+// Sealed blobs are prefixed with a small header, which is authenticated
+// alongside the ciphertext:
+//
+//	magic (3 bytes) | format version (1 byte) | method (1 byte) | nonce | ciphertext+tag
+const (
+	sealedMagic         = "knx"
+	sealedFormatVersion = 1
+	sealedHeaderLength  = len(sealedMagic) + 2
 )
 
+// Metadata (the repository, snapshots and the chunk-index) is always sealed
+// with authenticated encryption. Only while migrating repositories created
+// before version 5 the unauthenticated metadata written by older versions of
+// knoxite gets accepted, see decodeLegacyMetadata.
+const metadataEncryption = EncryptionAESGCM
+
 // Error declarations.
 var (
-	ErrInvalidPassword = errors.New("empty password not permitted")
+	ErrInvalidPassword          = errors.New("empty password not permitted")
+	ErrEncryptionUnknown        = errors.New("unknown encryption method")
+	ErrSealedFormatIncompatible = errors.New("encrypted data uses an unsupported format version")
+	ErrDataTampered             = errors.New("authentication failed, data has been tampered with or is corrupted")
 )
 
 // Encryptor is a pipeline processor that encrypts data.
@@ -31,6 +56,7 @@ type Encryptor struct {
 
 	iv    []byte
 	block cipher.Block
+	aead  cipher.AEAD
 }
 
 // NewEncryptor returns a newly configured Encryptor.
@@ -38,56 +64,80 @@ func NewEncryptor(method uint16, password string) (Encryptor, error) {
 	e := Encryptor{
 		Method: method,
 	}
-	if method == EncryptionAES {
-		if len(password) == 0 {
-			return e, ErrInvalidPassword
-		}
+	if method == EncryptionNone {
+		return e, nil
+	}
+	if len(password) == 0 {
+		return e, ErrInvalidPassword
+	}
 
-		key := sha256.Sum256([]byte(password))
+	key := sha256.Sum256([]byte(password))
+	var err error
+	switch method {
+	case EncryptionAES:
 		e.iv = key[:aes.BlockSize]
-
-		var err error
 		e.block, err = aes.NewCipher(key[:])
-		if err != nil {
-			return e, err
-		}
+	default:
+		e.aead, err = newAEAD(method, key[:])
 	}
 
-	return e, nil
+	return e, err
 }
 
 // Process encrypts the data.
 func (e Encryptor) Process(data []byte) ([]byte, error) {
-	if e.Method == EncryptionNone {
+	switch e.Method {
+	case EncryptionNone:
 		return data, nil
+	case EncryptionAES:
+		b := make([]byte, len(data))
+		encrypter := cipher.NewCFBEncrypter(e.block, e.iv)
+		encrypter.XORKeyStream(b, data)
+
+		return b, nil
 	}
 
-	b := make([]byte, len(data))
-	encrypter := cipher.NewCFBEncrypter(e.block, e.iv)
-	encrypter.XORKeyStream(b, data)
+	// every blob gets its own random nonce
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
 
-	return b, nil
+	header := append([]byte(sealedMagic), sealedFormatVersion, uint8(e.Method))
+	b := make([]byte, 0, len(header)+len(nonce)+len(data)+e.aead.Overhead())
+	b = append(b, header...)
+	b = append(b, nonce...)
+
+	return e.aead.Seal(b, nonce, data, header), nil
 }
 
 // Decryptor is a pipeline processor that decrypts data.
 type Decryptor struct {
 	Method uint16
 
+	key   []byte
 	iv    []byte
 	block cipher.Block
 }
 
 // NewDecryptor returns a newly configured Decryptor.
+// The format of the data is solely chosen by method: EncryptionAES expects
+// unauthenticated AES-CFB, all other methods sealed blobs.
 func NewDecryptor(method uint16, password string) (Decryptor, error) {
 	e := Decryptor{
 		Method: method,
 	}
-	if method == EncryptionAES {
-		if len(password) == 0 {
-			return e, ErrInvalidPassword
-		}
+	if method == EncryptionNone {
+		return e, nil
+	}
+	if len(password) == 0 {
+		return e, ErrInvalidPassword
+	}
 
-		key := sha256.Sum256([]byte(password))
+	key := sha256.Sum256([]byte(password))
+	e.key = key[:]
+	switch method {
+	case EncryptionAES:
 		e.iv = key[:aes.BlockSize]
 
 		var err error
@@ -95,6 +145,9 @@ func NewDecryptor(method uint16, password string) (Decryptor, error) {
 		if err != nil {
 			return e, err
 		}
+	case EncryptionAESGCM, EncryptionChaCha20Poly1305:
+	default:
+		return e, ErrEncryptionUnknown
 	}
 
 	return e, nil
@@ -106,9 +159,90 @@ func (e Decryptor) Process(data []byte) ([]byte, error) {
 		return data, nil
 	}
 
+	if e.Method != EncryptionAES {
+		return e.open(data)
+	}
+
 	b := make([]byte, len(data))
 	decrypter := cipher.NewCFBDecrypter(e.block, e.iv)
 	decrypter.XORKeyStream(b, data)
 
 	return b, nil
 }
+
+// open verifies and decrypts a sealed blob.
+func (e Decryptor) open(data []byte) ([]byte, error) {
+	if !isSealed(data) {
+		return nil, ErrDataTampered
+	}
+	header := data[:sealedHeaderLength]
+	if header[len(sealedMagic)] != sealedFormatVersion {
+		return nil, ErrSealedFormatIncompatible
+	}
+
+	method := uint16(header[len(sealedMagic)+1])
+	if method != e.Method {
+		// someone swapped the blob for one sealed with a different method
+		return nil, ErrDataTampered
+	}
+
+	aead, err := newAEAD(method, e.key)
+	if err != nil {
+		return nil, err
+	}
+
+	data = data[sealedHeaderLength:]
+	if len(data) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrDataTampered
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+
+	b, err := aead.Open(nil, nonce, ciphertext, header)
+	if err != nil {
+		return nil, ErrDataTampered
+	}
+
+	return b, nil
+}
+
+func newAEAD(method uint16, key []byte) (cipher.AEAD, error) {
+	switch method {
+	case EncryptionAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case EncryptionChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	}
+
+	return nil, ErrEncryptionUnknown
+}
+
+// isSealed returns true if data starts with a sealed blob header.
+func isSealed(data []byte) bool {
+	return len(data) >= sealedHeaderLength && bytes.HasPrefix(data, []byte(sealedMagic))
+}
+
+// decodeLegacyMetadata decodes metadata written by older versions of knoxite,
+// which is either sealed or unauthenticated AES-CFB. Unauthenticated data can
+// start with the magic bytes of a sealed blob by chance, so it falls back to
+// AES-CFB if the data can't be opened.
+func decodeLegacyMetadata(compression uint16, key string, b []byte, data interface{}) error {
+	if isSealed(b) {
+		pipe, err := NewDecodingPipeline(compression, metadataEncryption, key)
+		if err != nil {
+			return err
+		}
+		if err := pipe.Decode(b, data); err == nil {
+			return nil
+		}
+	}
+
+	pipe, err := NewDecodingPipeline(compression, EncryptionAES, key)
+	if err != nil {
+		return err
+	}
+	return pipe.Decode(b, data)
+}
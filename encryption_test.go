@@ -8,6 +8,7 @@
 package knoxite
 
 import (
+	"bytes"
 	"testing"
 )
 
@@ -49,3 +50,113 @@ func TestEmptyPassword(t *testing.T) {
 		t.Errorf("Expected %v, got %v", ErrInvalidPassword, err)
 	}
 }
+
+func TestAuthenticatedEncryption(t *testing.T) {
+	testPassword := "this_is_a_password"
+	b := []byte("1234567890")
+
+	for _, method := range []uint16{EncryptionAESGCM, EncryptionChaCha20Poly1305} {
+		epipe, err := NewEncodingPipeline(CompressionNone, method, testPassword)
+		if err != nil {
+			t.Error(err)
+		}
+		be1, err := epipe.Process(b)
+		if err != nil {
+			t.Error(err)
+		}
+		be2, err := epipe.Process(b)
+		if err != nil {
+			t.Error(err)
+		}
+		if bytes.Equal(be1, be2) {
+			t.Errorf("Method %d: encrypting the same data twice produced identical ciphertexts", method)
+		}
+
+		dpipe, err := NewDecodingPipeline(CompressionNone, method, testPassword)
+		if err != nil {
+			t.Error(err)
+		}
+		bd, err := dpipe.Process(be1)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(b) != string(bd) {
+			t.Errorf("Method %d: data mismatch after encryption & decryption cycle.", method)
+		}
+
+		// flip a single bit of the ciphertext
+		be1[len(be1)-1] ^= 1
+		_, err = dpipe.Process(be1)
+		if err != ErrDataTampered {
+			t.Errorf("Method %d: expected %v, got %v", method, ErrDataTampered, err)
+		}
+
+		dpipe, err = NewDecodingPipeline(CompressionNone, method, "this_is_another_password")
+		if err != nil {
+			t.Error(err)
+		}
+		_, err = dpipe.Process(be2)
+		if err != ErrDataTampered {
+			t.Errorf("Method %d: expected %v, got %v", method, ErrDataTampered, err)
+		}
+	}
+}
+
+func TestLegacyMetadataDecryption(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	for _, method := range []uint16{EncryptionAES, metadataEncryption} {
+		epipe, err := NewEncodingPipeline(CompressionNone, method, testPassword)
+		if err != nil {
+			t.Error(err)
+		}
+		b, err := epipe.Encode("1234567890")
+		if err != nil {
+			t.Error(err)
+		}
+
+		var s string
+		if err := decodeLegacyMetadata(CompressionNone, testPassword, b, &s); err != nil {
+			t.Errorf("Method %d: %s", method, err)
+		}
+		if s != "1234567890" {
+			t.Errorf("Method %d: data mismatch after encryption & decryption cycle.", method)
+		}
+	}
+}
+
+func TestLegacyDecryptionMagicPrefix(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	// AES-CFB uses a fixed IV, so the key stream tells which plaintext gets
+	// encrypted to data starting with the magic bytes of sealed blobs
+	epipe, err := NewEncodingPipeline(CompressionNone, EncryptionAES, testPassword)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	stream, _ := epipe.Process(make([]byte, 32))
+	b := make([]byte, len(stream))
+	copy(b, sealedMagic)
+	for i := range b {
+		b[i] ^= stream[i]
+	}
+	be, _ := epipe.Process(b)
+	if !isSealed(be) {
+		t.Errorf("Expected encrypted data to start with %q, got %q", sealedMagic, be[:3])
+		return
+	}
+
+	dpipe, err := NewDecodingPipeline(CompressionNone, EncryptionAES, testPassword)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	bd, err := dpipe.Process(be)
+	if err != nil {
+		t.Errorf("Failed decrypting AES-CFB data: %s", err)
+	}
+	if !bytes.Equal(b, bd) {
+		t.Errorf("Data mismatch after encryption & decryption cycle.")
+	}
+}
@@ -0,0 +1,190 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cacheDirSignature is the header of a valid CACHEDIR.TAG file, see
+// https://bford.info/cachedir/
+const cacheDirSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+
+// An excludeRule is a single gitignore-style pattern.
+type excludeRule struct {
+	pattern string
+	elems   []string
+	// negate re-includes paths excluded by earlier rules
+	negate bool
+	// dirOnly rules only match directories
+	dirOnly bool
+	// anchored rules match paths from their start, all others match base
+	// names at any depth
+	anchored bool
+}
+
+// parseExcludeRule parses a line of gitignore syntax. It returns false for
+// blank lines & comments.
+func parseExcludeRule(pattern string) (excludeRule, bool, error) {
+	rule := excludeRule{pattern: pattern}
+
+	// trailing spaces are ignored, unless they're escaped
+	for strings.HasSuffix(pattern, " ") && !strings.HasSuffix(pattern, "\\ ") {
+		pattern = pattern[:len(pattern)-1]
+	}
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return rule, false, nil
+	}
+
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, "\\!") || strings.HasPrefix(pattern, "\\#") {
+		pattern = pattern[1:]
+	}
+	pattern = filepath.ToSlash(pattern)
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	rule.anchored = strings.Contains(pattern, "/")
+	if foldCase {
+		pattern = strings.ToLower(pattern)
+	}
+
+	rule.elems = splitPath(pattern)
+	for _, elem := range rule.elems {
+		if _, err := filepath.Match(elem, ""); err != nil {
+			return rule, false, fmt.Errorf("invalid pattern %s: %w", rule.pattern, err)
+		}
+	}
+	return rule, true, nil
+}
+
+// matches reports whether the rule matches path, which is split into its
+// elements.
+func (rule excludeRule) matches(path []string, isDir bool) bool {
+	if rule.dirOnly && !isDir {
+		return false
+	}
+	if !rule.anchored {
+		path = path[len(path)-1:]
+	}
+
+	// patterns have been validated, so errors can't occur
+	match, _ := matchElements(rule.elems, path)
+	return match
+}
+
+// An excludeMatcher decides which paths are excluded by a list of rules
+// following the syntax of gitignore. The last matching rule wins, so negated
+// rules can re-include paths.
+type excludeMatcher struct {
+	rules []excludeRule
+}
+
+// newExcludeMatcher parses patterns and returns an error for the first
+// malformed one.
+func newExcludeMatcher(patterns []string) (*excludeMatcher, error) {
+	m := &excludeMatcher{}
+	for _, pattern := range patterns {
+		rule, ok, err := parseExcludeRule(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			m.rules = append(m.rules, rule)
+		}
+	}
+	return m, nil
+}
+
+// excluded reports whether path is excluded. Anchored rules match if they
+// match any of the alternative notations of path, e.g. its relative and its
+// absolute form.
+func (m *excludeMatcher) excluded(isDir bool, paths ...string) bool {
+	var elems [][]string
+	for _, path := range paths {
+		if foldCase {
+			path = strings.ToLower(path)
+		}
+		elems = append(elems, splitPath(path))
+	}
+
+	for i := len(m.rules) - 1; i >= 0; i-- {
+		for _, e := range elems {
+			if m.rules[i].matches(e, isDir) {
+				return !m.rules[i].negate
+			}
+		}
+	}
+	return false
+}
+
+// excludedTree reports whether path or one of its parent directories is
+// excluded. Like with gitignore, content of an excluded directory can't be
+// re-included.
+func (m *excludeMatcher) excludedTree(path string, isDir bool) bool {
+	elems := splitPath(path)
+	for i := 1; i < len(elems); i++ {
+		if m.excluded(true, filepath.Join(elems[:i]...)) {
+			return true
+		}
+	}
+	return m.excluded(isDir, path)
+}
+
+// readExcludeFile returns the patterns found in a file, one per line.
+func readExcludeFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		patterns = append(patterns, strings.TrimSuffix(scanner.Text(), "\r"))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading exclude file %s: %w", path, err)
+	}
+	return patterns, nil
+}
+
+// excludeDir reports whether the directory at path contains one of the files
+// named in names, or a valid CACHEDIR.TAG file if caches is set.
+func excludeDir(path string, names []string, caches bool) bool {
+	for _, name := range names {
+		if _, err := os.Lstat(filepath.Join(path, name)); err == nil {
+			return true
+		}
+	}
+
+	if caches {
+		f, err := os.Open(filepath.Join(path, "CACHEDIR.TAG"))
+		if err != nil {
+			return false
+		}
+		defer f.Close()
+
+		b := make([]byte, len(cacheDirSignature))
+		if _, err := io.ReadFull(f, b); err != nil {
+			return false
+		}
+		return bytes.Equal(b, []byte(cacheDirSignature))
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestExcludeMatcher(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		path     string
+		isDir    bool
+		excluded bool
+	}{
+		{[]string{"*.log"}, "app.log", false, true},
+		{[]string{"*.log"}, "var/log/app.log", false, true},
+		{[]string{"*.log"}, "app.log.gz", false, false},
+		{[]string{"# comment"}, "# comment", false, false},
+		{[]string{"\\#notes"}, "#notes", false, true},
+		{[]string{""}, "docs", true, false},
+		{[]string{"build/"}, "src/build", true, true},
+		{[]string{"build/"}, "src/build", false, false},
+		{[]string{"/build"}, "build", true, true},
+		{[]string{"/build"}, "src/build", true, false},
+		{[]string{"doc/*.txt"}, "doc/notes.txt", false, true},
+		{[]string{"doc/*.txt"}, "doc/server/arch.txt", false, false},
+		{[]string{"doc/**/*.txt"}, "doc/server/arch.txt", false, true},
+		{[]string{"**/cache"}, "home/alice/cache", true, true},
+		{[]string{"cache/**"}, "cache/a/b", false, true},
+		{[]string{"*.log", "!important.log"}, "important.log", false, false},
+		{[]string{"!important.log", "*.log"}, "important.log", false, true},
+		{[]string{"trailing  "}, "trailing", false, true},
+		{[]string{"Makefile"}, "makefile", false, foldCase},
+	}
+	for _, tt := range tests {
+		m, err := newExcludeMatcher(tt.patterns)
+		if err != nil {
+			t.Errorf("Failed parsing %v: %s", tt.patterns, err)
+			continue
+		}
+		if excluded := m.excluded(tt.isDir, tt.path); excluded != tt.excluded {
+			t.Errorf("Expected %v excluding %s to be %v, got %v", tt.patterns, tt.path, tt.excluded, excluded)
+		}
+	}
+
+	m, err := newExcludeMatcher([]string{"build", "!build/keep"})
+	if err != nil {
+		t.Errorf("Failed parsing patterns: %s", err)
+		return
+	}
+	// content of excluded directories can't be re-included
+	if !m.excludedTree("build/keep", false) {
+		t.Errorf("Expected build/keep to be excluded")
+	}
+
+	if _, err := newExcludeMatcher([]string{"**/[a"}); err == nil {
+		t.Errorf("Expected invalid pattern to fail")
+	}
+}
+
+func TestStoreExcludes(t *testing.T) {
+	sourcedir, err := ioutil.TempDir("", "knoxite.source")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for source: %s", err)
+		return
+	}
+	defer os.RemoveAll(sourcedir)
+
+	files := map[string]string{
+		"a.txt":                   "",
+		"a.log":                   "",
+		"keep.log":                "",
+		"build/out":               "",
+		"src/build/out":           "",
+		"private/.nobackup":       "",
+		"private/secret":          "",
+		"cache/CACHEDIR.TAG":      cacheDirSignature + "\n",
+		"cache/data":              "",
+		"notacache/CACHEDIR.TAG":  "no signature",
+		"notacache/data":          "",
+		"excludes/store.excludes": "# build output\n/build\n\n*.log\n!keep.log\n",
+	}
+	for path, data := range files {
+		path = filepath.Join(sourcedir, path)
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Errorf("Failed creating source dir: %s", err)
+			return
+		}
+		err = ioutil.WriteFile(path, []byte(data), 0644)
+		if err != nil {
+			t.Errorf("Failed writing source file: %s", err)
+			return
+		}
+	}
+
+	opts := StoreOptions{
+		CWD:              sourcedir,
+		ExcludeFiles:     []string{filepath.Join(sourcedir, "excludes", "store.excludes")},
+		ExcludeIfPresent: []string{".nobackup"},
+		ExcludeCaches:    true,
+	}
+	excludes, err := opts.excludeMatcher()
+	if err != nil {
+		t.Errorf("Failed reading excludes: %s", err)
+		return
+	}
+
+	var paths []string
+	for result := range findFiles(sourcedir, opts, &scanState{excludes: excludes, links: make(map[inodeKey]string)}) {
+		if result.Error != nil {
+			t.Errorf("Failed finding files: %s", result.Error)
+			return
+		}
+		path := relPath(sourcedir, result.Archive.Path)
+		if path != "." {
+			paths = append(paths, filepath.ToSlash(path))
+		}
+	}
+	sort.Strings(paths)
+
+	expected := []string{
+		"a.txt",
+		"excludes",
+		"excludes/store.excludes",
+		"keep.log",
+		"notacache",
+		"notacache/CACHEDIR.TAG",
+		"notacache/data",
+		"src",
+		"src/build",
+		"src/build/out",
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected paths %v, got %v", expected, paths)
+	}
+
+	opts.ExcludeFiles = []string{filepath.Join(sourcedir, "missing")}
+	if _, err := opts.excludeMatcher(); err == nil {
+		t.Errorf("Expected missing exclude file to fail")
+	}
+}
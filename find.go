@@ -0,0 +1,167 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFindJobs = 4
+)
+
+// FindOptions holds the criteria archives need to match for FindArchives.
+type FindOptions struct {
+	// Pattern is a glob pattern, matched against an archive's file name. If
+	// it contains a path separator, it gets matched against the entire path
+	Pattern string
+	// Regex treats Pattern as a regular expression, matched against the
+	// entire path
+	Regex      bool
+	IgnoreCase bool
+
+	MinSize        uint64    // 0 for no limit
+	MaxSize        uint64    // 0 for no limit
+	ModifiedAfter  time.Time // zero for no limit
+	ModifiedBefore time.Time // zero for no limit
+	Types          []uint8   // archive types, empty for all
+
+	// Jobs is the number of snapshots being loaded at the same time
+	Jobs int
+}
+
+// A FindResult is an archive matching the criteria passed to FindArchives,
+// or an error which occurred while searching.
+type FindResult struct {
+	Volume   *Volume
+	Snapshot *Snapshot
+	Archive  *Archive
+	Error    error
+}
+
+// archiveMatcher returns a function checking whether an archive matches opts.
+func (opts FindOptions) archiveMatcher() (func(*Archive) bool, error) {
+	var matchPath func(string) bool
+	if opts.Regex {
+		expr := opts.Pattern
+		if opts.IgnoreCase {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		matchPath = re.MatchString
+	} else {
+		pattern := opts.Pattern
+		if opts.IgnoreCase {
+			pattern = strings.ToLower(pattern)
+		}
+		// check the pattern, before anything gets loaded
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+
+		fullPath := strings.ContainsRune(pattern, filepath.Separator)
+		matchPath = func(path string) bool {
+			if opts.IgnoreCase {
+				path = strings.ToLower(path)
+			}
+			if !fullPath {
+				path = filepath.Base(path)
+			}
+			ok, _ := filepath.Match(pattern, path)
+			return ok
+		}
+	}
+
+	return func(arc *Archive) bool {
+		if len(opts.Types) > 0 {
+			found := false
+			for _, t := range opts.Types {
+				if t == arc.Type {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		if arc.Size < opts.MinSize || (opts.MaxSize > 0 && arc.Size > opts.MaxSize) {
+			return false
+		}
+		modTime := time.Unix(arc.ModTime, 0)
+		if (!opts.ModifiedAfter.IsZero() && modTime.Before(opts.ModifiedAfter)) ||
+			(!opts.ModifiedBefore.IsZero() && modTime.After(opts.ModifiedBefore)) {
+			return false
+		}
+
+		return matchPath(arc.Path)
+	}, nil
+}
+
+// FindArchives searches all snapshots of all volumes for archives matching
+// opts. Snapshots get loaded concurrently, so results arrive in no particular
+// order.
+func (r *Repository) FindArchives(opts FindOptions) (<-chan FindResult, error) {
+	match, err := opts.archiveMatcher()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Jobs <= 0 {
+		opts.Jobs = defaultFindJobs
+	}
+
+	type job struct {
+		volume *Volume
+		id     string
+	}
+	jobs := make(chan job)
+	go func() {
+		defer close(jobs)
+		for _, volume := range r.Volumes {
+			for _, id := range volume.Snapshots {
+				jobs <- job{volume, id}
+			}
+		}
+	}()
+
+	results := make(chan FindResult)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				snapshot, err := j.volume.LoadSnapshot(j.id, r)
+				if err != nil {
+					results <- FindResult{Volume: j.volume, Error: err}
+					continue
+				}
+
+				for _, arc := range snapshot.Archives {
+					if match(arc) {
+						results <- FindResult{Volume: j.volume, Snapshot: snapshot, Archive: arc}
+					}
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	return results, nil
+}
@@ -0,0 +1,89 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFindArchives(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository(dir, testPassword)
+	index, _ := OpenChunkIndex(&r)
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+	other, _ := NewVolume("other", "")
+	_ = r.AddVolume(other)
+
+	storePackedSnapshot(t, &r, vol, &index, []string{"find.go", "find_test.go", "diff.go"})
+	storePackedSnapshot(t, &r, vol, &index, []string{"find.go"})
+	storePackedSnapshot(t, &r, other, &index, []string{"find.go", "scripts"})
+
+	fi, err := os.Stat("find.go")
+	if err != nil {
+		t.Errorf("Failed to stat find.go: %s", err)
+		return
+	}
+
+	tests := []struct {
+		opts  FindOptions
+		found int
+	}{
+		{FindOptions{Pattern: "find.go"}, 3},
+		{FindOptions{Pattern: "FIND.GO"}, 0},
+		{FindOptions{Pattern: "FIND.GO", IgnoreCase: true}, 3},
+		{FindOptions{Pattern: "*_test.go"}, 1},
+		{FindOptions{Pattern: "scripts"}, 1},
+		{FindOptions{Pattern: "scripts", Types: []uint8{File}}, 0},
+		{FindOptions{Pattern: "scripts", Types: []uint8{Directory}}, 1},
+		{FindOptions{Pattern: `^(find|diff)\.go$`, Regex: true}, 4},
+		{FindOptions{Pattern: "*.go", MinSize: uint64(fi.Size())}, 4},
+		{FindOptions{Pattern: "find.go", MaxSize: uint64(fi.Size()) - 1}, 0},
+		{FindOptions{Pattern: "find.go", ModifiedAfter: fi.ModTime().Add(time.Second)}, 0},
+		{FindOptions{Pattern: "find.go", ModifiedBefore: fi.ModTime().Add(time.Second), Jobs: 1}, 3},
+	}
+	for _, tt := range tests {
+		results, err := r.FindArchives(tt.opts)
+		if err != nil {
+			t.Errorf("Failed finding archives: %s", err)
+			continue
+		}
+
+		found := 0
+		for res := range results {
+			if res.Error != nil {
+				t.Errorf("Failed finding archives: %s", res.Error)
+				continue
+			}
+			if res.Snapshot == nil || res.Volume == nil {
+				t.Errorf("Expected result to contain its volume and snapshot")
+			}
+			found++
+		}
+		if found != tt.found {
+			t.Errorf("Options %+v: expected %d results, got %d", tt.opts, tt.found, found)
+		}
+	}
+
+	for _, opts := range []FindOptions{{Pattern: "["}, {Pattern: "(", Regex: true}} {
+		if _, err := r.FindArchives(opts); err == nil {
+			t.Errorf("Expected invalid pattern %s to fail", opts.Pattern)
+		}
+	}
+}
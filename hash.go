@@ -8,8 +8,11 @@
 package knoxite
 
 import (
+	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
+	"fmt"
 
 	"github.com/minio/highwayhash"
 )
@@ -20,6 +23,7 @@ const (
 	HashHighway256
 )
 
+// hashkey is the all-zero key used for unkeyed hashes.
 var hashkey [32]byte
 
 // Hash data.
@@ -35,3 +39,25 @@ func Hash(b []byte, hashtype uint8) string {
 
 	return hex.EncodeToString(data[:])
 }
+
+// KeyedHash returns a MAC of b, keyed with key. Unlike Hash, nobody without
+// the key can tell which data a KeyedHash belongs to.
+func KeyedHash(b []byte, key []byte) string {
+	data := highwayhash.Sum(b, key)
+	return hex.EncodeToString(data[:])
+}
+
+// deriveHashKey derives the key for content hashes from a repository secret.
+func deriveHashKey(secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte("knoxite content hash key"))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// chunkName returns the name a chunk gets stored under: a MAC of its content
+// and encoding, so the same content stored with different settings or keys
+// never ends up with the same name.
+func chunkName(hashKey []byte, c Chunk, compressed, encrypted uint16) string {
+	return KeyedHash([]byte(fmt.Sprintf("%s:%d:%d:%d:%d:%d",
+		c.DecryptedHash, compressed, encrypted, c.DataParts, c.ParityParts, c.KeyGeneration)), hashKey)
+}
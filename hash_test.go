@@ -0,0 +1,172 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// storedChunkNames returns the names of all chunk files in a repository.
+func storedChunkNames(dir string) []string {
+	var names []string
+	_ = filepath.Walk(filepath.Join(dir, chunksDirname), func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() && fi.Name() != ChunkIndexFilename {
+			names = append(names, fi.Name())
+		}
+		return nil
+	})
+	return names
+}
+
+func TestKeyedHashes(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository(dir, testPassword)
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+	index, _ := OpenChunkIndex(&r)
+	// without compression & encryption the stored data equals the plaintext
+	opts := StoreOptions{Paths: []string{"snapshot.go"}, Compress: CompressionNone, Encrypt: EncryptionNone}
+	if r.HashKey == "" {
+		t.Error("Expected new repository to have a hash key")
+		return
+	}
+
+	snapshot := storeSnapshot(t, &r, vol, &index, opts)
+	data, _ := ioutil.ReadFile("snapshot.go")
+	plainHash := Hash(data, HashHighway256)
+
+	arc := snapshot.Archives["snapshot.go"]
+	for _, chunk := range arc.Chunks {
+		if !chunk.Keyed {
+			t.Errorf("Expected chunk %s to be keyed", chunk.Hash)
+		}
+	}
+	if len(arc.Chunks) == 1 && arc.Chunks[0].DecryptedHash == plainHash {
+		t.Error("Content hash is not keyed")
+	}
+	for _, name := range storedChunkNames(dir) {
+		if strings.HasPrefix(name, plainHash) {
+			t.Errorf("Chunk name %s reveals its content", name)
+		}
+	}
+
+	r2, err := OpenRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed opening repository: %s", err)
+		return
+	}
+	if r2.HashKey != r.HashKey {
+		t.Error("Hash key got lost")
+	}
+	if err := VerifyArchive(r2, *arc); err != nil {
+		t.Errorf("Failed verifying archive: %s", err)
+	}
+}
+
+func TestKeyedHashesMigration(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// a repository created before content hashes got keyed
+	r, _ := NewRepository(dir, testPassword)
+	r.HashKey = ""
+	r.Version = 6
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+	index, _ := OpenChunkIndex(&r)
+	opts := StoreOptions{Paths: []string{"snapshot.go"}, Compress: CompressionNone, Encrypt: EncryptionNone}
+	legacy := storeSnapshot(t, &r, vol, &index, opts)
+	if legacy.Archives["snapshot.go"].Chunks[0].Keyed {
+		t.Error("Expected legacy chunks to be unkeyed")
+		return
+	}
+
+	r, err = OpenRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed opening repository: %s", err)
+		return
+	}
+	if r.Version != RepositoryVersion || r.HashKey == "" {
+		t.Errorf("Expected repository to be migrated, got version %d", r.Version)
+		return
+	}
+	vol, _ = r.FindVolume(vol.ID)
+	index, _ = OpenChunkIndex(&r)
+
+	// old chunks stay readable, new ones are keyed
+	if err := VerifyArchive(r, *legacy.Archives["snapshot.go"]); err != nil {
+		t.Errorf("Failed verifying legacy archive: %s", err)
+	}
+	snapshot := storeSnapshot(t, &r, vol, &index, opts)
+	if !snapshot.Archives["snapshot.go"].Chunks[0].Keyed {
+		t.Error("Expected new chunks to be keyed")
+	}
+
+	// a key rotation re-encodes the legacy chunks
+	if err := r.RotateKey(&index); err != nil {
+		t.Errorf("Failed rotating key: %s", err)
+		return
+	}
+	progress, err := RotateChunks(&r, &index, 0)
+	if err != nil {
+		t.Errorf("Failed rotating chunks: %s", err)
+		return
+	}
+	for p := range progress {
+		if p.Error != nil {
+			t.Errorf("Failed rotating chunks: %s", p.Error)
+		}
+	}
+
+	data, _ := ioutil.ReadFile("snapshot.go")
+	plainHash := Hash(data, HashHighway256)
+	for _, name := range storedChunkNames(dir) {
+		if strings.HasPrefix(name, plainHash) {
+			t.Errorf("Legacy chunk %s is still stored", name)
+		}
+	}
+	if n := len(storedChunkNames(dir)); n != len(index.Chunks) {
+		t.Errorf("Expected %d chunks in storage, found %d", len(index.Chunks), n)
+	}
+
+	for _, id := range vol.Snapshots {
+		_, s, err := r.FindSnapshot(id)
+		if err != nil {
+			t.Errorf("Failed finding snapshot: %s", err)
+			continue
+		}
+		for _, arc := range s.Archives {
+			for _, chunk := range arc.Chunks {
+				if !chunk.Keyed {
+					t.Errorf("Chunk %s is still unkeyed", chunk.Hash)
+				}
+			}
+			if err := VerifyArchive(r, *arc); err != nil {
+				t.Errorf("Failed verifying archive %s: %s", arc.Path, err)
+			}
+		}
+	}
+}
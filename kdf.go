@@ -0,0 +1,86 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Available key derivation functions.
+const (
+	KDFScrypt = "scrypt"
+)
+
+const (
+	kdfSaltLength = 32
+
+	// the cost parameters are read from the unauthenticated repository
+	// header, so they must not be able to exhaust our memory or CPU
+	maxScryptMemory = 1 << 30 // bytes
+	maxScryptP      = 16
+)
+
+// DefaultKDFParams are the cost parameters used when a repository gets a new
+// password. They can be raised to make brute-forcing passwords more expensive.
+var DefaultKDFParams = KDFParams{
+	Algorithm: KDFScrypt,
+	N:         1 << 15,
+	R:         8,
+	P:         1,
+}
+
+// Error declarations.
+var (
+	ErrKDFUnknown       = errors.New("unknown key derivation function")
+	ErrKDFParamsInvalid = errors.New("key derivation parameters out of bounds")
+)
+
+// KDFParams holds the salt and cost parameters used to derive a key from a
+// password.
+type KDFParams struct {
+	Algorithm string `json:"algorithm"`
+	Salt      []byte `json:"salt"`
+	N         int    `json:"n"`
+	R         int    `json:"r"`
+	P         int    `json:"p"`
+}
+
+// NewKDFParams returns the default cost parameters with a fresh random salt.
+func NewKDFParams() (KDFParams, error) {
+	params := DefaultKDFParams
+	params.Salt = make([]byte, kdfSaltLength)
+
+	_, err := rand.Read(params.Salt)
+	return params, err
+}
+
+// DeriveKey derives a key from password.
+func (p KDFParams) DeriveKey(password string) (string, error) {
+	if len(password) == 0 {
+		return "", ErrInvalidPassword
+	}
+
+	switch p.Algorithm {
+	case KDFScrypt:
+		if p.N <= 1 || p.R <= 0 || p.P <= 0 || p.P > maxScryptP ||
+			p.N > maxScryptMemory/128/p.R {
+			return "", ErrKDFParamsInvalid
+		}
+		key, err := scrypt.Key([]byte(password), p.Salt, p.N, p.R, p.P, 32)
+		if err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(key), nil
+	}
+
+	return "", ErrKDFUnknown
+}
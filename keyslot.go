@@ -0,0 +1,114 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"time"
+
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+// A KeySlot grants access to a repository. It holds the repository's master
+// key, sealed with a key derived from the slot's password or key file.
+type KeySlot struct {
+	ID          string    `json:"id"`
+	Description string    `json:"description"`
+	Created     time.Time `json:"created"`
+	KDF         KDFParams `json:"kdf"`
+	Key         []byte    `json:"key"` // sealed master key
+}
+
+// Error declarations.
+var (
+	ErrKeySlotNotFound = errors.New("key slot not found")
+	ErrLastKeySlot     = errors.New("can't remove the last key slot of a repository")
+)
+
+// newKeySlot seals masterKey with a key derived from password.
+func newKeySlot(masterKey, password, description string) (KeySlot, error) {
+	slot := KeySlot{
+		Description: description,
+		Created:     time.Now(),
+	}
+
+	u, err := uuid.NewV4()
+	if err != nil {
+		return slot, err
+	}
+	slot.ID = u.String()[:8]
+
+	slot.KDF, err = NewKDFParams()
+	if err != nil {
+		return slot, err
+	}
+	key, err := slot.KDF.DeriveKey(password)
+	if err != nil {
+		return slot, err
+	}
+
+	pipe, err := NewEncodingPipeline(CompressionNone, metadataEncryption, key)
+	if err != nil {
+		return slot, err
+	}
+	slot.Key, err = pipe.Process([]byte(masterKey))
+	return slot, err
+}
+
+// open returns the master key if password unlocks this slot.
+func (slot KeySlot) open(password string) (string, error) {
+	key, err := slot.KDF.DeriveKey(password)
+	if err != nil {
+		return "", err
+	}
+
+	pipe, err := NewDecodingPipeline(CompressionNone, metadataEncryption, key)
+	if err != nil {
+		return "", err
+	}
+	b, err := pipe.Process(slot.Key)
+	return string(b), err
+}
+
+// KeySlots returns the repository's key slots.
+func (r *Repository) KeySlots() []KeySlot {
+	return r.keySlots
+}
+
+// KeySlot returns the key slot the repository has been opened with.
+func (r *Repository) KeySlot() string {
+	return r.keySlot
+}
+
+// AddKey adds a key slot that unlocks the repository with password.
+// Call Save to persist it.
+func (r *Repository) AddKey(password, description string) (KeySlot, error) {
+	slot, err := newKeySlot(r.masterKey, password, description)
+	if err != nil {
+		return slot, err
+	}
+
+	r.keySlots = append(r.keySlots, slot)
+	return slot, nil
+}
+
+// RemoveKey removes a key slot from the repository. Call Save to persist it.
+func (r *Repository) RemoveKey(id string) error {
+	for i, slot := range r.keySlots {
+		if slot.ID == id {
+			if len(r.keySlots) == 1 {
+				return ErrLastKeySlot
+			}
+
+			r.keySlots = append(r.keySlots[:i], r.keySlots[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrKeySlotNotFound
+}
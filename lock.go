@@ -0,0 +1,245 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+// A Lock prevents concurrent operations from corrupting a repository. Any
+// number of shared locks can be held at the same time, while an exclusive
+// lock can't be held alongside any other lock.
+type Lock struct {
+	ID        string    `json:"id"`
+	Exclusive bool      `json:"exclusive"`
+	Holder    string    `json:"holder"`
+	Host      string    `json:"host"`
+	PID       int       `json:"pid"`
+	Created   time.Time `json:"created"`
+	Refreshed time.Time `json:"refreshed"`
+
+	key     string
+	backend BackendManager
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+const (
+	// StaleLockTimeout is the duration after which a lock, which hasn't been
+	// refreshed by its holder, is considered stale.
+	StaleLockTimeout = 30 * time.Minute
+
+	lockRefreshInterval = 5 * time.Minute
+)
+
+// Error declarations.
+var (
+	ErrRepositoryLocked = errors.New("repository is locked")
+)
+
+// LockedError is returned when a repository can't be locked, because someone
+// else is holding a conflicting lock.
+type LockedError struct {
+	Lock Lock
+}
+
+func (e LockedError) Error() string {
+	if e.Lock.Created.IsZero() {
+		return fmt.Sprintf("%s by unreadable lock %s", ErrRepositoryLocked, e.Lock.ID)
+	}
+
+	kind := "shared"
+	if e.Lock.Exclusive {
+		kind = "exclusive"
+	}
+	return fmt.Sprintf("%s by %s (%s lock %s, PID %d on %s, since %s)",
+		ErrRepositoryLocked, e.Lock.Holder, kind, e.Lock.ID, e.Lock.PID, e.Lock.Host,
+		e.Lock.Created.Format(time.RFC3339))
+}
+
+// Unwrap returns ErrRepositoryLocked.
+func (e LockedError) Unwrap() error {
+	return ErrRepositoryLocked
+}
+
+// Lock acquires a shared or exclusive lock on the repository and reloads its
+// metadata, so changes made by previous lock holders are picked up. The lock
+// gets refreshed in the background until Unlock is called.
+func (r *Repository) Lock(exclusive bool) (*Lock, error) {
+	u, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &Lock{
+		ID:        u.String()[:8],
+		Exclusive: exclusive,
+		PID:       os.Getpid(),
+		Created:   time.Now(),
+		key:       r.Key,
+	}
+	lock.Refreshed = lock.Created
+	lock.Host, _ = os.Hostname()
+	if usr, err := user.Current(); err == nil {
+		lock.Holder = usr.Username
+	}
+
+	// the lock gets refreshed while the repository's backends are busy, so
+	// it needs connections of its own
+	for _, url := range r.backend.Locations() {
+		backend, err := BackendFromURL(url)
+		if err != nil {
+			return nil, err
+		}
+		lock.backend.AddBackend(&backend)
+	}
+
+	// store our lock before checking for others, so two processes racing for
+	// a lock will always see each other
+	err = lock.save()
+	if err != nil {
+		lock.close()
+		return nil, err
+	}
+
+	locks, err := r.Locks()
+	if err == nil {
+		for _, l := range locks {
+			if l.ID == lock.ID || l.IsStale() {
+				continue
+			}
+			if exclusive || l.Exclusive {
+				err = LockedError{l}
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = r.reload()
+	}
+	if err != nil {
+		_ = lock.backend.DeleteLock(lock.ID)
+		lock.close()
+		return nil, err
+	}
+
+	lock.done = make(chan struct{})
+	lock.stopped = make(chan struct{})
+	go lock.refresh()
+
+	return lock, nil
+}
+
+// Locks returns all locks currently held on the repository. Locks which can't
+// be decrypted are returned with only their ID set.
+func (r *Repository) Locks() ([]Lock, error) {
+	ids, err := r.backend.ListLocks()
+	if err != nil {
+		return nil, err
+	}
+
+	var locks []Lock
+	for _, id := range ids {
+		lock := Lock{ID: id}
+
+		b, err := r.backend.LoadLock(id)
+		if err != nil {
+			// the lock has been released in the meantime
+			continue
+		}
+		if err := r.decodeMetadata(b, &lock); err != nil {
+			lock = Lock{ID: id, Exclusive: true}
+		}
+		locks = append(locks, lock)
+	}
+
+	return locks, nil
+}
+
+// RemoveLock removes a lock from the repository, regardless of who's holding
+// it.
+func (r *Repository) RemoveLock(id string) error {
+	return r.backend.DeleteLock(id)
+}
+
+// IsStale returns true if the lock's holder isn't alive anymore. Locks which
+// can't be decrypted are never considered stale.
+func (lock Lock) IsStale() bool {
+	if lock.Refreshed.IsZero() {
+		return false
+	}
+	if time.Since(lock.Refreshed) > StaleLockTimeout {
+		return true
+	}
+
+	// on the same host we can check whether the holder is still running
+	hostname, err := os.Hostname()
+	if err == nil && lock.Host == hostname {
+		return !processExists(lock.PID)
+	}
+
+	return false
+}
+
+// Unlock releases the lock.
+func (lock *Lock) Unlock() error {
+	if lock.done != nil {
+		close(lock.done)
+		<-lock.stopped
+		lock.done = nil
+	}
+
+	err := lock.backend.DeleteLock(lock.ID)
+	lock.close()
+	return err
+}
+
+// refresh periodically updates the lock, so others don't consider it stale.
+func (lock *Lock) refresh() {
+	defer close(lock.stopped)
+
+	ticker := time.NewTicker(lockRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lock.done:
+			return
+		case <-ticker.C:
+			lock.Refreshed = time.Now()
+			if err := lock.save(); err != nil {
+				log.Warnf("Refreshing lock %s failed: %v", lock.ID, err)
+			}
+		}
+	}
+}
+
+func (lock *Lock) save() error {
+	pipe, err := NewEncodingPipeline(CompressionLZMA, metadataEncryption, lock.key)
+	if err != nil {
+		return err
+	}
+	b, err := pipe.Encode(lock)
+	if err != nil {
+		return err
+	}
+
+	return lock.backend.SaveLock(lock.ID, b)
+}
+
+func (lock *Lock) close() {
+	for _, be := range lock.backend.Backends {
+		_ = (*be).Close()
+	}
+}
@@ -0,0 +1,231 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRepositoryLock(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+
+	shared1, err := r.Lock(false)
+	if err != nil {
+		t.Errorf("Failed acquiring shared lock: %s", err)
+		return
+	}
+	shared2, err := r.Lock(false)
+	if err != nil {
+		t.Errorf("Failed acquiring second shared lock: %s", err)
+		return
+	}
+
+	_, err = r.Lock(true)
+	if !errors.Is(err, ErrRepositoryLocked) {
+		t.Errorf("Expected %v, got %v", ErrRepositoryLocked, err)
+	}
+
+	locks, err := r.Locks()
+	if err != nil {
+		t.Errorf("Failed listing locks: %s", err)
+		return
+	}
+	if len(locks) != 2 {
+		t.Errorf("Expected 2 locks, got %d", len(locks))
+	}
+
+	_ = shared1.Unlock()
+	_ = shared2.Unlock()
+
+	exclusive, err := r.Lock(true)
+	if err != nil {
+		t.Errorf("Failed acquiring exclusive lock: %s", err)
+		return
+	}
+	_, err = r.Lock(false)
+	if !errors.Is(err, ErrRepositoryLocked) {
+		t.Errorf("Expected %v, got %v", ErrRepositoryLocked, err)
+	}
+	_ = exclusive.Unlock()
+
+	locks, _ = r.Locks()
+	if len(locks) != 0 {
+		t.Errorf("Expected all locks to be released, found %d", len(locks))
+	}
+}
+
+func TestRepositoryStaleLock(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+
+	// a lock which hasn't been refreshed in a long time
+	stale := Lock{
+		ID:        "deadbeef",
+		Exclusive: true,
+		Holder:    "someone",
+		Host:      "elsewhere",
+		PID:       1,
+		Created:   time.Now().Add(-2 * StaleLockTimeout),
+		Refreshed: time.Now().Add(-2 * StaleLockTimeout),
+		key:       r.Key,
+		backend:   r.backend,
+	}
+	err = stale.save()
+	if err != nil {
+		t.Errorf("Failed saving lock: %s", err)
+		return
+	}
+
+	locks, err := r.Locks()
+	if err != nil {
+		t.Errorf("Failed listing locks: %s", err)
+		return
+	}
+	if len(locks) != 1 || !locks[0].IsStale() {
+		t.Errorf("Expected a single stale lock, got %v", locks)
+	}
+
+	lock, err := r.Lock(true)
+	if err != nil {
+		t.Errorf("Stale lock should not prevent locking: %s", err)
+		return
+	}
+	_ = lock.Unlock()
+
+	err = r.RemoveLock(stale.ID)
+	if err != nil {
+		t.Errorf("Failed removing lock: %s", err)
+	}
+	locks, _ = r.Locks()
+	if len(locks) != 0 {
+		t.Errorf("Expected no locks, found %d", len(locks))
+	}
+}
+
+func TestRepositoryLockReload(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+	r2, err := OpenRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed opening repository: %s", err)
+		return
+	}
+
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+	err = r.Save()
+	if err != nil {
+		t.Errorf("Failed saving repository: %s", err)
+		return
+	}
+
+	// locking must pick up the volume added after r2 has been opened
+	lock, err := r2.Lock(true)
+	if err != nil {
+		t.Errorf("Failed acquiring lock: %s", err)
+		return
+	}
+	defer lock.Unlock()
+
+	if _, err := r2.FindVolume(vol.ID); err != nil {
+		t.Errorf("Expected volume %s after locking: %s", vol.ID, err)
+	}
+}
+
+func TestRepositoryMigrateLocked(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+	r.Version = 7
+	if err := r.Save(); err != nil {
+		t.Errorf("Failed saving repository: %s", err)
+		return
+	}
+
+	// an older client is still using the repository
+	shared, err := r.Lock(false)
+	if err != nil {
+		t.Errorf("Failed acquiring shared lock: %s", err)
+		return
+	}
+	unmigrated, err := OpenRepository(dir, testPassword)
+	if !errors.Is(err, ErrRepositoryLocked) {
+		t.Errorf("Expected %v, got %v", ErrRepositoryLocked, err)
+	}
+	// its locks can still be removed
+	locks, _ := unmigrated.Locks()
+	if len(locks) != 1 || locks[0].ID != shared.ID {
+		t.Errorf("Expected to find lock %s, got %+v", shared.ID, locks)
+	}
+	_ = shared.Unlock()
+
+	migrated, err := OpenRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed opening repository: %s", err)
+		return
+	}
+	if migrated.Version != RepositoryVersion {
+		t.Errorf("Expected repository to be migrated, got version %d", migrated.Version)
+	}
+	locks, _ = migrated.Locks()
+	if len(locks) != 0 {
+		t.Errorf("Expected the migration lock to be released, found %d", len(locks))
+	}
+}
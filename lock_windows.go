@@ -0,0 +1,23 @@
+// +build windows
+
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import "os"
+
+// processExists returns true if a process with the given PID is running.
+func processExists(pid int) bool {
+	// FindProcess fails on Windows if there's no such process
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	_ = p.Release()
+	return true
+}
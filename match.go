@@ -0,0 +1,52 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// foldCase is set on platforms whose file systems are usually case-insensitive,
+// so patterns get matched case-insensitively as well.
+var foldCase = runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+
+// splitPath splits a slash or OS separated path into its elements, ignoring
+// leading and trailing separators.
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(filepath.ToSlash(path), "/"), "/")
+}
+
+// matchElements matches path elements against pattern elements. A "**"
+// element matches any number of path elements, including none.
+func matchElements(pattern, path []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(path); i++ {
+				match, err := matchElements(pattern[1:], path[i:])
+				if err != nil || match {
+					return match, err
+				}
+			}
+			return false, nil
+		}
+		if len(path) == 0 {
+			return false, nil
+		}
+
+		match, err := filepath.Match(pattern[0], path[0])
+		if err != nil || !match {
+			return false, err
+		}
+		pattern = pattern[1:]
+		path = path[1:]
+	}
+
+	return len(path) == 0, nil
+}
@@ -0,0 +1,443 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	packIDLength = 32
+
+	// DefaultPackSize is the suggested size for pack files
+	DefaultPackSize = 16 * (1 << 20) // 16 MiB
+
+	// packs wasting at least this share of their size on unreferenced chunks
+	// get rewritten by ChunkIndex.Pack
+	repackThreshold = 0.2
+)
+
+// Error declarations.
+var (
+	ErrInvalidPackLocation = errors.New("chunk part exceeds its pack file")
+	ErrLoadPackFailed      = errors.New("unable to load pack from any storage backend")
+)
+
+// PackLocation describes where a part of a chunk is stored within a pack file.
+type PackLocation struct {
+	Pack   string `json:"pack"`
+	Offset uint64 `json:"offset"`
+	Length uint64 `json:"length"`
+}
+
+// BackendRangeLoader can be implemented by backends which are able to load a
+// range of a stored chunk, without reading it entirely.
+type BackendRangeLoader interface {
+	// LoadChunkRange loads length bytes at offset of a single Chunk
+	LoadChunkRange(shasum string, part, totalParts uint, offset, length uint64) ([]byte, error)
+}
+
+// openPack is a pack file being filled.
+type openPack struct {
+	id      string
+	backend int
+	data    []byte
+}
+
+// A packer bundles chunk parts into pack files of roughly the same size. Each
+// backend gets its own pack file being filled, so the parts of a chunk end up
+// on different backends, as they would without packing. It's safe to use a
+// packer concurrently.
+type packer struct {
+	mut     sync.Mutex
+	backend *BackendManager
+	size    uint64
+	open    map[int]*openPack
+	failed  map[string]error // packs which couldn't be stored
+}
+
+func newPacker(backend *BackendManager, size uint64) *packer {
+	return &packer{
+		backend: backend,
+		size:    size,
+		open:    make(map[int]*openPack),
+		failed:  make(map[string]error),
+	}
+}
+
+func newPackID() (string, error) {
+	b := make([]byte, packIDLength)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// add appends the parts of chunk to pack files and returns their locations
+// and the size of the largest part. Pack files get stored once they're full,
+// the remaining ones when calling flush.
+func (p *packer) add(chunk Chunk) ([]PackLocation, uint64, error) {
+	parts := *chunk.Data
+	// Use storage backends in a round robin fashion to store chunks
+	idxs := p.backend.nextBackends(len(parts))
+
+	var locs []PackLocation
+	var size uint64
+	for i, data := range parts {
+		loc, err := p.addPart(idxs[i], data)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		locs = append(locs, loc)
+		if loc.Length > size {
+			size = loc.Length
+		}
+	}
+
+	return locs, size, nil
+}
+
+// addPart appends data to the pack file being filled for the backend with
+// index idx.
+func (p *packer) addPart(idx int, data []byte) (PackLocation, error) {
+	p.mut.Lock()
+	pack, ok := p.open[idx]
+	if !ok {
+		id, err := newPackID()
+		if err != nil {
+			p.mut.Unlock()
+			return PackLocation{}, err
+		}
+		pack = &openPack{id: id, backend: idx}
+		p.open[idx] = pack
+	}
+
+	loc := PackLocation{
+		Pack:   pack.id,
+		Offset: uint64(len(pack.data)),
+		Length: uint64(len(data)),
+	}
+	pack.data = append(pack.data, data...)
+
+	full := uint64(len(pack.data)) >= p.size
+	if full {
+		delete(p.open, idx)
+	}
+	p.mut.Unlock()
+
+	if full {
+		return loc, p.store(pack)
+	}
+	return loc, nil
+}
+
+func (p *packer) store(pack *openPack) error {
+	_, err := p.backend.storeChunkPart(pack.backend, pack.id, 0, 1, pack.data)
+	if err != nil {
+		p.mut.Lock()
+		p.failed[pack.id] = err
+		p.mut.Unlock()
+	}
+
+	return err
+}
+
+// flush stores all pack files which aren't full yet.
+func (p *packer) flush() error {
+	p.mut.Lock()
+	var packs []*openPack
+	for idx, pack := range p.open {
+		packs = append(packs, pack)
+		delete(p.open, idx)
+	}
+	p.mut.Unlock()
+
+	var err error
+	for _, pack := range packs {
+		if perr := p.store(pack); perr != nil && err == nil {
+			err = perr
+		}
+	}
+
+	return err
+}
+
+// failure returns the error which occurred while storing any of the pack
+// files the parts of chunk have been added to.
+func (p *packer) failure(chunk Chunk) error {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	for _, loc := range chunk.Parts {
+		if err, ok := p.failed[loc.Pack]; ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasFailed returns true if any pack file couldn't be stored.
+func (p *packer) hasFailed() bool {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	return len(p.failed) > 0
+}
+
+// loadPackedPart loads a chunk part from its pack file.
+func (backend *BackendManager) loadPackedPart(loc PackLocation) ([]byte, error) {
+	for _, be := range backend.Backends {
+		for i := 0; i < retries; i++ {
+			b, err := loadPackRange(*be, loc)
+			if err == nil {
+				return b, nil
+			}
+		}
+	}
+
+	return []byte{}, ErrLoadChunkFailed
+}
+
+// loadPackRange loads a range of a pack file from be. Backends without
+// support for ranged reads have to load the entire pack file.
+func loadPackRange(be Backend, loc PackLocation) ([]byte, error) {
+	var b []byte
+	var err error
+	if rl, ok := be.(BackendRangeLoader); ok {
+		b, err = rl.LoadChunkRange(loc.Pack, 0, 1, loc.Offset, loc.Length)
+		if err != nil {
+			return nil, err
+		}
+		if uint64(len(b)) != loc.Length {
+			return nil, ErrInvalidPackLocation
+		}
+		return b, nil
+	}
+
+	b, err = be.LoadChunk(loc.Pack, 0, 1)
+	if err != nil {
+		return nil, err
+	}
+	return sliceRange(b, loc.Offset, loc.Length)
+}
+
+// sliceRange returns length bytes at offset of b.
+func sliceRange(b []byte, offset, length uint64) ([]byte, error) {
+	if offset+length > uint64(len(b)) {
+		return nil, ErrInvalidPackLocation
+	}
+	return b[offset : offset+length], nil
+}
+
+// loadPack loads an entire pack file and returns it alongside the index of
+// the backend it's stored on.
+func (backend *BackendManager) loadPack(id string) ([]byte, int, error) {
+	for idx, be := range backend.Backends {
+		for i := 0; i < retries; i++ {
+			b, err := (*be).LoadChunk(id, 0, 1)
+			if err == nil {
+				return b, idx, nil
+			}
+		}
+	}
+
+	return nil, 0, ErrLoadPackFailed
+}
+
+// packUsage tracks how much of a pack file is still referenced.
+type packUsage struct {
+	live uint64
+	dead uint64
+}
+
+// repack deletes pack files without any referenced chunks and rewrites the
+// ones wasting too much space on unreferenced chunks. Snapshots get updated to
+// point to the new pack files.
+func (index *ChunkIndex) repack(repository *Repository, packs map[string]*packUsage) (freedSize uint64, err error) {
+	var deleted []string
+	var rewrite []string
+	for id, usage := range packs {
+		switch {
+		case usage.live == 0:
+			fmt.Printf("Pack %s is no longer referenced by any snapshot. Deleting!\n", id)
+			deleted = append(deleted, id)
+		case float64(usage.dead)/float64(usage.live+usage.dead) >= repackThreshold:
+			fmt.Printf("Pack %s contains %s of unreferenced data. Repacking!\n", id, SizeToString(usage.dead))
+			rewrite = append(rewrite, id)
+		default:
+			continue
+		}
+		freedSize += usage.dead
+	}
+
+	if len(rewrite) > 0 {
+		moved, err := index.rewritePacks(repository, rewrite)
+		if err != nil {
+			return 0, err
+		}
+		if err := updateSnapshotParts(repository, moved); err != nil {
+			return 0, err
+		}
+		for hash, parts := range moved {
+			index.Chunks[hash].Parts = parts
+		}
+		deleted = append(deleted, rewrite...)
+	}
+	if len(deleted) == 0 {
+		return 0, nil
+	}
+	index.dropPacks(deleted)
+
+	// nothing may reference the old pack files when they get deleted
+	if err := index.Save(repository); err != nil {
+		return 0, err
+	}
+	for _, id := range deleted {
+		if err := repository.backend.DeleteChunk(id, 0, 1); err != nil {
+			return freedSize, err
+		}
+	}
+
+	return freedSize, nil
+}
+
+// rewritePacks copies all referenced chunk parts of the given pack files to
+// new ones on the same backends and returns the new locations of the affected
+// chunks.
+func (index *ChunkIndex) rewritePacks(repository *Repository, ids []string) (map[string][]PackLocation, error) {
+	rewrite := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		rewrite[id] = true
+	}
+
+	moved := make(map[string][]PackLocation)
+	for _, chunk := range index.Chunks {
+		if len(chunk.Snapshots) == 0 {
+			// unreferenced chunks get dropped along with the old pack files
+			continue
+		}
+		for _, loc := range chunk.Parts {
+			if rewrite[loc.Pack] {
+				moved[chunk.Hash] = append([]PackLocation{}, chunk.Parts...)
+				break
+			}
+		}
+	}
+
+	size := repository.PackSize
+	if size == 0 {
+		// packing got disabled in the meantime
+		size = DefaultPackSize
+	}
+	p := newPacker(&repository.backend, size)
+	for _, id := range ids {
+		b, idx, err := repository.backend.loadPack(id)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, parts := range moved {
+			for i, loc := range parts {
+				if loc.Pack != id {
+					continue
+				}
+
+				data, err := sliceRange(b, loc.Offset, loc.Length)
+				if err != nil {
+					return nil, err
+				}
+				parts[i], err = p.addPart(idx, data)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return moved, p.flush()
+}
+
+// dropPacks forgets the locations of the unreferenced chunk parts stored in
+// the given pack files. Chunks get removed from the index once none of their
+// parts is stored anymore.
+func (index *ChunkIndex) dropPacks(ids []string) {
+	gone := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		gone[id] = true
+	}
+
+	for hash, chunk := range index.Chunks {
+		if len(chunk.Parts) == 0 {
+			continue
+		}
+
+		stored := false
+		parts := make([]PackLocation, len(chunk.Parts))
+		for i, loc := range chunk.Parts {
+			if !gone[loc.Pack] {
+				parts[i] = loc
+				stored = stored || loc.Pack != ""
+			}
+		}
+		if !stored {
+			delete(index.Chunks, hash)
+			continue
+		}
+		chunk.Parts = parts
+	}
+	index.contents = nil
+}
+
+// updateSnapshotParts points the chunks of all snapshots to their new
+// locations.
+func updateSnapshotParts(repository *Repository, moved map[string][]PackLocation) error {
+	for _, volume := range repository.Volumes {
+		for _, id := range volume.Snapshots {
+			snapshot, err := volume.LoadSnapshot(id, repository)
+			if err != nil {
+				return err
+			}
+
+			changed := false
+			for _, arc := range snapshot.Archives {
+				for i, chunk := range arc.Chunks {
+					if parts, ok := moved[chunk.Hash]; ok {
+						arc.Chunks[i].Parts = parts
+						changed = true
+					}
+				}
+			}
+
+			if changed {
+				if err := snapshot.Save(repository); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// removeFailedPacks drops all chunks stored in any of the pack files a packer
+// failed to store.
+func (index *ChunkIndex) removeFailedPacks(p *packer) {
+	for hash, chunk := range index.Chunks {
+		if p.failure(Chunk{Parts: chunk.Parts}) != nil {
+			delete(index.Chunks, hash)
+		}
+	}
+	index.contents = nil
+}
@@ -0,0 +1,409 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func storePackedSnapshot(t *testing.T, r *Repository, vol *Volume, index *ChunkIndex, paths []string) *Snapshot {
+	return storeSnapshot(t, r, vol, index, StoreOptions{
+		Paths:    paths,
+		Compress: CompressionNone,
+		Encrypt:  EncryptionAES,
+	})
+}
+
+// storeSnapshot stores a new snapshot of vol with opts, relative to the
+// working dir.
+func storeSnapshot(t *testing.T, r *Repository, vol *Volume, index *ChunkIndex, opts StoreOptions) *Snapshot {
+	wd, _ := os.Getwd()
+	snapshot, _ := NewSnapshot("test_snapshot")
+	opts.CWD = wd
+
+	for p := range snapshot.Add(*r, index, opts) {
+		if p.Error != nil {
+			t.Errorf("Failed adding to snapshot: %s", p.Error)
+		}
+	}
+	_ = snapshot.Save(r)
+	_ = vol.AddSnapshot(snapshot.ID)
+	_ = index.Save(r)
+	_ = r.Save()
+
+	return snapshot
+}
+
+func verifyRestore(t *testing.T, r *Repository, id string, paths []string) {
+	_, snapshot, err := r.FindSnapshot(id)
+	if err != nil {
+		t.Errorf("Failed finding snapshot: %s", err)
+		return
+	}
+
+	targetdir, err := ioutil.TempDir("", "knoxite.target")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for restore: %s", err)
+		return
+	}
+	defer os.RemoveAll(targetdir)
+
+	progress, err := DecodeSnapshot(*r, snapshot, targetdir, RestoreOptions{})
+	if err != nil {
+		t.Errorf("Failed restoring snapshot: %s", err)
+		return
+	}
+	for p := range progress {
+		if p.Error != nil {
+			t.Errorf("Failed restoring snapshot: %s", p.Error)
+		}
+	}
+
+	for _, path := range paths {
+		hash1, err := hashFile(filepath.Join(targetdir, path))
+		if err != nil {
+			t.Errorf("Failed generating shasum for %s: %s", path, err)
+			return
+		}
+		hash2, err := hashFile(path)
+		if err != nil {
+			t.Errorf("Failed generating shasum for %s: %s", path, err)
+			return
+		}
+		if hash1 != hash2 {
+			t.Errorf("Failed verifying shasum of %s: %s != %s", path, hash1, hash2)
+		}
+	}
+}
+
+func TestPackedSnapshot(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository(dir, testPassword)
+	r.PackSize = 16 * 1024
+	index, _ := OpenChunkIndex(&r)
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+
+	paths := []string{"chunk.go", "chunkindex.go", "pack.go", "snapshot.go", "snapshot_test.go"}
+	snapshot := storePackedSnapshot(t, &r, vol, &index, paths)
+
+	chunks := 0
+	for _, arc := range snapshot.Archives {
+		for _, chunk := range arc.Chunks {
+			chunks++
+			if len(chunk.Parts) != 1 {
+				t.Errorf("Expected chunk %s to be packed, got %+v", chunk.Hash, chunk.Parts)
+			}
+			if item := index.Chunks[chunk.Hash]; item == nil || len(item.Parts) != 1 {
+				t.Errorf("Expected pack location of chunk %s in the chunk-index", chunk.Hash)
+			}
+		}
+	}
+	if packs := len(storedChunkNames(dir)); packs == 0 || packs >= chunks {
+		t.Errorf("Expected %d chunks to be bundled into fewer pack files, got %d", chunks, packs)
+	}
+
+	r, err = OpenRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed opening repository: %s", err)
+		return
+	}
+	if r.PackSize != 16*1024 {
+		t.Errorf("Expected pack size to be stored, got %d", r.PackSize)
+	}
+	verifyRestore(t, &r, snapshot.ID, paths)
+}
+
+func TestChunkIndexRepack(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository(dir, testPassword)
+	r.PackSize = DefaultPackSize
+	index, _ := OpenChunkIndex(&r)
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+
+	// both files end up in the same pack file, the second snapshot only
+	// references one of them
+	first := storePackedSnapshot(t, &r, vol, &index, []string{"chunk.go", "pack.go"})
+	second := storePackedSnapshot(t, &r, vol, &index, []string{"pack.go"})
+	packs := storedChunkNames(dir)
+	if len(packs) != 1 {
+		t.Errorf("Expected a single pack file, got %d", len(packs))
+		return
+	}
+
+	// nothing to free yet
+	freed, err := index.Pack(&r)
+	if err != nil || freed != 0 {
+		t.Errorf("Expected nothing to be freed, got %d bytes: %v", freed, err)
+	}
+
+	_ = vol.RemoveSnapshot(first.ID)
+	index.RemoveSnapshot(first.ID)
+	freed, err = index.Pack(&r)
+	if err != nil {
+		t.Errorf("Packing chunk index failed: %s", err)
+		return
+	}
+	if freed != uint64(first.Archives["chunk.go"].Chunks[0].Size) {
+		t.Errorf("Expected %d bytes to be freed, got %d", first.Archives["chunk.go"].Chunks[0].Size, freed)
+	}
+
+	repacked := storedChunkNames(dir)
+	if len(repacked) != 1 || repacked[0] == packs[0] {
+		t.Errorf("Expected the pack file to be rewritten, got %v", repacked)
+	}
+	for _, chunk := range index.Chunks {
+		if chunk.Parts[0].Pack+".0_1" != repacked[0] {
+			t.Errorf("Expected chunk %s to be moved to the new pack file", chunk.Hash)
+		}
+	}
+
+	// the remaining snapshot points to the new pack file
+	verifyRestore(t, &r, second.ID, []string{"pack.go"})
+
+	// once all snapshots are gone, the pack file gets deleted
+	_ = vol.RemoveSnapshot(second.ID)
+	index.RemoveSnapshot(second.ID)
+	_, err = index.Pack(&r)
+	if err != nil {
+		t.Errorf("Packing chunk index failed: %s", err)
+		return
+	}
+	if names := storedChunkNames(dir); len(names) != 0 {
+		t.Errorf("Expected all pack files to be deleted, got %v", names)
+	}
+}
+
+func TestChunkIndexRepackGradually(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	sourcedir, err := ioutil.TempDir("", "knoxite.source")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for source: %s", err)
+		return
+	}
+	defer os.RemoveAll(sourcedir)
+
+	// ten files of the same size, each making up a tenth of the pack file
+	var files []string
+	for i := 0; i < 10; i++ {
+		b := make([]byte, 4096)
+		_, _ = rand.Read(b)
+		name := fmt.Sprintf("file%d", i)
+		_ = ioutil.WriteFile(filepath.Join(sourcedir, name), b, 0644)
+		files = append(files, name)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Failed getting working dir: %s", err)
+		return
+	}
+	err = os.Chdir(sourcedir)
+	if err != nil {
+		t.Errorf("Failed changing working dir: %s", err)
+		return
+	}
+	defer func() {
+		_ = os.Chdir(wd)
+	}()
+
+	r, _ := NewRepository(dir, testPassword)
+	r.PackSize = DefaultPackSize
+	index, _ := OpenChunkIndex(&r)
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+
+	// every snapshot references one file less than the previous one
+	var snapshots []*Snapshot
+	for i := 0; i < 3; i++ {
+		snapshots = append(snapshots, storePackedSnapshot(t, &r, vol, &index, files[i:]))
+	}
+	packs := storedChunkNames(dir)
+	if len(packs) != 1 {
+		t.Errorf("Expected a single pack file, got %d", len(packs))
+		return
+	}
+
+	// a tenth of the pack file isn't worth rewriting it
+	_ = vol.RemoveSnapshot(snapshots[0].ID)
+	index.RemoveSnapshot(snapshots[0].ID)
+	freed, err := index.Pack(&r)
+	if err != nil || freed != 0 {
+		t.Errorf("Expected nothing to be freed, got %d bytes: %v", freed, err)
+	}
+	if names := storedChunkNames(dir); len(names) != 1 || names[0] != packs[0] {
+		t.Errorf("Expected the pack file to be kept, got %v", names)
+	}
+
+	// together with the space wasted before, it is
+	_ = vol.RemoveSnapshot(snapshots[1].ID)
+	index.RemoveSnapshot(snapshots[1].ID)
+	freed, err = index.Pack(&r)
+	if err != nil {
+		t.Errorf("Packing chunk index failed: %s", err)
+		return
+	}
+	dead := snapshots[0].Archives[files[0]].Chunks[0].Size + snapshots[1].Archives[files[1]].Chunks[0].Size
+	if freed != uint64(dead) {
+		t.Errorf("Expected %d bytes to be freed, got %d", dead, freed)
+	}
+	if names := storedChunkNames(dir); len(names) != 1 || names[0] == packs[0] {
+		t.Errorf("Expected the pack file to be rewritten, got %v", names)
+	}
+	if len(index.Chunks) != len(files)-2 {
+		t.Errorf("Expected %d chunks in the chunk-index, got %d", len(files)-2, len(index.Chunks))
+	}
+
+	verifyRestore(t, &r, snapshots[2].ID, files[2:])
+}
+
+func TestPackerDistinctBackends(t *testing.T) {
+	backend := BackendManager{}
+	var dirs []string
+	for i := 0; i < 3; i++ {
+		dir, err := ioutil.TempDir("", "knoxite")
+		if err != nil {
+			t.Errorf("Failed creating temporary dir for backend: %s", err)
+			return
+		}
+		defer os.RemoveAll(dir)
+
+		be, err := BackendFromURL(dir)
+		if err != nil {
+			t.Errorf("Failed creating backend: %s", err)
+			return
+		}
+		backend.AddBackend(&be)
+		dirs = append(dirs, dir)
+	}
+	p := newPacker(&backend, DefaultPackSize)
+
+	// add the three parts of many chunks at the same time
+	chunks := 300
+	locs := make([][]PackLocation, chunks)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < chunks; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			data := [][]byte{{byte(i), 0}, {byte(i), 1}, {byte(i), 2}}
+			var err error
+			locs[i], _, err = p.add(Chunk{Data: &data})
+			if err != nil {
+				t.Errorf("Failed adding chunk to pack: %s", err)
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	if err := p.flush(); err != nil {
+		t.Errorf("Failed storing pack files: %s", err)
+		return
+	}
+
+	packBackends := make(map[string]string)
+	for _, dir := range dirs {
+		for _, name := range storedChunkNames(dir) {
+			packBackends[strings.TrimSuffix(name, ".0_1")] = dir
+		}
+	}
+	for i, l := range locs {
+		used := make(map[string]bool)
+		for _, loc := range l {
+			dir := packBackends[loc.Pack]
+			if used[dir] {
+				t.Errorf("Expected the parts of chunk %d to be packed on different backends, got %+v", i, l)
+				break
+			}
+			used[dir] = true
+		}
+	}
+}
+
+func TestPackedChunkRevived(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository(dir, testPassword)
+	r.PackSize = DefaultPackSize
+	index, _ := OpenChunkIndex(&r)
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+
+	first := storePackedSnapshot(t, &r, vol, &index, []string{"chunk.go", "pack.go"})
+	storePackedSnapshot(t, &r, vol, &index, []string{"pack.go"})
+	_ = vol.RemoveSnapshot(first.ID)
+	index.RemoveSnapshot(first.ID)
+
+	// the unreferenced chunk is still stored in its pack file
+	hash := first.Archives["chunk.go"].Chunks[0].Hash
+	third := storePackedSnapshot(t, &r, vol, &index, []string{"chunk.go"})
+	if names := storedChunkNames(dir); len(names) != 1 {
+		t.Errorf("Expected the unreferenced chunk to be re-used, got pack files %v", names)
+	}
+	if c := index.Chunks[hash]; len(c.Snapshots) != 1 || c.Snapshots[0] != third.ID {
+		t.Errorf("Expected chunk %s to be referenced by snapshot %s, got %v", hash, third.ID, c.Snapshots)
+	}
+
+	// once a part of it is gone, it gets stored in a new pack file
+	_ = vol.RemoveSnapshot(third.ID)
+	index.RemoveSnapshot(third.ID)
+	index.Chunks[hash].Parts[0] = PackLocation{}
+	index.contents = nil
+	fourth := storePackedSnapshot(t, &r, vol, &index, []string{"chunk.go"})
+	if names := storedChunkNames(dir); len(names) != 2 {
+		t.Errorf("Expected the chunk to be stored in a new pack file, got %v", names)
+	}
+	if c := index.Chunks[hash]; c.Parts[0].Pack == "" || len(c.Snapshots) != 1 {
+		t.Errorf("Expected chunk %s to point to its new pack file, got %+v", hash, c)
+	}
+
+	if report := checkRepository(t, r, CheckOptions{ReadData: true}); !report.OK() {
+		t.Errorf("Expected an intact repository, got %+v", report)
+	}
+	verifyRestore(t, &r, fourth.ID, []string{"chunk.go"})
+}
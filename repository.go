@@ -8,8 +8,10 @@
 package knoxite
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 )
 
@@ -21,14 +23,38 @@ type Repository struct {
 	Key     string    `json:"key"` // key for encrypting data stored with knoxite
 	// Owner   string    `json:"owner"`
 
-	backend  BackendManager
-	password string // password for knoxite repository file
+	KeyGeneration uint            `json:"key_generation"`     // generation of Key, increased by every key rotation
+	OldKeys       map[uint]string `json:"old_keys,omitempty"` // retired keys, needed until all chunks got re-encrypted
+
+	Chunker  ChunkerParams `json:"chunker"`             // how files get split into chunks
+	HashKey  string        `json:"hash_key,omitempty"`  // key for content hashes, so chunk names don't reveal their content
+	PackSize uint64        `json:"pack_size,omitempty"` // size of the pack files chunks get bundled into, 0 stores each chunk part on its own
+
+	backend   BackendManager
+	password  string    // password for knoxite repository file
+	masterKey string    // key for encrypting the repository file
+	keySlots  []KeySlot // key slots granting access to masterKey
+	keySlot   string    // ID of the key slot the repository has been opened with
+
+	legacyMetadata bool // accept unauthenticated metadata, only while migrating
+}
+
+// RepositoryHeader is stored in plain text in front of the encrypted
+// repository data. It holds everything needed to get the key for the
+// repository file from a password.
+type RepositoryHeader struct {
+	Version  uint       `json:"version"`
+	KeySlots []KeySlot  `json:"keyslots,omitempty"`
+	KDF      *KDFParams `json:"kdf,omitempty"` // only used by version 5
 }
 
 // Const declarations.
 const (
-	RepositoryVersion   = 4
+	RepositoryVersion   = 8
 	repositoryKeyLength = 32
+
+	// RepositoryHeaderPrefix marks repository files starting with a RepositoryHeader.
+	RepositoryHeaderPrefix = "knoxiterepo+"
 )
 
 // Error declarations.
@@ -38,6 +64,9 @@ var (
 	ErrVolumeNotFound          = errors.New("volume not found")
 	ErrSnapshotNotFound        = errors.New("snapshot not found")
 	ErrGenerateRandomKeyFailed = errors.New("failed to generate a random encryption key for new repository")
+	ErrInvalidRepositoryHeader = errors.New("invalid repository header")
+	ErrKeyGenerationUnknown    = errors.New("no data key for this key generation")
+	ErrHashKeyMissing          = errors.New("chunk has a keyed hash, but the repository has no hash key")
 )
 
 // NewRepository returns a new repository.
@@ -48,10 +77,21 @@ func NewRepository(path, password string) (Repository, error) {
 		return Repository{}, ErrGenerateRandomKeyFailed
 	}
 
+	chunker, err := DefaultChunkerParams()
+	if err != nil {
+		return Repository{}, err
+	}
+
 	repository := Repository{
 		Version:  RepositoryVersion,
 		password: password,
 		Key:      key,
+		Chunker:  chunker,
+		HashKey:  deriveHashKey(key),
+	}
+	err = repository.initKeySlots()
+	if err != nil {
+		return repository, err
 	}
 
 	backend, err := BackendFromURL(path)
@@ -77,6 +117,8 @@ func generateRandomKey(length int) (string, error) {
 }
 
 // OpenRepository opens an existing repository and migrates it if possible.
+// Migrating requires an exclusive lock: if someone else holds a lock, the
+// repository gets returned unmigrated along with ErrRepositoryLocked.
 func OpenRepository(path, password string) (Repository, error) {
 	repository := Repository{
 		password: password,
@@ -91,33 +133,212 @@ func OpenRepository(path, password string) (Repository, error) {
 		return repository, err
 	}
 
-	pipe, err := NewDecodingPipeline(CompressionNone, EncryptionAES, password)
+	err = repository.decode(b)
 	if err != nil {
 		return repository, err
 	}
-	err = pipe.Decode(b, &repository)
-	if err != nil {
-		return repository, ErrOpenRepositoryFailed
-	}
-	if repository.Version < RepositoryVersion {
-		// migrate to current version
-		err = repository.Migrate()
+
+	for _, url := range repository.Paths {
+		backend, err := BackendFromURL(url)
 		if err != nil {
 			return repository, err
 		}
+		repository.backend.AddBackend(&backend)
 	}
 
-	for _, url := range repository.Paths {
-		backend, err := BackendFromURL(url)
+	if repository.Version < RepositoryVersion {
+		// migrating rewrites the repository's metadata, so nobody else may
+		// use the repository meanwhile
+		var lock *Lock
+		lock, err = repository.Lock(true)
 		if err != nil {
 			return repository, err
 		}
-		repository.backend.AddBackend(&backend)
+		// unless someone else migrated it before we got the lock
+		if repository.Version < RepositoryVersion {
+			err = repository.Migrate()
+		}
+		if uerr := lock.Unlock(); err == nil {
+			err = uerr
+		}
 	}
 
 	return repository, err
 }
 
+// decode decrypts the repository data b. The key for the repository file gets
+// derived from the password, unless the master key is known already.
+func (r *Repository) decode(b []byte) error {
+	header, b, err := parseRepositoryHeader(b)
+	if err != nil {
+		return err
+	}
+
+	key := r.password
+	switch {
+	case header == nil:
+		// repositories before version 5 don't have a header and use the
+		// password as key directly. Their metadata isn't authenticated
+	case header.KDF != nil:
+		// version 5 repositories derive the key from the password
+		key, err = header.KDF.DeriveKey(r.password)
+		if err != nil {
+			return err
+		}
+	default:
+		r.keySlots = header.KeySlots
+		if r.masterKey == "" {
+			r.masterKey, err = r.unlock(r.password)
+			if err != nil {
+				return err
+			}
+		}
+		key = r.masterKey
+	}
+
+	if header == nil {
+		err = decodeLegacyMetadata(CompressionNone, key, b, r)
+	} else {
+		var pipe Pipeline
+		pipe, err = NewDecodingPipeline(CompressionNone, metadataEncryption, key)
+		if err != nil {
+			return err
+		}
+		err = pipe.Decode(b, r)
+	}
+	if err != nil {
+		return ErrOpenRepositoryFailed
+	}
+	if header == nil {
+		if r.Version >= 5 {
+			// a header got stripped to sneak in unauthenticated metadata
+			return ErrOpenRepositoryFailed
+		}
+		// until migrating seals it
+		r.legacyMetadata = true
+	}
+	// repositories created before the chunker became configurable keep
+	// chunking files the way they always did
+	r.Chunker = r.Chunker.withDefaults()
+
+	return nil
+}
+
+// parseRepositoryHeader splits the plain text header from the encrypted
+// repository data. It returns a nil header for repositories without one.
+func parseRepositoryHeader(b []byte) (*RepositoryHeader, []byte, error) {
+	if !bytes.HasPrefix(b, []byte(RepositoryHeaderPrefix)) {
+		return nil, b, nil
+	}
+	b = b[len(RepositoryHeaderPrefix):]
+
+	n := bytes.IndexByte(b, '\n')
+	if n < 0 {
+		return nil, b, ErrInvalidRepositoryHeader
+	}
+
+	var header RepositoryHeader
+	if err := json.Unmarshal(b[:n], &header); err != nil {
+		return nil, b, ErrInvalidRepositoryHeader
+	}
+
+	return &header, b[n+1:], nil
+}
+
+// unlock tries password on every key slot and returns the master key.
+func (r *Repository) unlock(password string) (string, error) {
+	for _, slot := range r.keySlots {
+		key, err := slot.open(password)
+		if err == nil {
+			r.keySlot = slot.ID
+			return key, nil
+		}
+		if err != ErrDataTampered {
+			return "", err
+		}
+	}
+
+	return "", ErrOpenRepositoryFailed
+}
+
+// initKeySlots generates a new master key with a single key slot for the
+// repository's password.
+func (r *Repository) initKeySlots() error {
+	var err error
+	r.masterKey, err = generateRandomKey(repositoryKeyLength)
+	if err != nil {
+		return ErrGenerateRandomKeyFailed
+	}
+
+	slot, err := newKeySlot(r.masterKey, r.password, "default")
+	if err != nil {
+		return err
+	}
+	r.keySlots = []KeySlot{slot}
+	r.keySlot = slot.ID
+
+	return nil
+}
+
+// reload re-reads the repository's metadata from storage, picking up changes
+// made since it has been opened.
+func (r *Repository) reload() error {
+	b, err := r.backend.LoadRepository()
+	if err != nil {
+		return err
+	}
+
+	repository := Repository{
+		password:  r.password,
+		masterKey: r.masterKey,
+		keySlot:   r.keySlot,
+	}
+	err = repository.decode(b)
+	if err != nil {
+		return err
+	}
+
+	if !stringsEqual(repository.Paths, r.backend.Locations()) {
+		// storage backends got added in the meantime
+		r.backend = BackendManager{}
+		for _, url := range repository.Paths {
+			backend, err := BackendFromURL(url)
+			if err != nil {
+				return err
+			}
+			r.backend.AddBackend(&backend)
+		}
+	}
+
+	r.Version = repository.Version
+	r.Volumes = repository.Volumes
+	r.Paths = repository.Paths
+	r.Key = repository.Key
+	r.KeyGeneration = repository.KeyGeneration
+	r.OldKeys = repository.OldKeys
+	r.Chunker = repository.Chunker
+	r.HashKey = repository.HashKey
+	r.PackSize = repository.PackSize
+	r.keySlots = repository.keySlots
+	r.keySlot = repository.keySlot
+	r.masterKey = repository.masterKey
+	r.legacyMetadata = repository.legacyMetadata
+
+	return nil
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // AddVolume adds a volume to a repository.
 func (r *Repository) AddVolume(volume *Volume) error {
 	r.Volumes = append(r.Volumes, volume)
@@ -135,7 +356,8 @@ func (r *Repository) RemoveVolume(volume *Volume) error {
 	return ErrVolumeNotFound
 }
 
-// FindVolume finds a volume within a repository.
+// FindVolume finds a volume within a repository by its ID or name. The
+// volume added last can be referred to as "latest".
 func (r *Repository) FindVolume(id string) (*Volume, error) {
 	if id == "latest" && len(r.Volumes) > 0 {
 		return r.Volumes[len(r.Volumes)-1], nil
@@ -146,53 +368,134 @@ func (r *Repository) FindVolume(id string) (*Volume, error) {
 			return volume, nil
 		}
 	}
+	for _, volume := range r.Volumes {
+		if volume.Name == id {
+			return volume, nil
+		}
+	}
 
 	return &Volume{}, ErrVolumeNotFound
 }
 
-// FindSnapshot finds a snapshot within a repository.
+// FindSnapshot finds a snapshot within a repository. Besides snapshot IDs,
+// it accepts all references understood by ResolveSnapshot.
 func (r *Repository) FindSnapshot(id string) (*Volume, *Snapshot, error) {
-	if id == "latest" {
-		latestVolume := &Volume{}
-		latestSnapshot := &Snapshot{}
-		found := false
-		for _, volume := range r.Volumes {
-			for _, snapshotID := range volume.Snapshots {
-				snapshot, err := volume.LoadSnapshot(snapshotID, r)
-				if err == nil {
-					if !found || snapshot.Date.Sub(latestSnapshot.Date) > 0 {
-						latestSnapshot = snapshot
-						latestVolume = volume
-						found = true
-					}
-				}
-			}
+	return r.ResolveSnapshot(id, SnapshotFilter{})
+}
+
+// FindLatestSnapshot finds the most recent snapshot within a repository
+// matching filter.
+func (r *Repository) FindLatestSnapshot(filter SnapshotFilter) (*Volume, *Snapshot, error) {
+	return r.ResolveSnapshot("latest", filter)
+}
+
+// IsEmpty returns true if there a no snapshots stored in a repository.
+func (r *Repository) IsEmpty() bool {
+	for _, volume := range r.Volumes {
+		if len(volume.Snapshots) > 0 {
+			return false
 		}
+	}
 
-		if found {
-			return latestVolume, latestSnapshot, nil
+	return true
+}
+
+// DataKey returns the data key of a specific key generation.
+func (r *Repository) DataKey(generation uint) (string, error) {
+	if generation == r.KeyGeneration {
+		return r.Key, nil
+	}
+	if key, ok := r.OldKeys[generation]; ok {
+		return key, nil
+	}
+
+	return "", ErrKeyGenerationUnknown
+}
+
+// contentHashKey returns the key content hashes are keyed with, or nil for
+// repositories without one.
+func (r *Repository) contentHashKey() ([]byte, error) {
+	if r.HashKey == "" {
+		return nil, nil
+	}
+
+	return base64.URLEncoding.DecodeString(r.HashKey)
+}
+
+// decodeMetadata decodes snapshot or chunk-index data. Metadata that hasn't
+// been re-encrypted yet after a key rotation gets decoded with a retired key.
+func (r *Repository) decodeMetadata(b []byte, data interface{}) error {
+	if r.legacyMetadata {
+		// older versions had no key rotation
+		return decodeLegacyMetadata(CompressionLZMA, r.Key, b, data)
+	}
+
+	keys := []string{r.Key}
+	for gen := int(r.KeyGeneration) - 1; gen >= 0; gen-- {
+		if key, ok := r.OldKeys[uint(gen)]; ok {
+			keys = append(keys, key)
 		}
-	} else {
-		for _, volume := range r.Volumes {
+	}
+
+	var err error
+	for _, key := range keys {
+		var pipe Pipeline
+		pipe, err = NewDecodingPipeline(CompressionLZMA, metadataEncryption, key)
+		if err != nil {
+			return err
+		}
+		err = pipe.Decode(b, data)
+		if err != ErrDataTampered {
+			return err
+		}
+	}
+
+	return err
+}
+
+// sealMetadata re-encodes all snapshots and the chunk-index with
+// authenticated encryption.
+func (r *Repository) sealMetadata() error {
+	for _, volume := range r.Volumes {
+		for _, id := range volume.Snapshots {
 			snapshot, err := volume.LoadSnapshot(id, r)
-			if err == nil {
-				return volume, snapshot, err
+			if err != nil {
+				return err
+			}
+			if err := snapshot.Save(r); err != nil {
+				return err
 			}
 		}
 	}
 
-	return &Volume{}, &Snapshot{}, ErrSnapshotNotFound
+	b, err := r.backend.LoadChunkIndex()
+	if err != nil {
+		// a missing chunk-index gets rebuilt from the snapshots
+		return nil
+	}
+	var index ChunkIndex
+	if err := r.decodeMetadata(b, &index); err != nil {
+		return err
+	}
+	return index.Save(r)
 }
 
-// IsEmpty returns true if there a no snapshots stored in a repository.
-func (r *Repository) IsEmpty() bool {
+// fillSnapshotDates adds the missing dates of snapshots to their volumes.
+// Snapshots which can't be loaded are skipped.
+func (r *Repository) fillSnapshotDates() {
 	for _, volume := range r.Volumes {
-		if len(volume.Snapshots) > 0 {
-			return false
+		for _, id := range volume.Snapshots {
+			if _, ok := volume.Dates[id]; ok {
+				continue
+			}
+
+			snapshot, err := volume.LoadSnapshot(id, r)
+			if err != nil {
+				continue
+			}
+			volume.setSnapshotDate(id, snapshot.Date)
 		}
 	}
-
-	return true
 }
 
 // BackendManager returns the repository's BackendManager.
@@ -214,7 +517,15 @@ func (r *Repository) init() error {
 func (r *Repository) Save() error {
 	r.Paths = r.backend.Locations()
 
-	pipe, err := NewEncodingPipeline(CompressionNone, EncryptionAES, r.password)
+	header, err := json.Marshal(RepositoryHeader{
+		Version:  r.Version,
+		KeySlots: r.keySlots,
+	})
+	if err != nil {
+		return err
+	}
+
+	pipe, err := NewEncodingPipeline(CompressionNone, metadataEncryption, r.masterKey)
 	if err != nil {
 		return err
 	}
@@ -222,32 +533,94 @@ func (r *Repository) Save() error {
 	if err != nil {
 		return err
 	}
-	return r.backend.SaveRepository(b)
+
+	var buf bytes.Buffer
+	buf.WriteString(RepositoryHeaderPrefix)
+	buf.Write(header)
+	buf.WriteByte('\n')
+	buf.Write(b)
+
+	return r.backend.SaveRepository(buf.Bytes())
 }
 
-// Changes password of repository.
+// Changes password of the key slot the repository has been opened with.
 func (r *Repository) ChangePassword(newPassword string) error {
-	r.password = newPassword
+	for i, slot := range r.keySlots {
+		if slot.ID != r.keySlot {
+			continue
+		}
 
-	return r.Save()
+		s, err := newKeySlot(r.masterKey, newPassword, slot.Description)
+		if err != nil {
+			return err
+		}
+		s.ID = slot.ID
+		r.keySlots[i] = s
+		r.password = newPassword
+
+		return r.Save()
+	}
+
+	return ErrKeySlotNotFound
 }
 
 // Migrates a repository to the current version, if possible.
 func (r *Repository) Migrate() error {
-	switch v := r.Version; {
-	case v < 3:
+	if r.Version < 3 {
 		return ErrRepositoryIncompatible
-	case v == 3:
+	}
+
+	if r.Version == 3 {
 		// since the introduction of the repo passwd command there are two keys:
 		// - Key is for encryption of the data and will be stored in encrypted repo file
 		// - password is for the encryption of the repository (which holds Key)
 		// to migrate we need to use the existing repository password as key
-		if r.Key == "" {
-			r.Key = r.password
-			r.Version = 4
+		if r.Key != "" {
+			return ErrRepositoryIncompatible
+		}
+		r.Key = r.password
+		r.Version = 4
+	}
 
-			return r.Save()
+	if r.Version < 5 {
+		// older versions stored metadata without authentication. It gets
+		// sealed before the repository file, so an interrupted migration
+		// can be resumed
+		err := r.sealMetadata()
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.Version < 6 {
+		// version 5 derived the key for the repository file from its password.
+		// Since version 6 the repository file is encrypted with a random master
+		// key, which one or many key slots grant access to.
+		err := r.initKeySlots()
+		if err != nil {
+			return err
 		}
+		r.Version = 6
+	}
+
+	if r.Version < 7 {
+		// since version 7 content hashes are keyed. Existing chunks stay
+		// readable with their unkeyed hashes, until a key rotation re-encodes
+		// them
+		r.HashKey = deriveHashKey(r.Key)
+		r.Version = 7
+	}
+
+	if r.Version < 8 {
+		// since version 8 volumes know the dates of their snapshots, so
+		// snapshots can be found by date without loading them
+		r.fillSnapshotDates()
+		r.Version = 8
+	}
+
+	err := r.Save()
+	if err == nil {
+		r.legacyMetadata = false
 	}
-	return ErrRepositoryIncompatible
+	return err
 }
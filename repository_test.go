@@ -8,11 +8,19 @@
 package knoxite
 
 import (
+	"bytes"
+	"encoding/json"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
+func init() {
+	// we don't need any brute-force protection in tests, keep them fast
+	DefaultKDFParams.N = 1 << 10
+}
+
 func TestRepositoryCreate(t *testing.T) {
 	testPassword := "this_is_a_password"
 
@@ -115,3 +123,343 @@ func TestRepositoryChangePassword(t *testing.T) {
 	}
 
 }
+
+func TestRepositoryHeader(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, RepoFilename))
+	if err != nil {
+		t.Errorf("Failed reading repository file: %s", err)
+		return
+	}
+	header, _, err := parseRepositoryHeader(b)
+	if err != nil || header == nil {
+		t.Errorf("Failed parsing repository header: %s", err)
+		return
+	}
+	if header.Version != RepositoryVersion {
+		t.Errorf("Expected repository version %d in header, got %d", RepositoryVersion, header.Version)
+	}
+	if len(header.KeySlots) != 1 {
+		t.Errorf("Expected 1 key slot in header, got %d", len(header.KeySlots))
+		return
+	}
+	kdf := header.KeySlots[0].KDF
+	if kdf.Algorithm != KDFScrypt || len(kdf.Salt) != kdfSaltLength {
+		t.Errorf("Unexpected KDF parameters in header: %+v", kdf)
+	}
+
+	// a new password must also use a new salt
+	if err := r.ChangePassword("this_is_another_password"); err != nil {
+		t.Errorf("Failed to change repository password: %s", err)
+		return
+	}
+	b, _ = ioutil.ReadFile(filepath.Join(dir, RepoFilename))
+	newHeader, _, err := parseRepositoryHeader(b)
+	if err != nil || newHeader == nil || len(newHeader.KeySlots) != 1 {
+		t.Errorf("Failed parsing repository header: %s", err)
+		return
+	}
+	if bytes.Equal(kdf.Salt, newHeader.KeySlots[0].KDF.Salt) {
+		t.Error("Salt did not change after changing the repository password")
+	}
+}
+
+func TestRepositoryKDFBounds(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = NewRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+	b, _ := ioutil.ReadFile(filepath.Join(dir, RepoFilename))
+	header, data, err := parseRepositoryHeader(b)
+	if err != nil || header == nil || len(header.KeySlots) != 1 {
+		t.Errorf("Failed parsing repository header: %s", err)
+		return
+	}
+
+	// the header isn't authenticated, anyone could raise the cost parameters
+	tests := []func(*KDFParams){
+		func(p *KDFParams) { p.N = 1 << 30 },
+		func(p *KDFParams) { p.R = 1 << 20 },
+		func(p *KDFParams) { p.P = 1 << 20 },
+		func(p *KDFParams) { p.R = 0 },
+	}
+	for i, tamper := range tests {
+		h := *header
+		h.KeySlots = []KeySlot{header.KeySlots[0]}
+		tamper(&h.KeySlots[0].KDF)
+
+		hb, _ := json.Marshal(h)
+		var buf bytes.Buffer
+		buf.WriteString(RepositoryHeaderPrefix)
+		buf.Write(hb)
+		buf.WriteByte('\n')
+		buf.Write(data)
+		_ = ioutil.WriteFile(filepath.Join(dir, RepoFilename), buf.Bytes(), 0600)
+
+		_, err = OpenRepository(dir, testPassword)
+		if err != ErrKDFParamsInvalid {
+			t.Errorf("Test %d: expected %v, got %v", i, ErrKDFParamsInvalid, err)
+		}
+	}
+}
+
+func TestRepositoryMigrate(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+
+	// write a version 4 repository file, encrypted with the password directly
+	r.Version = 4
+	pipe, _ := NewEncodingPipeline(CompressionNone, EncryptionAES, testPassword)
+	b, err := pipe.Encode(r)
+	if err != nil {
+		t.Errorf("Failed encoding repository: %s", err)
+		return
+	}
+	if err := r.backend.SaveRepository(b); err != nil {
+		t.Errorf("Failed saving repository: %s", err)
+		return
+	}
+
+	_, err = OpenRepository(dir, "this_is_the_wrong_password")
+	if err != ErrOpenRepositoryFailed {
+		t.Errorf("Expected %v, got %v", ErrOpenRepositoryFailed, err)
+	}
+
+	migrated, err := OpenRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed opening version 4 repository: %s", err)
+		return
+	}
+	if migrated.Version != RepositoryVersion {
+		t.Errorf("Expected repository version %d after migration, got %d", RepositoryVersion, migrated.Version)
+	}
+	if migrated.Key != r.Key {
+		t.Error("Repository key changed during migration")
+	}
+
+	b, _ = ioutil.ReadFile(filepath.Join(dir, RepoFilename))
+	if header, _, err := parseRepositoryHeader(b); err != nil || header == nil {
+		t.Errorf("Migrated repository has no header: %v", err)
+	}
+
+	if _, err = OpenRepository(dir, testPassword); err != nil {
+		t.Errorf("Failed opening migrated repository: %s", err)
+	}
+}
+
+func TestRepositoryMigrateSealsMetadata(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+	snapshot, _ := NewSnapshot("test_snapshot")
+	_ = vol.AddSnapshot(snapshot.ID)
+
+	// write a version 4 repository with unauthenticated metadata
+	r.Version = 4
+	r.Key = testPassword
+	legacy, _ := NewEncodingPipeline(CompressionLZMA, EncryptionAES, testPassword)
+	b, _ := legacy.Encode(snapshot)
+	_ = r.backend.SaveSnapshot(snapshot.ID, b)
+	b, _ = legacy.Encode(ChunkIndex{Chunks: make(map[string]*ChunkIndexItem)})
+	_ = r.backend.SaveChunkIndex(b)
+	pipe, _ := NewEncodingPipeline(CompressionNone, EncryptionAES, testPassword)
+	b, _ = pipe.Encode(r)
+	if err := r.backend.SaveRepository(b); err != nil {
+		t.Errorf("Failed saving repository: %s", err)
+		return
+	}
+
+	migrated, err := OpenRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed opening version 4 repository: %s", err)
+		return
+	}
+	if b, _ := migrated.backend.LoadSnapshot(snapshot.ID); !isSealed(b) {
+		t.Error("Snapshot didn't get sealed during migration")
+	}
+	if b, _ := migrated.backend.LoadChunkIndex(); !isSealed(b) {
+		t.Error("Chunk-index didn't get sealed during migration")
+	}
+	if _, err := OpenChunkIndex(&migrated); err != nil {
+		t.Errorf("Failed opening migrated chunk-index: %s", err)
+	}
+
+	// unauthenticated metadata must not be accepted anymore
+	legacy, _ = NewEncodingPipeline(CompressionLZMA, EncryptionAES, migrated.Key)
+	b, _ = legacy.Encode(snapshot)
+	_ = migrated.backend.SaveSnapshot(snapshot.ID, b)
+	if _, err := migrated.Volumes[0].LoadSnapshot(snapshot.ID, &migrated); err == nil {
+		t.Error("Expected unauthenticated snapshot to be rejected")
+	}
+
+	// neither by stripping the header of the repository file
+	b, _ = pipe.Encode(migrated)
+	_ = migrated.backend.SaveRepository(b)
+	if _, err := OpenRepository(dir, testPassword); err != ErrOpenRepositoryFailed {
+		t.Errorf("Expected %v, got %v", ErrOpenRepositoryFailed, err)
+	}
+}
+
+func TestRepositoryMigrateSnapshotDates(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+	snapshot, _ := NewSnapshot("test_snapshot")
+	_ = snapshot.Save(&r)
+	_ = vol.AddSnapshot(snapshot.ID)
+
+	// a version 7 repository without the dates of its snapshots
+	r.Version = 7
+	if err := r.Save(); err != nil {
+		t.Errorf("Failed saving repository: %s", err)
+		return
+	}
+
+	if _, err = OpenRepository(dir, testPassword); err != nil {
+		t.Errorf("Failed opening version 7 repository: %s", err)
+		return
+	}
+	migrated, err := OpenRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed opening migrated repository: %s", err)
+		return
+	}
+	date, ok := migrated.Volumes[0].Dates[snapshot.ID]
+	if !ok || !date.Equal(snapshot.Date) {
+		t.Errorf("Expected stored snapshot date %v, got %v", snapshot.Date, date)
+	}
+}
+
+func TestRepositoryKeySlots(t *testing.T) {
+	testPassword := "this_is_a_password"
+	otherPassword := "this_is_another_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+	first := r.KeySlot()
+
+	slot, err := r.AddKey(otherPassword, "ci")
+	if err != nil {
+		t.Errorf("Failed adding key slot: %s", err)
+		return
+	}
+	if err := r.Save(); err != nil {
+		t.Errorf("Failed saving repository: %s", err)
+		return
+	}
+
+	for _, password := range []string{testPassword, otherPassword} {
+		repo, err := OpenRepository(dir, password)
+		if err != nil {
+			t.Errorf("Failed opening repository with %s: %s", password, err)
+			continue
+		}
+		if repo.Key != r.Key {
+			t.Error("Key slots unlocked different repository keys")
+		}
+		if len(repo.KeySlots()) != 2 {
+			t.Errorf("Expected 2 key slots, got %d", len(repo.KeySlots()))
+		}
+	}
+
+	// revoke the first key
+	repo, _ := OpenRepository(dir, otherPassword)
+	if repo.KeySlot() != slot.ID {
+		t.Errorf("Expected repository to be opened with key slot %s, got %s", slot.ID, repo.KeySlot())
+	}
+	if err := repo.RemoveKey(first); err != nil {
+		t.Errorf("Failed removing key slot: %s", err)
+		return
+	}
+	if err := repo.RemoveKey(first); err != ErrKeySlotNotFound {
+		t.Errorf("Expected %v, got %v", ErrKeySlotNotFound, err)
+	}
+	if err := repo.RemoveKey(slot.ID); err != ErrLastKeySlot {
+		t.Errorf("Expected %v, got %v", ErrLastKeySlot, err)
+	}
+	if err := repo.Save(); err != nil {
+		t.Errorf("Failed saving repository: %s", err)
+		return
+	}
+
+	_, err = OpenRepository(dir, testPassword)
+	if err != ErrOpenRepositoryFailed {
+		t.Errorf("Expected %v, got %v", ErrOpenRepositoryFailed, err)
+	}
+	_, err = OpenRepository(dir, otherPassword)
+	if err != nil {
+		t.Errorf("Failed opening repository: %s", err)
+	}
+}
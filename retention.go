@@ -0,0 +1,220 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A RetentionPolicy decides which snapshots of a volume to keep. A snapshot
+// is kept if any of the rules applies to it.
+type RetentionPolicy struct {
+	KeepLast    int           // keep the n most recent snapshots
+	KeepHourly  int           // keep the most recent snapshot of the last n hours
+	KeepDaily   int           // keep the most recent snapshot of the last n days
+	KeepWeekly  int           // keep the most recent snapshot of the last n weeks
+	KeepMonthly int           // keep the most recent snapshot of the last n months
+	KeepYearly  int           // keep the most recent snapshot of the last n years
+	KeepWithin  time.Duration // keep all snapshots made within this duration of the latest one
+}
+
+// A RetentionDecision tells whether a snapshot is kept and why.
+type RetentionDecision struct {
+	Snapshot *Snapshot
+	Keep     bool
+	Reasons  []string
+}
+
+// Error declarations.
+var (
+	ErrInvalidRetentionDuration = errors.New("invalid duration, use a combination of y, m, w, d and h, e.g. 1y6m")
+)
+
+// retentionBucket groups snapshots by a period of time. Of every period only
+// the most recent snapshot gets kept.
+type retentionBucket struct {
+	reason string
+	count  int
+	period func(t time.Time) string
+}
+
+// IsEmpty returns true if the policy doesn't contain any rules.
+func (p RetentionPolicy) IsEmpty() bool {
+	return p == RetentionPolicy{}
+}
+
+// Apply returns the decisions for all snapshots, sorted from the latest to
+// the oldest snapshot. If the policy is empty, all snapshots are kept.
+func (p RetentionPolicy) Apply(snapshots []*Snapshot) []RetentionDecision {
+	decisions := make([]RetentionDecision, len(snapshots))
+	for i, snapshot := range snapshots {
+		decisions[i] = RetentionDecision{Snapshot: snapshot}
+	}
+	sort.SliceStable(decisions, func(i, j int) bool {
+		return decisions[i].Snapshot.Date.After(decisions[j].Snapshot.Date)
+	})
+
+	if p.IsEmpty() {
+		for i := range decisions {
+			decisions[i].Keep = true
+		}
+		return decisions
+	}
+
+	buckets := []retentionBucket{
+		{"last snapshot", p.KeepLast, func(t time.Time) string {
+			// every snapshot is a period of its own
+			return t.Format(time.RFC3339Nano)
+		}},
+		{"hourly snapshot", p.KeepHourly, func(t time.Time) string { return t.Format("2006-01-02 15") }},
+		{"daily snapshot", p.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly snapshot", p.KeepWeekly, func(t time.Time) string {
+			y, w := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", y, w)
+		}},
+		{"monthly snapshot", p.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{"yearly snapshot", p.KeepYearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+
+	for _, b := range buckets {
+		last := ""
+		for i := range decisions {
+			if b.count <= 0 {
+				break
+			}
+
+			period := b.period(decisions[i].Snapshot.Date.Local())
+			if period == last {
+				continue
+			}
+			last = period
+
+			decisions[i].Keep = true
+			decisions[i].Reasons = append(decisions[i].Reasons, b.reason)
+			b.count--
+		}
+	}
+
+	if p.KeepWithin > 0 && len(decisions) > 0 {
+		// measured from the latest snapshot, so no snapshots expire when
+		// backups stop running
+		since := decisions[0].Snapshot.Date.Add(-p.KeepWithin)
+		for i := range decisions {
+			if !decisions[i].Snapshot.Date.Before(since) {
+				decisions[i].Keep = true
+				decisions[i].Reasons = append(decisions[i].Reasons, "within "+FormatRetentionDuration(p.KeepWithin))
+			}
+		}
+	}
+
+	return decisions
+}
+
+// ParseRetentionDuration parses durations like "1y6m", "2w" or "36h". A year
+// is counted as 365 days, a month as 30 days.
+func ParseRetentionDuration(s string) (time.Duration, error) {
+	units := map[byte]time.Duration{
+		'y': 365 * 24 * time.Hour,
+		'm': 30 * 24 * time.Hour,
+		'w': 7 * 24 * time.Hour,
+		'd': 24 * time.Hour,
+		'h': time.Hour,
+	}
+
+	var d time.Duration
+	num := ""
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= '0' && c <= '9' {
+			num += string(c)
+			continue
+		}
+
+		unit, ok := units[c]
+		if !ok || num == "" {
+			return 0, ErrInvalidRetentionDuration
+		}
+		n, err := strconv.Atoi(num)
+		if err != nil {
+			return 0, ErrInvalidRetentionDuration
+		}
+		d += time.Duration(n) * unit
+		num = ""
+	}
+	if num != "" || d == 0 {
+		return 0, ErrInvalidRetentionDuration
+	}
+
+	return d, nil
+}
+
+// FormatRetentionDuration formats a duration the way ParseRetentionDuration
+// accepts it.
+func FormatRetentionDuration(d time.Duration) string {
+	s := ""
+	for _, u := range []struct {
+		unit     string
+		duration time.Duration
+	}{
+		{"y", 365 * 24 * time.Hour},
+		{"m", 30 * 24 * time.Hour},
+		{"w", 7 * 24 * time.Hour},
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+	} {
+		if n := d / u.duration; n > 0 {
+			s += strconv.FormatInt(int64(n), 10) + u.unit
+			d -= n * u.duration
+		}
+	}
+	if s == "" {
+		return "0h"
+	}
+
+	return s
+}
+
+// Forget applies policy to the volume's snapshots matching filter and removes
+// every snapshot the policy doesn't keep from the volume and the chunk-index.
+// Snapshots not matching filter are left alone. Unless dryRun is set, the
+// caller needs to save the repository and the chunk-index.
+func (v *Volume) Forget(repository *Repository, index *ChunkIndex, policy RetentionPolicy, filter SnapshotFilter, dryRun bool) ([]RetentionDecision, error) {
+	var snapshots []*Snapshot
+	for _, id := range v.Snapshots {
+		snapshot, err := v.LoadSnapshot(id, repository)
+		if err != nil {
+			return nil, err
+		}
+		if filter.Match(snapshot) {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+
+	decisions := policy.Apply(snapshots)
+	if dryRun {
+		return decisions, nil
+	}
+
+	var forget []string
+	for _, d := range decisions {
+		if d.Keep {
+			continue
+		}
+		if err := v.RemoveSnapshot(d.Snapshot.ID); err != nil {
+			return decisions, err
+		}
+		forget = append(forget, d.Snapshot.ID)
+	}
+	index.RemoveSnapshot(forget...)
+
+	return decisions, nil
+}
@@ -0,0 +1,154 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicy(t *testing.T) {
+	latest := time.Date(2021, 3, 31, 12, 0, 0, 0, time.Local)
+
+	// two snapshots a day for 90 days
+	var snapshots []*Snapshot
+	for i := 0; i < 180; i++ {
+		snapshots = append(snapshots, &Snapshot{
+			ID:   latest.Add(-time.Duration(i) * 12 * time.Hour).Format(time.RFC3339),
+			Date: latest.Add(-time.Duration(i) * 12 * time.Hour),
+		})
+	}
+
+	tests := []struct {
+		policy RetentionPolicy
+		kept   int
+	}{
+		{RetentionPolicy{}, 180},
+		{RetentionPolicy{KeepLast: 3}, 3},
+		{RetentionPolicy{KeepDaily: 7}, 7},
+		{RetentionPolicy{KeepLast: 2, KeepDaily: 7}, 8},
+		{RetentionPolicy{KeepMonthly: 12}, 3},
+		{RetentionPolicy{KeepYearly: 5}, 1},
+		{RetentionPolicy{KeepWithin: 48 * time.Hour}, 5},
+		{RetentionPolicy{KeepDaily: 7, KeepWeekly: 4, KeepMonthly: 6}, 11},
+	}
+
+	for _, tt := range tests {
+		decisions := tt.policy.Apply(snapshots)
+		if len(decisions) != len(snapshots) {
+			t.Errorf("Expected %d decisions, got %d", len(snapshots), len(decisions))
+			continue
+		}
+		if !decisions[0].Snapshot.Date.Equal(latest) {
+			t.Errorf("Expected decisions to start with the latest snapshot, got %s", decisions[0].Snapshot.Date)
+		}
+
+		kept := 0
+		for _, d := range decisions {
+			if d.Keep {
+				kept++
+				if len(d.Reasons) == 0 && !tt.policy.IsEmpty() {
+					t.Errorf("Snapshot %s kept without a reason", d.Snapshot.ID)
+				}
+			}
+		}
+		if kept != tt.kept {
+			t.Errorf("Policy %+v: expected %d snapshots to be kept, got %d", tt.policy, tt.kept, kept)
+		}
+	}
+}
+
+func TestParseRetentionDuration(t *testing.T) {
+	tests := []struct {
+		s string
+		d time.Duration
+	}{
+		{"12h", 12 * time.Hour},
+		{"2w", 14 * 24 * time.Hour},
+		{"1y6m", (365 + 180) * 24 * time.Hour},
+		{"1d12h", 36 * time.Hour},
+	}
+	for _, tt := range tests {
+		d, err := ParseRetentionDuration(tt.s)
+		if err != nil {
+			t.Errorf("Failed parsing %s: %s", tt.s, err)
+			continue
+		}
+		if d != tt.d {
+			t.Errorf("Expected %s for %s, got %s", tt.d, tt.s, d)
+		}
+		if s := FormatRetentionDuration(d); s != tt.s {
+			t.Errorf("Expected %s, got %s", tt.s, s)
+		}
+	}
+
+	for _, s := range []string{"", "12", "d", "3x", "1.5d"} {
+		if _, err := ParseRetentionDuration(s); err != ErrInvalidRetentionDuration {
+			t.Errorf("Expected %v for %q, got %v", ErrInvalidRetentionDuration, s, err)
+		}
+	}
+}
+
+func TestVolumeForget(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository(dir, testPassword)
+	index, _ := OpenChunkIndex(&r)
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		snapshot, _ := NewSnapshot("test_snapshot")
+		snapshot.Date = snapshot.Date.Add(time.Duration(i-5) * time.Hour)
+		_ = snapshot.Save(&r)
+		_ = vol.AddSnapshot(snapshot.ID)
+		index.AddArchive(&Archive{
+			Chunks: []Chunk{{Hash: snapshot.ID}},
+		}, snapshot.ID)
+		ids = append(ids, snapshot.ID)
+	}
+
+	policy := RetentionPolicy{KeepLast: 2}
+	decisions, err := vol.Forget(&r, &index, policy, SnapshotFilter{}, true)
+	if err != nil {
+		t.Errorf("Failed forgetting snapshots: %s", err)
+		return
+	}
+	if len(decisions) != 5 || len(vol.Snapshots) != 5 {
+		t.Errorf("Dry-run should not remove any snapshots")
+	}
+
+	_, err = vol.Forget(&r, &index, policy, SnapshotFilter{}, false)
+	if err != nil {
+		t.Errorf("Failed forgetting snapshots: %s", err)
+		return
+	}
+	if len(vol.Snapshots) != 2 || vol.Snapshots[0] != ids[3] || vol.Snapshots[1] != ids[4] {
+		t.Errorf("Expected snapshots %v to be kept, got %v", ids[3:], vol.Snapshots)
+	}
+
+	for i, id := range ids {
+		refs := len(index.Chunks[id].Snapshots)
+		if i < 3 && refs != 0 {
+			t.Errorf("Chunk of forgotten snapshot %s is still referenced", id)
+		}
+		if i >= 3 && refs != 1 {
+			t.Errorf("Chunk of kept snapshot %s lost its reference", id)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+const (
+	// number of chunks to re-encrypt before the snapshots & chunk-index
+	// get updated, so an interrupted rotation can be resumed
+	rotationCheckpoint = 1024
+)
+
+// RotateKey replaces the repository's data key with a new one. The snapshots
+// and the chunk-index get re-encrypted right away, while the chunks can be
+// re-encrypted incrementally with RotateChunks. Until then the retired key is
+// kept to decrypt the chunks it's been used for.
+func (r *Repository) RotateKey(index *ChunkIndex) error {
+	key, err := generateRandomKey(repositoryKeyLength)
+	if err != nil {
+		return ErrGenerateRandomKeyFailed
+	}
+
+	var snapshots []*Snapshot
+	for _, volume := range r.Volumes {
+		for _, id := range volume.Snapshots {
+			snapshot, err := volume.LoadSnapshot(id, r)
+			if err != nil {
+				return err
+			}
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+
+	if r.OldKeys == nil {
+		r.OldKeys = make(map[uint]string)
+	}
+	r.OldKeys[r.KeyGeneration] = r.Key
+	r.Key = key
+	r.KeyGeneration++
+
+	// the new key must be stored before anything gets encrypted with it
+	err = r.Save()
+	if err != nil {
+		return err
+	}
+
+	for _, snapshot := range snapshots {
+		err = snapshot.Save(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	return index.Save(r)
+}
+
+// IsRotating returns true if some chunks are still encrypted with a retired key.
+func (r *Repository) IsRotating() bool {
+	return len(r.OldKeys) > 0
+}
+
+// rotationJob is a chunk that needs to be re-encrypted.
+type rotationJob struct {
+	Chunk      Chunk
+	Compressed uint16
+	Encrypted  uint16
+}
+
+// RotateChunks re-encrypts up to limit chunks (or all of them, if limit is 0)
+// still encrypted with a retired key. Chunks stored before content hashes got
+// keyed are re-encoded as well, so their names don't reveal their content
+// anymore. Progress is saved regularly, so the rotation can be resumed by
+// calling RotateChunks again. Once all chunks use the current key, the retired
+// keys get dropped.
+func RotateChunks(repository *Repository, index *ChunkIndex, limit int) (<-chan Progress, error) {
+	prog := make(chan Progress)
+
+	// snapshots are the only place knowing how a chunk has been encoded
+	var snapshots []*Snapshot
+	jobs := make(map[string]rotationJob)
+	for _, volume := range repository.Volumes {
+		for _, id := range volume.Snapshots {
+			snapshot, err := volume.LoadSnapshot(id, repository)
+			if err != nil {
+				return prog, err
+			}
+			snapshots = append(snapshots, snapshot)
+
+			for _, arc := range snapshot.Archives {
+				for _, chunk := range arc.Chunks {
+					if chunk.KeyGeneration != repository.KeyGeneration ||
+						(!chunk.Keyed && repository.HashKey != "") {
+						jobs[chunk.Hash] = rotationJob{chunk, arc.Compressed, arc.Encrypted}
+					}
+				}
+			}
+		}
+	}
+
+	var pk *packer
+	if repository.PackSize > 0 {
+		pk = newPacker(&repository.backend, repository.PackSize)
+	}
+
+	go func() {
+		defer close(prog)
+
+		var total Stats
+		for _, job := range jobs {
+			total.Size += uint64(job.Chunk.OriginalSize)
+		}
+
+		done := 0
+		rotated := make(map[string]Chunk)
+		for _, job := range jobs {
+			if limit > 0 && done >= limit {
+				break
+			}
+
+			p := Progress{
+				Path: job.Chunk.Hash,
+				CurrentItemStats: Stats{
+					Size: uint64(job.Chunk.OriginalSize),
+				},
+			}
+			chunk, err := rotateChunk(repository, pk, job)
+			if err != nil {
+				p.Error = err
+				prog <- p
+				return
+			}
+			rotated[job.Chunk.Hash] = chunk
+			done++
+
+			total.Transferred += uint64(chunk.OriginalSize)
+			p.CurrentItemStats.Transferred = p.CurrentItemStats.Size
+			p.TotalStatistics = total
+			prog <- p
+
+			if len(rotated) >= rotationCheckpoint {
+				if err := rotationCheckpointSave(repository, pk, index, snapshots, rotated); err != nil {
+					prog <- newProgressError(err)
+					return
+				}
+				rotated = make(map[string]Chunk)
+			}
+		}
+
+		if err := rotationCheckpointSave(repository, pk, index, snapshots, rotated); err != nil {
+			prog <- newProgressError(err)
+			return
+		}
+
+		if done == len(jobs) {
+			// all chunks use the current key now
+			repository.OldKeys = nil
+			if err := repository.Save(); err != nil {
+				prog <- newProgressError(err)
+			}
+		}
+	}()
+
+	return prog, nil
+}
+
+// rotateChunk re-encrypts a single chunk with the current key and stores it,
+// in a pack file if pk isn't nil. Chunks without encryption only get their key
+// generation updated, unless their hashes need to be keyed.
+func rotateChunk(repository *Repository, pk *packer, job rotationJob) (Chunk, error) {
+	chunk := job.Chunk
+	chunk.KeyGeneration = repository.KeyGeneration
+	hashKey, err := repository.contentHashKey()
+	if err != nil {
+		return chunk, err
+	}
+	if job.Encrypted == EncryptionNone && (chunk.Keyed || hashKey == nil) {
+		return chunk, nil
+	}
+
+	arc := Archive{
+		Compressed: job.Compressed,
+		Encrypted:  job.Encrypted,
+	}
+	b, err := loadChunk(*repository, arc, job.Chunk)
+	if err != nil {
+		return chunk, err
+	}
+
+	pipe, err := NewEncodingPipeline(job.Compressed, job.Encrypted, repository.Key)
+	if err != nil {
+		return chunk, err
+	}
+	c, err := encodeChunk(pipe, b, chunkEncoding{
+		Compressed:    job.Compressed,
+		Encrypted:     job.Encrypted,
+		DataParts:     job.Chunk.DataParts,
+		ParityParts:   job.Chunk.ParityParts,
+		KeyGeneration: repository.KeyGeneration,
+		HashKey:       hashKey,
+	})
+	if err != nil {
+		return chunk, err
+	}
+
+	if pk != nil {
+		c.Parts, _, err = pk.add(c)
+	} else {
+		_, err = repository.backend.StoreChunk(c)
+	}
+	if err != nil {
+		return chunk, err
+	}
+
+	chunk.Hash = c.Hash
+	chunk.Parts = c.Parts
+	chunk.DecryptedHash = c.DecryptedHash
+	chunk.Keyed = c.Keyed
+	chunk.Size = c.Size
+	return chunk, nil
+}
+
+// rotationCheckpointSave points all snapshots and the chunk-index to the
+// re-encrypted chunks, before deleting the old ones.
+func rotationCheckpointSave(repository *Repository, pk *packer, index *ChunkIndex, snapshots []*Snapshot, rotated map[string]Chunk) error {
+	if len(rotated) == 0 {
+		return nil
+	}
+	if pk != nil {
+		// the re-encrypted chunks must be stored before anything points to them
+		if err := pk.flush(); err != nil {
+			return err
+		}
+	}
+
+	for _, snapshot := range snapshots {
+		changed := false
+		for _, arc := range snapshot.Archives {
+			changed = arc.replaceChunks(rotated) || changed
+		}
+
+		if changed {
+			if err := snapshot.Save(repository); err != nil {
+				return err
+			}
+		}
+	}
+
+	var loose []string
+	for hash, chunk := range rotated {
+		item, ok := index.Chunks[hash]
+		if !ok {
+			continue
+		}
+		delete(index.Chunks, hash)
+		if hash != chunk.Hash {
+			if len(item.Parts) > 0 {
+				// packed chunks stay in their pack files until the next repo pack
+				dead := *item
+				dead.Snapshots = nil
+				index.Chunks[hash] = &dead
+			} else {
+				loose = append(loose, hash)
+			}
+		}
+
+		if existing, ok := index.Chunks[chunk.Hash]; ok {
+			// chunks with the same content end up with the same keyed name
+			refs := make(map[string]bool, len(existing.Snapshots))
+			for _, s := range existing.Snapshots {
+				refs[s] = true
+			}
+			for _, s := range item.Snapshots {
+				if !refs[s] {
+					refs[s] = true
+					existing.Snapshots = append(existing.Snapshots, s)
+				}
+			}
+			continue
+		}
+		item.Hash = chunk.Hash
+		item.DecryptedHash = chunk.DecryptedHash
+		item.Size = chunk.Size
+		item.KeyGeneration = chunk.KeyGeneration
+		item.Parts = chunk.Parts
+		index.Chunks[chunk.Hash] = item
+	}
+	index.contents = nil
+	if err := index.Save(repository); err != nil {
+		return err
+	}
+
+	// nothing references the old chunks anymore
+	for _, hash := range loose {
+		chunk := rotated[hash]
+		for i := uint(0); i < chunk.DataParts+chunk.ParityParts; i++ {
+			_ = repository.backend.DeleteChunk(hash, i, chunk.DataParts)
+		}
+	}
+
+	return nil
+}
+
+// replaceChunks updates an archive's chunks with their re-encrypted
+// counterparts and returns true if anything changed.
+func (arc *Archive) replaceChunks(rotated map[string]Chunk) bool {
+	changed := false
+	for i, chunk := range arc.Chunks {
+		c, ok := rotated[chunk.Hash]
+		if !ok {
+			continue
+		}
+
+		c.Num = chunk.Num
+		arc.Chunks[i] = c
+		changed = true
+	}
+
+	if changed {
+		arc.KeyGeneration = arc.Chunks[0].KeyGeneration
+		for _, chunk := range arc.Chunks {
+			if chunk.KeyGeneration < arc.KeyGeneration {
+				arc.KeyGeneration = chunk.KeyGeneration
+			}
+		}
+	}
+
+	return changed
+}
@@ -0,0 +1,169 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotateKey(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository(dir, testPassword)
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+	index, _ := OpenChunkIndex(&r)
+	wd, _ := os.Getwd()
+
+	for _, encryption := range []uint16{EncryptionAES, EncryptionAESGCM, EncryptionNone} {
+		snapshot, _ := NewSnapshot("test_snapshot")
+		opts := StoreOptions{
+			CWD:         wd,
+			Paths:       []string{"snapshot.go"},
+			Excludes:    []string{},
+			Compress:    CompressionGZip,
+			Encrypt:     encryption,
+			DataParts:   1,
+			ParityParts: 0,
+		}
+
+		progress := snapshot.Add(r, &index, opts)
+		for p := range progress {
+			if p.Error != nil {
+				t.Errorf("Failed adding to snapshot: %s", p.Error)
+			}
+		}
+		_ = snapshot.Save(&r)
+		_ = vol.AddSnapshot(snapshot.ID)
+	}
+	_ = index.Save(&r)
+	_ = r.Save()
+
+	oldKey := r.Key
+	if err := r.RotateKey(&index); err != nil {
+		t.Errorf("Failed rotating key: %s", err)
+		return
+	}
+	if r.Key == oldKey || r.KeyGeneration != 1 || !r.IsRotating() {
+		t.Error("Repository key did not change")
+	}
+
+	verify := func() {
+		repo, err := OpenRepository(dir, testPassword)
+		if err != nil {
+			t.Errorf("Failed opening repository: %s", err)
+			return
+		}
+		if _, err := OpenChunkIndex(&repo); err != nil {
+			t.Errorf("Failed opening chunk-index: %s", err)
+		}
+
+		for _, id := range vol.Snapshots {
+			_, snapshot, err := repo.FindSnapshot(id)
+			if err != nil {
+				t.Errorf("Failed finding snapshot: %s", err)
+				continue
+			}
+			for _, arc := range snapshot.Archives {
+				if err := VerifyArchive(repo, *arc); err != nil {
+					t.Errorf("Failed verifying archive %s: %s", arc.Path, err)
+				}
+			}
+		}
+	}
+
+	// chunks encrypted with the old key must still be readable
+	verify()
+
+	rotate := func(limit int) {
+		progress, err := RotateChunks(&r, &index, limit)
+		if err != nil {
+			t.Errorf("Failed rotating chunks: %s", err)
+			return
+		}
+		for p := range progress {
+			if p.Error != nil {
+				t.Errorf("Failed rotating chunks: %s", p.Error)
+			}
+		}
+	}
+
+	// rotate a single chunk, then resume
+	rotate(1)
+	if !r.IsRotating() {
+		t.Error("Rotation finished early")
+	}
+	verify()
+
+	rotate(0)
+	if r.IsRotating() {
+		t.Error("Rotation did not finish")
+	}
+	verify()
+
+	for hash, chunk := range index.Chunks {
+		if chunk.KeyGeneration != r.KeyGeneration {
+			t.Errorf("Chunk %s still uses key generation %d", hash, chunk.KeyGeneration)
+		}
+	}
+
+	// the chunks encrypted with the old key must be gone
+	files := 0
+	_ = filepath.Walk(filepath.Join(dir, chunksDirname), func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() && fi.Name() != ChunkIndexFilename {
+			files++
+		}
+		return nil
+	})
+	if files != len(index.Chunks) {
+		t.Errorf("Expected %d chunks in storage, found %d", len(index.Chunks), files)
+	}
+}
+
+func TestRotationCheckpointMerge(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository(dir, testPassword)
+	index, _ := OpenChunkIndex(&r)
+
+	// a legacy chunk which gets the same keyed name as an existing one
+	index.Chunks["legacy"] = &ChunkIndexItem{Hash: "legacy", Snapshots: []string{"a", "b"}}
+	index.Chunks["keyed"] = &ChunkIndexItem{Hash: "keyed", Snapshots: []string{"b", "c"}}
+	rotated := map[string]Chunk{
+		"legacy": {Hash: "keyed", DataParts: 1},
+	}
+	if err := rotationCheckpointSave(&r, nil, &index, nil, rotated); err != nil {
+		t.Errorf("Failed saving rotation checkpoint: %s", err)
+		return
+	}
+
+	if _, ok := index.Chunks["legacy"]; ok {
+		t.Error("Expected legacy chunk to be gone from the chunk-index")
+	}
+	refs := index.Chunks["keyed"].Snapshots
+	if len(refs) != 3 || refs[0] != "b" || refs[1] != "c" || refs[2] != "a" {
+		t.Errorf("Expected snapshots [b c a], got %v", refs)
+	}
+}
@@ -12,13 +12,48 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
 )
 
-func findFiles(rootPath string, excludes []string) <-chan ArchiveResult {
+// inodeKey identifies a file across hardlinks.
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+// scanState is shared by the scans of all paths of a snapshot.
+type scanState struct {
+	excludes *excludeMatcher
+	// links maps files with multiple hardlinks to the path they were first
+	// found at
+	links map[inodeKey]string
+	// skipped counts the entries skipped by the filters of StoreOptions
+	skipped uint64
+}
+
+// skip reports whether an entry gets skipped by the size & time filters of
+// opts. Directories are never skipped.
+func (opts StoreOptions) skip(fi os.FileInfo) bool {
+	if fi.IsDir() {
+		return false
+	}
+	if opts.ExcludeLargerThan > 0 && isRegularFile(fi) && uint64(fi.Size()) > opts.ExcludeLargerThan {
+		return true
+	}
+	if !opts.NewerThan.IsZero() && !fi.ModTime().After(opts.NewerThan) {
+		return true
+	}
+	return !opts.OlderThan.IsZero() && !fi.ModTime().Before(opts.OlderThan)
+}
+
+// findFiles walks rootPath and sends an archive for every entry not excluded
+// or skipped by opts. The state gets updated once the returned channel is
+// closed.
+func findFiles(rootPath string, opts StoreOptions, state *scanState) <-chan ArchiveResult {
 	c := make(chan ArchiveResult)
 	go func() {
 		defer close(c)
+
+		var rootDev uint64
 		err := filepath.Walk(rootPath, func(path string, fi os.FileInfo, err error) error {
 			if err != nil {
 				if os.IsNotExist(err) {
@@ -32,24 +67,8 @@ func findFiles(rootPath string, excludes []string) <-chan ArchiveResult {
 				return fmt.Errorf("%s: could not read", path)
 			}
 
-			match := false
-			for _, exclude := range excludes {
-				// fmt.Println("Matching", path, filepath.Base(path), exclude)
-				match, err = filepath.Match(strings.ToLower(exclude), strings.ToLower(path))
-				if err != nil {
-					fmt.Println("Invalid exclude filter:", exclude)
-					return err
-				}
-				if !match {
-					match, _ = filepath.Match(strings.ToLower(exclude), strings.ToLower(filepath.Base(path)))
-				}
-
-				if match {
-					// fmt.Printf("\n\nSkipping %s as it matches filter: %s\n\n", path, exclude)
-					break
-				}
-			}
-			if match {
+			if state.excludes.excluded(fi.IsDir(), relPath(opts.CWD, path), path) ||
+				(fi.IsDir() && excludeDir(path, opts.ExcludeIfPresent, opts.ExcludeCaches)) {
 				if fi.IsDir() {
 					return filepath.SkipDir
 				}
@@ -60,12 +79,30 @@ func findFiles(rootPath string, excludes []string) <-chan ArchiveResult {
 			if !ok {
 				return &os.PathError{Op: "stat", Path: path, Err: errors.New("error reading metadata")}
 			}
+			if opts.skip(fi) {
+				state.skipped++
+				return nil
+			}
+
+			// mount points get stored, but not their content
+			otherFS := false
+			if path == rootPath {
+				rootDev = statT.dev()
+			} else if opts.OneFileSystem && statT.dev() != rootDev {
+				if !fi.IsDir() {
+					state.skipped++
+					return nil
+				}
+				otherFS = true
+			}
 			archive := Archive{
-				Path:    path,
-				Mode:    fi.Mode(),
-				ModTime: fi.ModTime().Unix(),
-				UID:     statT.uid(),
-				GID:     statT.gid(),
+				Path:       path,
+				Mode:       fi.Mode(),
+				ModTime:    fi.ModTime().Unix(),
+				ChangeTime: statT.ctime(),
+				Inode:      statT.ino(),
+				UID:        statT.uid(),
+				GID:        statT.gid(),
 				// AbsPath: path,
 				// FileInfo: fi,
 			}
@@ -83,11 +120,42 @@ func findFiles(rootPath string, excludes []string) <-chan ArchiveResult {
 			} else if isRegularFile(fi) {
 				archive.Type = File
 				archive.Size = uint64(fi.Size())
+
+				if statT.nlink() > 1 {
+					key := inodeKey{statT.dev(), statT.ino()}
+					if first, ok := state.links[key]; ok {
+						archive.LinkTo = first
+					} else {
+						state.links[key] = path
+					}
+				}
+			} else if fi.Mode()&os.ModeDevice != 0 {
+				archive.Type = BlockDevice
+				if fi.Mode()&os.ModeCharDevice != 0 {
+					archive.Type = CharDevice
+				}
+				archive.DevMajor, archive.DevMinor = deviceNumbers(statT.rdev())
+			} else if fi.Mode()&os.ModeNamedPipe != 0 {
+				archive.Type = FIFO
+			} else if fi.Mode()&os.ModeSocket != 0 {
+				archive.Type = Socket
 			} else {
 				return nil
 			}
 
+			if opts.XAttrs {
+				archive.XAttrs, err = readXAttrs(path)
+				if err != nil {
+					// don't fail the whole snapshot over missing metadata
+					log.Warnf("Could not read extended attributes: %v", err)
+				}
+			}
+
 			c <- ArchiveResult{Archive: &archive, Error: nil}
+			if otherFS {
+				state.skipped++
+				return filepath.SkipDir
+			}
 			return nil
 		})
 
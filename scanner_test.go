@@ -0,0 +1,98 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestFindFilesFilters(t *testing.T) {
+	sourcedir, err := ioutil.TempDir("", "knoxite.source")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for source: %s", err)
+		return
+	}
+	defer os.RemoveAll(sourcedir)
+
+	now := time.Now()
+	files := []struct {
+		path    string
+		size    int
+		modTime time.Time
+	}{
+		{"recent", 10, now.Add(-time.Hour)},
+		{"large", 2048, now.Add(-time.Hour)},
+		{"old", 10, now.AddDate(0, 0, -30)},
+		{"future", 10, now.AddDate(0, 0, 1)},
+		{"dir/recent", 10, now.Add(-time.Hour)},
+	}
+	for _, f := range files {
+		path := filepath.Join(sourcedir, f.path)
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Errorf("Failed creating source dir: %s", err)
+			return
+		}
+		err = ioutil.WriteFile(path, make([]byte, f.size), 0644)
+		if err != nil {
+			t.Errorf("Failed writing source file: %s", err)
+			return
+		}
+		err = os.Chtimes(path, f.modTime, f.modTime)
+		if err != nil {
+			t.Errorf("Failed setting modification time: %s", err)
+			return
+		}
+	}
+	// directories are never skipped, regardless of their modification time
+	old := now.AddDate(-1, 0, 0)
+	err = os.Chtimes(filepath.Join(sourcedir, "dir"), old, old)
+	if err != nil {
+		t.Errorf("Failed setting modification time: %s", err)
+		return
+	}
+
+	opts := StoreOptions{
+		CWD:               sourcedir,
+		OneFileSystem:     true,
+		ExcludeLargerThan: 1024,
+		NewerThan:         now.AddDate(0, 0, -7),
+		OlderThan:         now,
+	}
+	state := &scanState{
+		excludes: &excludeMatcher{},
+		links:    make(map[inodeKey]string),
+	}
+
+	var paths []string
+	for result := range findFiles(sourcedir, opts, state) {
+		if result.Error != nil {
+			t.Errorf("Failed finding files: %s", result.Error)
+			return
+		}
+		path := relPath(sourcedir, result.Archive.Path)
+		if path != "." {
+			paths = append(paths, filepath.ToSlash(path))
+		}
+	}
+	sort.Strings(paths)
+
+	expected := []string{"dir", "dir/recent", "recent"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected paths %v, got %v", expected, paths)
+	}
+	if state.skipped != 3 {
+		t.Errorf("Expected 3 skipped entries, got %d", state.skipped)
+	}
+}
@@ -8,9 +8,13 @@
 package knoxite
 
 import (
+	"io"
+	"io/ioutil"
 	"math"
 	"os"
+	"os/user"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -25,6 +29,10 @@ type Snapshot struct {
 	ID          string              `json:"id"`
 	Date        time.Time           `json:"date"`
 	Description string              `json:"description"`
+	Hostname    string              `json:"hostname,omitempty"`
+	Username    string              `json:"username,omitempty"`
+	Paths       []string            `json:"paths,omitempty"`
+	Tags        []string            `json:"tags,omitempty"`
 	Stats       Stats               `json:"stats"`
 	Archives    map[string]*Archive `json:"items"`
 }
@@ -33,12 +41,101 @@ type Snapshot struct {
 type StoreOptions struct {
 	CWD         string
 	Paths       []string
-	Excludes    []string
 	Compress    uint16
 	Encrypt     uint16
 	Pedantic    bool
 	DataParts   uint
 	ParityParts uint
+
+	// Excludes are gitignore-style patterns of paths which don't get stored.
+	// Anchored patterns match paths relative to CWD, or absolute paths
+	Excludes []string
+	// ExcludeFiles are files containing further Excludes, one per line
+	ExcludeFiles []string
+	// ExcludeIfPresent excludes directories containing a file with one of
+	// these names
+	ExcludeIfPresent []string
+	// ExcludeCaches excludes directories tagged by a CACHEDIR.TAG file
+	ExcludeCaches bool
+	// OneFileSystem stores mount points, but doesn't descend into them
+	OneFileSystem bool
+	// ExcludeLargerThan skips files larger than this many bytes, 0 for no
+	// limit
+	ExcludeLargerThan uint64
+	// NewerThan and OlderThan skip all but directories last modified before
+	// or after the respective time. Zero for no limit
+	NewerThan time.Time
+	OlderThan time.Time
+
+	// XAttrs stores extended attributes, including ACLs & file capabilities
+	XAttrs bool
+
+	// Stdin is a stream which gets stored as a file named StdinFilename,
+	// in addition to Paths. Nil for none
+	Stdin         io.Reader
+	StdinFilename string
+
+	// Parent is a previous snapshot of the same paths. Files which haven't
+	// changed since the parent snapshot re-use its chunks without being read
+	Parent *Snapshot
+
+	// Jobs is the number of files being read at the same time
+	Jobs int
+	// EncodeJobs is the number of chunks being compressed & encrypted at the
+	// same time
+	EncodeJobs int
+	// UploadJobs is the number of chunks being uploaded to each backend at
+	// the same time
+	UploadJobs int
+	// MemoryLimit is roughly the maximum amount of chunk data in bytes being
+	// held in memory at any time
+	MemoryLimit uint64
+}
+
+const (
+	defaultJobs        = 1
+	defaultEncodeJobs  = 4
+	defaultUploadJobs  = 1
+	defaultMemoryLimit = 256 * (1 << 20) // 256 MiB
+
+	defaultStdinFilename = "stdin"
+)
+
+// withDefaults returns a copy of opts with all unset values replaced by their
+// defaults.
+func (opts StoreOptions) withDefaults() StoreOptions {
+	opts.DataParts = uint(math.Max(1, float64(opts.DataParts)))
+	if opts.Jobs <= 0 {
+		opts.Jobs = defaultJobs
+	}
+	if opts.StdinFilename == "" {
+		opts.StdinFilename = defaultStdinFilename
+	}
+	if opts.EncodeJobs <= 0 {
+		opts.EncodeJobs = defaultEncodeJobs
+	}
+	if opts.UploadJobs <= 0 {
+		opts.UploadJobs = defaultUploadJobs
+	}
+	if opts.MemoryLimit == 0 {
+		opts.MemoryLimit = defaultMemoryLimit
+	}
+	return opts
+}
+
+// excludeMatcher returns a matcher for Excludes and the patterns found in
+// ExcludeFiles.
+func (opts StoreOptions) excludeMatcher() (*excludeMatcher, error) {
+	patterns := append([]string{}, opts.Excludes...)
+	for _, file := range opts.ExcludeFiles {
+		p, err := readExcludeFile(file)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p...)
+	}
+
+	return newExcludeMatcher(patterns)
 }
 
 // NewSnapshot creates a new snapshot.
@@ -48,6 +145,11 @@ func NewSnapshot(description string) (*Snapshot, error) {
 		Description: description,
 		Archives:    make(map[string]*Archive),
 	}
+	// missing metadata doesn't stop us from creating a snapshot
+	snapshot.Hostname, _ = os.Hostname()
+	if u, err := user.Current(); err == nil {
+		snapshot.Username = u.Username
+	}
 
 	u, err := uuid.NewV4()
 	if err != nil {
@@ -58,7 +160,16 @@ func NewSnapshot(description string) (*Snapshot, error) {
 	return &snapshot, nil
 }
 
-func (snapshot *Snapshot) gatherTargetInformation(cwd string, paths []string, excludes []string) <-chan ArchiveResult {
+// relPath returns path relative to cwd, unless it's outside of cwd.
+func relPath(cwd, path string) string {
+	rel, err := filepath.Rel(cwd, path)
+	if err == nil && !strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return rel
+	}
+	return path
+}
+
+func (snapshot *Snapshot) gatherTargetInformation(opts StoreOptions, excludes *excludeMatcher) <-chan ArchiveResult {
 	ch := make(chan ArchiveResult)
 	var wg sync.WaitGroup
 
@@ -73,15 +184,19 @@ func (snapshot *Snapshot) gatherTargetInformation(cwd string, paths []string, ex
 
 	go func() {
 		var archives []ArchiveResult
+		state := &scanState{
+			excludes: excludes,
+			links:    make(map[inodeKey]string),
+		}
 
-		for _, path := range paths {
-			ff := findFiles(path, excludes)
+		for _, path := range opts.Paths {
+			ff := findFiles(path, opts, state)
 
 			for result := range ff {
 				if result.Error == nil {
-					rel, err := filepath.Rel(cwd, result.Archive.Path)
-					if err == nil && !strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
-						result.Archive.Path = rel
+					result.Archive.Path = relPath(opts.CWD, result.Archive.Path)
+					if result.Archive.LinkTo != "" {
+						result.Archive.LinkTo = relPath(opts.CWD, result.Archive.LinkTo)
 					}
 					if isSpecialPath(result.Archive.Path) {
 						continue
@@ -111,6 +226,10 @@ func (snapshot *Snapshot) gatherTargetInformation(cwd string, paths []string, ex
 			}
 		}
 
+		snapshot.mut.Lock()
+		snapshot.Stats.Skipped += state.skipped
+		snapshot.mut.Unlock()
+
 		results(archives)
 
 		wg.Wait()
@@ -123,106 +242,457 @@ func (snapshot *Snapshot) gatherTargetInformation(cwd string, paths []string, ex
 // Add adds a path to a Snapshot.
 func (snapshot *Snapshot) Add(repository Repository, chunkIndex *ChunkIndex, opts StoreOptions) <-chan Progress {
 	progress := make(chan Progress)
+	opts = opts.withDefaults()
+	snapshot.addPaths(opts.Paths...)
 
-	ch := snapshot.gatherTargetInformation(opts.CWD, opts.Paths, opts.Excludes)
+	excludes, err := opts.excludeMatcher()
+	if err != nil {
+		go func() {
+			progress <- newProgressError(err)
+			close(progress)
+		}()
+		return progress
+	}
+	ch := snapshot.gatherTargetInformation(opts, excludes)
 
 	go func() {
 		defer close(progress)
-		for result := range ch {
-			if result.Error != nil {
-				p := newProgressError(result.Error)
-				p.Path = result.Archive.Path
-				progress <- p
-				if opts.Pedantic {
-					break
-				}
-				continue
-			}
 
-			archive := result.Archive
-			rel, err := filepath.Rel(opts.CWD, archive.Path)
-			if err == nil && !strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
-				archive.Path = rel
-			}
-			if isSpecialPath(archive.Path) {
-				continue
+		encoder, err := newChunkEncoder(&repository, opts)
+		if err != nil {
+			progress <- newProgressError(err)
+			for range ch {
 			}
+			return
+		}
+		defer encoder.close()
+		repository.backend.limitUploads(opts.UploadJobs)
+
+		w := &snapshotWriter{
+			snapshot:   snapshot,
+			repository: &repository,
+			chunkIndex: chunkIndex,
+			opts:       opts,
+			encoder:    encoder,
+			progress:   progress,
+			pending:    make(map[string]*pendingChunk),
+			links:      make(map[string][]*Archive),
+			abort:      make(chan struct{}),
+		}
+		if repository.PackSize > 0 {
+			w.packer = newPacker(&repository.backend, repository.PackSize)
+		}
 
-			p := newProgress(archive)
-			snapshot.mut.Lock()
-			p.TotalStatistics = snapshot.Stats
-			snapshot.mut.Unlock()
-			progress <- p
-
-			if archive.Type == File {
-				opts.DataParts = uint(math.Max(1, float64(opts.DataParts)))
-				chunkchan, err := chunkFile(archive.Path, repository.Key, opts)
-				if err != nil {
-					if os.IsNotExist(err) {
-						// if this file has already been deleted before we could backup it, we can gracefully ignore it and continue
+		var wg sync.WaitGroup
+		if opts.Stdin != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w.storeStream(opts.Stdin, opts.StdinFilename)
+			}()
+		}
+		for i := 0; i < opts.Jobs; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for result := range ch {
+					if w.aborted() {
+						// keep draining, so the scanner can finish
 						continue
 					}
-					p = newProgressError(err)
-					p.Path = archive.Path
-					progress <- p
-					if opts.Pedantic {
-						break
+					if result.Error != nil {
+						w.fail(result.Archive.Path, result.Error)
+						continue
 					}
+					w.storeArchive(result.Archive)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if !w.aborted() {
+			w.addLinks()
+		}
+		if w.packer != nil {
+			w.flushPacks()
+		}
+	}()
+
+	return progress
+}
+
+// A snapshotWriter stores the archives of a snapshot, with multiple files
+// being processed at the same time.
+type snapshotWriter struct {
+	snapshot   *Snapshot
+	repository *Repository
+	chunkIndex *ChunkIndex
+	opts       StoreOptions
+	encoder    *chunkEncoder
+	packer     *packer // nil, unless chunks get bundled into pack files
+	progress   chan<- Progress
+
+	// guards chunkIndex and pending
+	indexMut sync.Mutex
+	// chunks currently being uploaded, by their hash
+	pending map[string]*pendingChunk
+
+	// guards links
+	linkMut sync.Mutex
+	// hardlinks waiting to be added, by the path they're linked to
+	links map[string][]*Archive
+
+	abort     chan struct{}
+	abortOnce sync.Once
+}
+
+// pendingChunk is a chunk being uploaded. done gets closed once the upload
+// finished.
+type pendingChunk struct {
+	done  chan struct{}
+	parts []PackLocation
+	err   error
+}
+
+// fail reports an error for path. In pedantic mode it stops storing any
+// further archives.
+func (w *snapshotWriter) fail(path string, err error) {
+	p := newProgressError(err)
+	p.Path = path
+	w.progress <- p
+	if w.opts.Pedantic {
+		w.abortOnce.Do(func() {
+			close(w.abort)
+		})
+	}
+}
+
+func (w *snapshotWriter) aborted() bool {
+	select {
+	case <-w.abort:
+		return true
+	default:
+		return false
+	}
+}
+
+// storeArchive stores a single archive and adds it to the snapshot.
+func (w *snapshotWriter) storeArchive(archive *Archive) {
+	archive.Path = relPath(w.opts.CWD, archive.Path)
+	if isSpecialPath(archive.Path) {
+		return
+	}
+
+	p := newProgress(archive)
+	w.snapshot.mut.Lock()
+	p.TotalStatistics = w.snapshot.Stats
+	w.snapshot.mut.Unlock()
+	w.progress <- p
+
+	if archive.Type == File && archive.LinkTo != "" {
+		// hardlinks share the data of the archive they're linked to. They
+		// get added once it's known whether that one could be stored
+		w.linkMut.Lock()
+		w.links[archive.LinkTo] = append(w.links[archive.LinkTo], archive)
+		w.linkMut.Unlock()
+		return
+	} else if archive.Type == File {
+		w.indexMut.Lock()
+		reused := w.opts.Parent != nil && reuseParentChunks(w.opts.Parent, archive, w.chunkIndex, w.opts)
+		w.indexMut.Unlock()
+
+		if reused {
+			// the file hasn't changed since the parent snapshot
+			p.CurrentItemStats.Transferred = archive.Size
+			w.snapshot.mut.Lock()
+			w.snapshot.Stats.Transferred += archive.Size
+			p.TotalStatistics = w.snapshot.Stats
+			w.snapshot.mut.Unlock()
+			w.progress <- p
+		} else if !w.storeFile(archive, p) {
+			return
+		}
+	}
+	if w.aborted() {
+		return
+	}
+
+	w.addArchive(archive)
+}
+
+// addLinks adds the hardlinks to the snapshot. If the archive a group of
+// hardlinks is linked to couldn't be stored, the next link of the group holds
+// the data instead, so no link is left without content.
+func (w *snapshotWriter) addLinks() {
+	for target, links := range w.links {
+		w.snapshot.mut.Lock()
+		_, stored := w.snapshot.Archives[target]
+		w.snapshot.mut.Unlock()
+
+		sort.Slice(links, func(i, j int) bool {
+			return links[i].Path < links[j].Path
+		})
+		for _, link := range links {
+			if w.aborted() {
+				return
+			}
+
+			p := newProgress(link)
+			if !stored {
+				link.LinkTo = ""
+				if !w.storeFile(link, p) {
 					continue
 				}
-				archive.Encrypted = opts.Encrypt
-				archive.Compressed = opts.Compress
-
-				for cd := range chunkchan {
-					if cd.Error != nil {
-						p = newProgressError(err)
-						p.Path = archive.Path
-						progress <- p
-						if opts.Pedantic {
-							return
-						}
-						continue
-					}
-					chunk := cd.Chunk
-					// fmt.Printf("\tSplit %s (#%d, %d bytes), compression: %s, encryption: %s, hash: %s\n", id.Path, cd.Num, cd.Size, CompressionText(cd.Compressed), EncryptionText(cd.Encrypted), cd.Hash)
-
-					// store this chunk
-					n, err := repository.backend.StoreChunk(chunk)
-					if err != nil {
-						p = newProgressError(err)
-						p.Path = archive.Path
-						progress <- p
-						if opts.Pedantic {
-							return
-						}
-						continue
-					}
+				target = link.Path
+				stored = true
+			} else {
+				link.LinkTo = target
+				p.CurrentItemStats.Transferred = link.Size
+				w.snapshot.mut.Lock()
+				w.snapshot.Stats.Transferred += link.Size
+				p.TotalStatistics = w.snapshot.Stats
+				w.snapshot.mut.Unlock()
+				w.progress <- p
+			}
 
-					// release the memory, we don't need the data anymore
-					chunk.Data = &[][]byte{}
+			w.addArchive(link)
+		}
+	}
+}
 
-					archive.Chunks = append(archive.Chunks, chunk)
-					archive.StorageSize += n
+// addArchive adds a stored archive to the snapshot and the chunk-index.
+func (w *snapshotWriter) addArchive(archive *Archive) {
+	w.snapshot.mut.Lock()
+	w.snapshot.AddArchive(archive)
+	w.snapshot.mut.Unlock()
+	w.indexMut.Lock()
+	w.chunkIndex.AddArchive(archive, w.snapshot.ID)
+	w.indexMut.Unlock()
+}
 
-					p.CurrentItemStats.StorageSize = archive.StorageSize
-					p.CurrentItemStats.Transferred += uint64(chunk.OriginalSize)
-					snapshot.Stats.Transferred += uint64(chunk.OriginalSize)
-					snapshot.Stats.StorageSize += n
+// storeStream stores the data read from r as a file named path, owned by the
+// current user.
+func (w *snapshotWriter) storeStream(r io.Reader, path string) {
+	archive := &Archive{
+		Path:    path,
+		Type:    File,
+		Mode:    0600,
+		ModTime: time.Now().Unix(),
+		UID:     uint32(os.Getuid()),
+		GID:     uint32(os.Getgid()),
+	}
+	p := newProgress(archive)
+	w.progress <- p
 
-					snapshot.mut.Lock()
-					p.TotalStatistics = snapshot.Stats
-					snapshot.mut.Unlock()
-					progress <- p
+	if !w.storeChunks(archive, p, w.encoder.chunkReader(ioutil.NopCloser(r))) || w.aborted() {
+		return
+	}
+
+	// the size is only known once the entire stream has been read
+	for _, chunk := range archive.Chunks {
+		archive.Size += uint64(chunk.OriginalSize)
+	}
+	w.snapshot.mut.Lock()
+	w.snapshot.Stats.Files++
+	w.snapshot.Stats.Size += archive.Size
+	w.snapshot.mut.Unlock()
+
+	w.addArchive(archive)
+}
+
+// storeFile chunks a file and stores all chunks which aren't already part of
+// the repository. It returns false if the archive should be skipped.
+func (w *snapshotWriter) storeFile(archive *Archive, p Progress) bool {
+	chunkchan, err := w.encoder.chunkFile(archive.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// if this file has already been deleted before we could backup it, we can gracefully ignore it and continue
+			return false
+		}
+		w.fail(archive.Path, err)
+		return false
+	}
+
+	return w.storeChunks(archive, p, chunkchan)
+}
+
+// storeChunks stores all chunks received from chunkchan which aren't already
+// part of the repository, and adds them to archive. It returns false if the
+// archive should be skipped, because not all of its chunks could be stored.
+func (w *snapshotWriter) storeChunks(archive *Archive, p Progress, chunkchan <-chan ChunkResult) bool {
+	archive.Encrypted = w.opts.Encrypt
+	archive.Compressed = w.opts.Compress
+	archive.KeyGeneration = w.repository.KeyGeneration
+
+	// guards archive & p, chunks of this file get stored concurrently
+	var mut sync.Mutex
+	addChunk := func(chunk Chunk, n uint64) {
+		// release the memory, we don't need the data anymore
+		chunk.Data = &[][]byte{}
+
+		mut.Lock()
+		defer mut.Unlock()
+		if chunk.KeyGeneration < archive.KeyGeneration {
+			archive.KeyGeneration = chunk.KeyGeneration
+		}
+		archive.Chunks = append(archive.Chunks, chunk)
+		archive.StorageSize += n
+
+		p.CurrentItemStats.StorageSize = archive.StorageSize
+		p.CurrentItemStats.Transferred += uint64(chunk.OriginalSize)
+		w.snapshot.mut.Lock()
+		w.snapshot.Stats.Transferred += uint64(chunk.OriginalSize)
+		w.snapshot.Stats.StorageSize += n
+		p.TotalStatistics = w.snapshot.Stats
+		w.snapshot.mut.Unlock()
+		w.progress <- p
+	}
+
+	var uploads sync.WaitGroup
+	var failed bool
+	for cd := range chunkchan {
+		if cd.Error != nil || w.aborted() {
+			if cd.Error != nil {
+				w.fail(archive.Path, cd.Error)
+				mut.Lock()
+				failed = true
+				mut.Unlock()
+			}
+			w.encoder.release()
+			continue
+		}
+		chunk := cd.Chunk
+		// fmt.Printf("\tSplit %s (#%d, %d bytes), compression: %s, encryption: %s, hash: %s\n", id.Path, cd.Num, cd.Size, CompressionText(cd.Compressed), EncryptionText(cd.Encrypted), cd.Hash)
+
+		w.indexMut.Lock()
+		if stored, ok := w.chunkIndex.FindChunk(chunk, archive.Compressed, archive.Encrypted); ok {
+			w.indexMut.Unlock()
+			w.encoder.release()
+
+			// we already stored this content, re-use the existing chunk
+			chunk.Hash = stored.Hash
+			chunk.Size = stored.Size
+			chunk.KeyGeneration = stored.KeyGeneration
+			chunk.Parts = stored.Parts
+			addChunk(chunk, 0)
+			continue
+		}
+		pc, uploading := w.pending[chunk.Hash]
+		if !uploading {
+			pc = &pendingChunk{done: make(chan struct{})}
+			w.pending[chunk.Hash] = pc
+		}
+		w.indexMut.Unlock()
+
+		uploads.Add(1)
+		go func(chunk Chunk) {
+			defer uploads.Done()
+
+			var n uint64
+			if uploading {
+				// another file is storing the same chunk right now
+				w.encoder.release()
+				<-pc.done
+			} else {
+				// store this chunk
+				if w.packer != nil {
+					pc.parts, n, pc.err = w.packer.add(chunk)
+				} else {
+					n, pc.err = w.repository.backend.StoreChunk(chunk)
 				}
+				w.encoder.release()
+				close(pc.done)
 			}
+			if pc.err != nil {
+				w.fail(archive.Path, pc.err)
+				mut.Lock()
+				failed = true
+				mut.Unlock()
+				return
+			}
+			chunk.Parts = pc.parts
+
+			addChunk(chunk, n)
+		}(chunk)
+	}
+	uploads.Wait()
+
+	return !failed
+}
+
+// flushPacks stores the remaining pack files. Archives with chunks in pack
+// files which couldn't be stored get removed from the snapshot again.
+func (w *snapshotWriter) flushPacks() {
+	// errors get reported for each affected archive
+	_ = w.packer.flush()
+	if !w.packer.hasFailed() {
+		return
+	}
 
-			snapshot.AddArchive(archive)
-			chunkIndex.AddArchive(archive, snapshot.ID)
+	failed := make(map[string]error)
+	w.snapshot.mut.Lock()
+	for path, archive := range w.snapshot.Archives {
+		for _, chunk := range archive.Chunks {
+			if err := w.packer.failure(chunk); err != nil {
+				failed[path] = err
+				delete(w.snapshot.Archives, path)
+				break
+			}
 		}
+	}
+	// as are the hardlinks to them
+	for path, archive := range w.snapshot.Archives {
+		if err, ok := failed[archive.LinkTo]; ok && archive.LinkTo != "" {
+			failed[path] = err
+			delete(w.snapshot.Archives, path)
+		}
+	}
+	w.snapshot.mut.Unlock()
+	w.chunkIndex.removeFailedPacks(w.packer)
 
-	}()
+	for path, err := range failed {
+		w.fail(path, err)
+	}
+}
 
-	return progress
+// reuseParentChunks copies the chunks of the parent's archive with the same
+// path to archive, if the file hasn't changed since the parent snapshot. A file
+// is considered unchanged if its size, modification time, inode and change time
+// all match and the parent's chunks are still available with the requested
+// compression, encryption and redundancy. Hardlinks in the parent don't hold
+// any chunks, so they never get re-used.
+func reuseParentChunks(parent *Snapshot, archive *Archive, chunkIndex *ChunkIndex, opts StoreOptions) bool {
+	prev, ok := parent.Archives[archive.Path]
+	if !ok || prev.Type != File || prev.LinkTo != "" || len(prev.Chunks) == 0 {
+		return false
+	}
+	if prev.Size != archive.Size ||
+		prev.ModTime != archive.ModTime ||
+		prev.Inode != archive.Inode ||
+		prev.ChangeTime != archive.ChangeTime {
+		return false
+	}
+	if prev.Compressed != opts.Compress || prev.Encrypted != opts.Encrypt {
+		return false
+	}
+
+	dataParts := uint(math.Max(1, float64(opts.DataParts)))
+	for _, chunk := range prev.Chunks {
+		if chunk.DataParts != dataParts || chunk.ParityParts != opts.ParityParts {
+			return false
+		}
+		if _, ok := chunkIndex.Chunks[chunk.Hash]; !ok {
+			// the chunk has been deleted in the meantime
+			return false
+		}
+	}
+
+	archive.Chunks = make([]Chunk, len(prev.Chunks))
+	copy(archive.Chunks, prev.Chunks)
+	archive.Encrypted = prev.Encrypted
+	archive.Compressed = prev.Compressed
+	archive.KeyGeneration = prev.KeyGeneration
+	return true
 }
 
 // Clone clones a snapshot.
@@ -232,6 +702,8 @@ func (snapshot *Snapshot) Clone() (*Snapshot, error) {
 		return s, err
 	}
 
+	s.Paths = append([]string{}, snapshot.Paths...)
+	s.Tags = append([]string{}, snapshot.Tags...)
 	s.Stats = snapshot.Stats
 	s.Archives = snapshot.Archives
 
@@ -247,17 +719,13 @@ func openSnapshot(id string, repository *Repository) (*Snapshot, error) {
 	if err != nil {
 		return &snapshot, err
 	}
-	pipe, err := NewDecodingPipeline(CompressionLZMA, EncryptionAES, repository.Key)
-	if err != nil {
-		return &snapshot, err
-	}
-	err = pipe.Decode(b, &snapshot)
+	err = repository.decodeMetadata(b, &snapshot)
 	return &snapshot, err
 }
 
 // Save writes a snapshot's metadata.
 func (snapshot *Snapshot) Save(repository *Repository) error {
-	pipe, err := NewEncodingPipeline(CompressionLZMA, EncryptionAES, repository.Key)
+	pipe, err := NewEncodingPipeline(CompressionLZMA, metadataEncryption, repository.Key)
 	if err != nil {
 		return err
 	}
@@ -268,6 +736,74 @@ func (snapshot *Snapshot) Save(repository *Repository) error {
 	return repository.backend.SaveSnapshot(snapshot.ID, b)
 }
 
+// ContentArchive returns the archive containing the data of arc. For
+// hardlinks that's the archive they're linked to, otherwise arc itself.
+func (snapshot *Snapshot) ContentArchive(arc *Archive) (*Archive, error) {
+	if arc.LinkTo == "" {
+		return arc, nil
+	}
+
+	target, ok := snapshot.Archives[arc.LinkTo]
+	if !ok {
+		return nil, ErrHardlinkTargetMissing
+	}
+	return target, nil
+}
+
+// addPaths records source paths of a snapshot, ignoring the ones already
+// recorded.
+func (snapshot *Snapshot) addPaths(paths ...string) {
+	for _, path := range paths {
+		found := false
+		for _, p := range snapshot.Paths {
+			if p == path {
+				found = true
+				break
+			}
+		}
+		if !found {
+			snapshot.Paths = append(snapshot.Paths, path)
+		}
+	}
+}
+
+// HasTag returns true if the snapshot is tagged with tag.
+func (snapshot *Snapshot) HasTag(tag string) bool {
+	for _, t := range snapshot.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// AddTags adds tags to a snapshot, ignoring the ones it already has.
+func (snapshot *Snapshot) AddTags(tags ...string) {
+	for _, tag := range tags {
+		if !snapshot.HasTag(tag) {
+			snapshot.Tags = append(snapshot.Tags, tag)
+		}
+	}
+}
+
+// RemoveTags removes tags from a snapshot.
+func (snapshot *Snapshot) RemoveTags(tags ...string) {
+	var kept []string
+	for _, t := range snapshot.Tags {
+		remove := false
+		for _, tag := range tags {
+			if t == tag {
+				remove = true
+				break
+			}
+		}
+		if !remove {
+			kept = append(kept, t)
+		}
+	}
+	snapshot.Tags = kept
+}
+
 // AddArchive adds an archive to a snapshot.
 func (snapshot *Snapshot) AddArchive(archive *Archive) {
 	snapshot.Archives[archive.Path] = archive
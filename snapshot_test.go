@@ -9,11 +9,14 @@
 package knoxite
 
 import (
+	"bytes"
+	"crypto/rand"
 	"encoding/hex"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/minio/highwayhash"
 	"github.com/muesli/combinator"
@@ -200,7 +203,7 @@ func TestSnapshotCreate(t *testing.T) {
 			}
 			defer os.RemoveAll(targetdir)
 
-			progress, err := DecodeSnapshot(r, snapshot, targetdir, tt.ExcludesRestore, false)
+			progress, err := DecodeSnapshot(r, snapshot, targetdir, RestoreOptions{Excludes: tt.ExcludesRestore})
 			if err != nil {
 				t.Errorf("Failed restoring snapshot: %s", err)
 				return
@@ -306,3 +309,399 @@ func TestSnapshotFind(t *testing.T) {
 		t.Errorf("Failed finding latest snapshot: %s %s", err, snapshot.ID)
 	}
 }
+
+func TestSnapshotParent(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	sourcedir, err := ioutil.TempDir("", "knoxite.source")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for source: %s", err)
+		return
+	}
+	defer os.RemoveAll(sourcedir)
+
+	for _, name := range []string{"a", "b"} {
+		err = ioutil.WriteFile(filepath.Join(sourcedir, name), []byte("unchanged content "+name), 0644)
+		if err != nil {
+			t.Errorf("Failed writing source file: %s", err)
+			return
+		}
+	}
+
+	// archive paths are relative to the working dir
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Failed getting working dir: %s", err)
+		return
+	}
+	err = os.Chdir(sourcedir)
+	if err != nil {
+		t.Errorf("Failed changing working dir: %s", err)
+		return
+	}
+	defer func() {
+		_ = os.Chdir(wd)
+	}()
+
+	r, err := NewRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+	index, err := OpenChunkIndex(&r)
+	if err != nil {
+		t.Errorf("Failed opening chunk-index: %s", err)
+		return
+	}
+
+	store := func(parent *Snapshot) *Snapshot {
+		snapshot, _ := NewSnapshot("test_snapshot")
+		opts := StoreOptions{
+			CWD:       sourcedir,
+			Paths:     []string{sourcedir},
+			Compress:  CompressionNone,
+			Encrypt:   EncryptionAES,
+			DataParts: 1,
+			Parent:    parent,
+		}
+
+		for p := range snapshot.Add(r, &index, opts) {
+			if p.Error != nil {
+				t.Errorf("Failed adding to snapshot: %s", p.Error)
+			}
+		}
+		return snapshot
+	}
+
+	parent := store(nil)
+	if len(parent.Archives["a"].Chunks) != 1 || parent.Archives["a"].Inode == 0 {
+		t.Errorf("Unexpected archive in parent snapshot: %+v", parent.Archives["a"])
+		return
+	}
+
+	// mark the parent's chunks, so we can tell whether they got re-used
+	// instead of reading the file again
+	for _, name := range []string{"a", "b"} {
+		parent.Archives[name].Chunks[0].DecryptedHash = "from_parent"
+	}
+
+	// b changes, but keeps its size and modification time. Filesystems update
+	// timestamps with a coarse granularity, so give its change time a chance
+	// to advance
+	time.Sleep(20 * time.Millisecond)
+	fi, _ := os.Stat(filepath.Join(sourcedir, "b"))
+	err = ioutil.WriteFile(filepath.Join(sourcedir, "b"), []byte("modified  content b"), 0644)
+	if err != nil {
+		t.Errorf("Failed modifying source file: %s", err)
+		return
+	}
+	_ = os.Chtimes(filepath.Join(sourcedir, "b"), fi.ModTime(), fi.ModTime())
+
+	snapshot := store(parent)
+	if h := snapshot.Archives["a"].Chunks[0].DecryptedHash; h != "from_parent" {
+		t.Errorf("Expected chunks of unchanged file to be re-used, got %s", h)
+	}
+	if h := snapshot.Archives["b"].Chunks[0].DecryptedHash; h == "from_parent" {
+		t.Errorf("Expected changed file to be read again")
+	}
+	if snapshot.Stats.Transferred != snapshot.Stats.Size {
+		t.Errorf("Expected %d bytes to be transferred, got %d", snapshot.Stats.Size, snapshot.Stats.Transferred)
+	}
+
+	// without a parent all files get read again
+	snapshot = store(nil)
+	if h := snapshot.Archives["a"].Chunks[0].DecryptedHash; h == "from_parent" {
+		t.Errorf("Expected file to be read again without a parent snapshot")
+	}
+}
+
+func TestSnapshotParallel(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	sourcedir, err := ioutil.TempDir("", "knoxite.source")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for source: %s", err)
+		return
+	}
+	defer os.RemoveAll(sourcedir)
+
+	// every other file has the same content, so identical chunks get stored
+	// concurrently
+	shared := make([]byte, 3<<20)
+	_, _ = rand.Read(shared)
+	var names []string
+	for i := 0; i < 12; i++ {
+		data := shared
+		if i%2 == 1 {
+			data = make([]byte, 1<<20+i)
+			_, _ = rand.Read(data)
+		}
+
+		name := filepath.Join(sourcedir, string(rune('a'+i)))
+		err = ioutil.WriteFile(name, data, 0644)
+		if err != nil {
+			t.Errorf("Failed writing source file: %s", err)
+			return
+		}
+		names = append(names, name)
+	}
+
+	// archive paths are relative to the working dir
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Failed getting working dir: %s", err)
+		return
+	}
+	err = os.Chdir(sourcedir)
+	if err != nil {
+		t.Errorf("Failed changing working dir: %s", err)
+		return
+	}
+	defer func() {
+		_ = os.Chdir(wd)
+	}()
+
+	r, err := NewRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+	index, err := OpenChunkIndex(&r)
+	if err != nil {
+		t.Errorf("Failed opening chunk-index: %s", err)
+		return
+	}
+
+	snapshot, _ := NewSnapshot("test_snapshot")
+	opts := StoreOptions{
+		CWD:        sourcedir,
+		Paths:      []string{sourcedir},
+		Compress:   CompressionNone,
+		Encrypt:    EncryptionAES,
+		Jobs:       4,
+		EncodeJobs: 2,
+		UploadJobs: 2,
+		// just enough memory for a single chunk at a time
+		MemoryLimit: 1,
+	}
+	for p := range snapshot.Add(r, &index, opts) {
+		if p.Error != nil {
+			t.Errorf("Failed adding to snapshot: %s", p.Error)
+		}
+	}
+
+	if snapshot.Stats.Transferred != snapshot.Stats.Size {
+		t.Errorf("Expected %d bytes to be transferred, got %d", snapshot.Stats.Size, snapshot.Stats.Transferred)
+	}
+
+	targetdir, err := ioutil.TempDir("", "knoxite.target")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for restore: %s", err)
+		return
+	}
+	defer os.RemoveAll(targetdir)
+
+	progress, err := DecodeSnapshot(r, snapshot, targetdir, RestoreOptions{})
+	if err != nil {
+		t.Errorf("Failed restoring snapshot: %s", err)
+		return
+	}
+	for p := range progress {
+		if p.Error != nil {
+			t.Errorf("Failed restoring snapshot: %s", p.Error)
+		}
+	}
+
+	for _, name := range names {
+		rel, _ := filepath.Rel(sourcedir, name)
+		hash1, err := hashFile(filepath.Join(targetdir, rel))
+		if err != nil {
+			t.Errorf("Failed generating shasum for %s: %s", rel, err)
+			return
+		}
+		hash2, err := hashFile(name)
+		if err != nil {
+			t.Errorf("Failed generating shasum for %s: %s", name, err)
+			return
+		}
+		if hash1 != hash2 {
+			t.Errorf("Failed verifying shasum of %s: %s != %s", rel, hash1, hash2)
+		}
+	}
+}
+
+func TestSnapshotStdin(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+	index, err := OpenChunkIndex(&r)
+	if err != nil {
+		t.Errorf("Failed opening chunk-index: %s", err)
+		return
+	}
+
+	data := make([]byte, 3<<20)
+	_, _ = rand.Read(data)
+
+	snapshot, _ := NewSnapshot("test_snapshot")
+	opts := StoreOptions{
+		CWD:           dir,
+		Compress:      CompressionNone,
+		Encrypt:       EncryptionAES,
+		Stdin:         bytes.NewReader(data),
+		StdinFilename: "db.sql",
+	}
+	for p := range snapshot.Add(r, &index, opts) {
+		if p.Error != nil {
+			t.Errorf("Failed adding to snapshot: %s", p.Error)
+		}
+	}
+
+	arc, ok := snapshot.Archives["db.sql"]
+	if !ok {
+		t.Errorf("Expected archive db.sql in snapshot")
+		return
+	}
+	if arc.Type != File || arc.Size != uint64(len(data)) {
+		t.Errorf("Expected file of %d bytes, got type %d with %d bytes", len(data), arc.Type, arc.Size)
+	}
+	if snapshot.Stats.Files != 1 || snapshot.Stats.Size != uint64(len(data)) {
+		t.Errorf("Unexpected snapshot stats: %s", snapshot.Stats.String())
+	}
+
+	var buf bytes.Buffer
+	err = WriteArchiveData(&buf, r, *arc)
+	if err != nil {
+		t.Errorf("Failed reading archive data: %s", err)
+		return
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("Restored data differs from data read from stdin")
+	}
+}
+
+func TestSnapshotHardlinkTargetFailed(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	sourcedir, err := ioutil.TempDir("", "knoxite.source")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for source: %s", err)
+		return
+	}
+	defer os.RemoveAll(sourcedir)
+
+	_ = ioutil.WriteFile(filepath.Join(sourcedir, "b"), []byte("content"), 0644)
+	if err := os.Link(filepath.Join(sourcedir, "b"), filepath.Join(sourcedir, "c")); err != nil {
+		t.Skipf("Filesystem doesn't support hardlinks: %s", err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Failed getting working dir: %s", err)
+		return
+	}
+	err = os.Chdir(sourcedir)
+	if err != nil {
+		t.Errorf("Failed changing working dir: %s", err)
+		return
+	}
+	defer func() {
+		_ = os.Chdir(wd)
+	}()
+
+	r, _ := NewRepository(dir, testPassword)
+	index, _ := OpenChunkIndex(&r)
+	snapshot, _ := NewSnapshot("test_snapshot")
+	opts := StoreOptions{CWD: sourcedir}.withDefaults()
+	encoder, err := newChunkEncoder(&r, opts)
+	if err != nil {
+		t.Errorf("Failed creating chunk encoder: %s", err)
+		return
+	}
+	defer encoder.close()
+
+	progress := make(chan Progress)
+	go func() {
+		for range progress {
+		}
+	}()
+	defer close(progress)
+	w := &snapshotWriter{
+		snapshot:   snapshot,
+		repository: &r,
+		chunkIndex: &index,
+		opts:       opts,
+		encoder:    encoder,
+		progress:   progress,
+		pending:    make(map[string]*pendingChunk),
+		links:      make(map[string][]*Archive),
+		abort:      make(chan struct{}),
+	}
+
+	// the file the others are linked to vanished before it could be stored
+	w.storeArchive(&Archive{Path: "a", Type: File, Size: 7})
+	w.storeArchive(&Archive{Path: "c", Type: File, Size: 7, LinkTo: "a"})
+	w.storeArchive(&Archive{Path: "b", Type: File, Size: 7, LinkTo: "a"})
+	w.addLinks()
+
+	if _, ok := snapshot.Archives["a"]; ok {
+		t.Errorf("Expected a to be missing from the snapshot")
+	}
+	if arc := snapshot.Archives["b"]; arc == nil || arc.LinkTo != "" || len(arc.Chunks) == 0 {
+		t.Errorf("Expected b to contain the data, got %+v", arc)
+	}
+	if arc := snapshot.Archives["c"]; arc == nil || arc.LinkTo != "b" {
+		t.Errorf("Expected c to be a hardlink to b, got %+v", arc)
+	}
+}
+
+func TestReuseParentHardlink(t *testing.T) {
+	index := ChunkIndex{Chunks: map[string]*ChunkIndexItem{"1": {Hash: "1"}}}
+	opts := StoreOptions{Compress: CompressionNone, Encrypt: EncryptionNone}.withDefaults()
+	chunks := []Chunk{{Hash: "1", DataParts: 1}}
+
+	parent := &Snapshot{Archives: map[string]*Archive{
+		"a": {Path: "a", Type: File, Size: 7, ModTime: 1, Inode: 2, Chunks: chunks},
+		"b": {Path: "b", Type: File, Size: 7, ModTime: 1, Inode: 2, LinkTo: "a"},
+	}}
+	for path, reused := range map[string]bool{"a": true, "b": false} {
+		archive := &Archive{Path: path, Type: File, Size: 7, ModTime: 1, Inode: 2}
+		if reuseParentChunks(parent, archive, &index, opts) != reused {
+			t.Errorf("Expected chunks of %s to be re-used: %v", path, reused)
+		}
+		if reused && len(archive.Chunks) != len(chunks) {
+			t.Errorf("Expected %s to get %d chunks, got %d", path, len(chunks), len(archive.Chunks))
+		}
+	}
+}
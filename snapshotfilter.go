@@ -0,0 +1,65 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"path/filepath"
+)
+
+// A SnapshotFilter selects snapshots by their metadata. Empty fields match
+// all snapshots.
+type SnapshotFilter struct {
+	// Hosts matches snapshots created on any of these hosts
+	Hosts []string
+	// Tags matches snapshots tagged with all of these tags
+	Tags []string
+	// Paths matches snapshots containing all of these source paths
+	Paths []string
+}
+
+// IsEmpty returns true if the filter matches all snapshots.
+func (f SnapshotFilter) IsEmpty() bool {
+	return len(f.Hosts) == 0 && len(f.Tags) == 0 && len(f.Paths) == 0
+}
+
+// Match returns true if snapshot is selected by the filter.
+func (f SnapshotFilter) Match(snapshot *Snapshot) bool {
+	if len(f.Hosts) > 0 {
+		found := false
+		for _, host := range f.Hosts {
+			if host == snapshot.Hostname {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for _, tag := range f.Tags {
+		if !snapshot.HasTag(tag) {
+			return false
+		}
+	}
+
+	for _, path := range f.Paths {
+		found := false
+		for _, p := range snapshot.Paths {
+			if filepath.Clean(p) == filepath.Clean(path) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,120 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapshotTags(t *testing.T) {
+	snapshot, err := NewSnapshot("test_snapshot")
+	if err != nil {
+		t.Errorf("Failed creating snapshot: %s", err)
+		return
+	}
+	if hostname, _ := os.Hostname(); snapshot.Hostname != hostname {
+		t.Errorf("Expected hostname %s, got %s", hostname, snapshot.Hostname)
+	}
+
+	snapshot.AddTags("daily", "home", "daily")
+	if !reflect.DeepEqual(snapshot.Tags, []string{"daily", "home"}) {
+		t.Errorf("Expected tags [daily home], got %v", snapshot.Tags)
+	}
+	snapshot.RemoveTags("daily", "missing")
+	if !reflect.DeepEqual(snapshot.Tags, []string{"home"}) {
+		t.Errorf("Expected tags [home], got %v", snapshot.Tags)
+	}
+	if snapshot.HasTag("daily") || !snapshot.HasTag("home") {
+		t.Errorf("Unexpected tags %v", snapshot.Tags)
+	}
+}
+
+func TestSnapshotFilter(t *testing.T) {
+	snapshot := &Snapshot{
+		Hostname: "alpha",
+		Paths:    []string{"/home/alice", "/etc"},
+		Tags:     []string{"daily", "home"},
+	}
+
+	tests := []struct {
+		filter SnapshotFilter
+		match  bool
+	}{
+		{SnapshotFilter{}, true},
+		{SnapshotFilter{Hosts: []string{"alpha"}}, true},
+		{SnapshotFilter{Hosts: []string{"beta", "alpha"}}, true},
+		{SnapshotFilter{Hosts: []string{"beta"}}, false},
+		{SnapshotFilter{Tags: []string{"daily", "home"}}, true},
+		{SnapshotFilter{Tags: []string{"daily", "weekly"}}, false},
+		{SnapshotFilter{Paths: []string{"/home/alice/"}}, true},
+		{SnapshotFilter{Paths: []string{"/home"}}, false},
+		{SnapshotFilter{Hosts: []string{"alpha"}, Tags: []string{"weekly"}}, false},
+	}
+	for _, tt := range tests {
+		if match := tt.filter.Match(snapshot); match != tt.match {
+			t.Errorf("Expected filter %+v matching to be %v, got %v", tt.filter, tt.match, match)
+		}
+	}
+}
+
+func TestFindLatestSnapshot(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository(dir, testPassword)
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+
+	var ids []string
+	for i, host := range []string{"alpha", "beta", "alpha", "beta"} {
+		snapshot, _ := NewSnapshot("test_snapshot")
+		snapshot.Date = snapshot.Date.Add(time.Duration(i-5) * time.Hour)
+		snapshot.Hostname = host
+		if i < 2 {
+			snapshot.AddTags("old")
+		}
+		_ = snapshot.Save(&r)
+		_ = vol.AddSnapshot(snapshot.ID)
+		ids = append(ids, snapshot.ID)
+	}
+
+	tests := []struct {
+		filter SnapshotFilter
+		id     string
+	}{
+		{SnapshotFilter{}, ids[3]},
+		{SnapshotFilter{Hosts: []string{"alpha"}}, ids[2]},
+		{SnapshotFilter{Tags: []string{"old"}}, ids[1]},
+		{SnapshotFilter{Hosts: []string{"alpha"}, Tags: []string{"old"}}, ids[0]},
+	}
+	for _, tt := range tests {
+		_, snapshot, err := r.FindLatestSnapshot(tt.filter)
+		if err != nil {
+			t.Errorf("Failed finding snapshot: %s", err)
+			continue
+		}
+		if snapshot.ID != tt.id {
+			t.Errorf("Expected snapshot %s for filter %+v, got %s", tt.id, tt.filter, snapshot.ID)
+		}
+	}
+
+	_, _, err = r.FindLatestSnapshot(SnapshotFilter{Hosts: []string{"gamma"}})
+	if err != ErrSnapshotNotFound {
+		t.Errorf("Expected %v, got %v", ErrSnapshotNotFound, err)
+	}
+}
@@ -0,0 +1,222 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error declarations.
+var (
+	ErrInvalidSnapshotRef = errors.New("invalid snapshot reference")
+)
+
+// Date formats accepted by ParseDate.
+const (
+	DateTimeFormat = "2006-01-02 15:04:05"
+	DateFormat     = "2006-01-02"
+)
+
+// ParseDate parses a date in the local timezone, with or without a time.
+func ParseDate(s string) (time.Time, error) {
+	t, err := time.ParseInLocation(DateTimeFormat, s, time.Local)
+	if err != nil {
+		t, err = time.ParseInLocation(DateFormat, s, time.Local)
+	}
+	if err != nil {
+		return t, fmt.Errorf("invalid date %s, use YYYY-MM-DD or YYYY-MM-DD HH:MM:SS", s)
+	}
+	return t, nil
+}
+
+// A snapshotRef is a parsed snapshot reference, see ResolveSnapshot.
+type snapshotRef struct {
+	volume string
+	// base is either a snapshot ID, "latest" or empty if before is set
+	base   string
+	before time.Time
+	offset int
+}
+
+// parseSnapshotRef parses references of the form [volume:]base[~n], where
+// base is a snapshot ID, "latest" or "@" followed by a date.
+func parseSnapshotRef(s string) (snapshotRef, error) {
+	var r snapshotRef
+	ref := s
+
+	// dates can contain colons as well
+	at := strings.Index(ref, "@")
+	if colon := strings.Index(ref, ":"); colon >= 0 && (at < 0 || colon < at) {
+		r.volume = ref[:colon]
+		ref = ref[colon+1:]
+		if r.volume == "" {
+			return r, fmt.Errorf("%w %s: missing volume", ErrInvalidSnapshotRef, s)
+		}
+	}
+
+	if i := strings.LastIndex(ref, "~"); i >= 0 {
+		r.offset = 1
+		if n := ref[i+1:]; n != "" {
+			var err error
+			r.offset, err = strconv.Atoi(n)
+			if err != nil || r.offset < 0 {
+				return r, fmt.Errorf("%w %s: invalid offset %s", ErrInvalidSnapshotRef, s, n)
+			}
+		}
+		ref = ref[:i]
+	}
+
+	if strings.HasPrefix(ref, "@") {
+		t, err := ParseDate(ref[1:])
+		if err != nil {
+			return r, fmt.Errorf("%w %s: %v", ErrInvalidSnapshotRef, s, err)
+		}
+		if len(ref[1:]) == len(DateFormat) {
+			// a date without a time includes the entire day
+			t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		r.before = t
+		return r, nil
+	}
+
+	if ref == "" {
+		return r, fmt.Errorf("%w %s: missing snapshot", ErrInvalidSnapshotRef, s)
+	}
+	r.base = ref
+	return r, nil
+}
+
+// A datedSnapshot is a snapshot ID together with the volume it belongs to
+// and its date.
+type datedSnapshot struct {
+	volume *Volume
+	id     string
+	date   time.Time
+}
+
+// datedSnapshots returns the snapshots of volumes, from the oldest to the
+// most recent one. Snapshots only get loaded if their date is unknown.
+// Snapshots which can't be loaded are skipped.
+func (r *Repository) datedSnapshots(volumes []*Volume) []datedSnapshot {
+	var snapshots []datedSnapshot
+	for _, volume := range volumes {
+		for _, id := range volume.Snapshots {
+			date, ok := volume.Dates[id]
+			if !ok {
+				snapshot, err := volume.LoadSnapshot(id, r)
+				if err != nil {
+					continue
+				}
+
+				// remember the date, it gets stored the next time the
+				// repository gets saved
+				date = snapshot.Date
+				volume.setSnapshotDate(id, date)
+			}
+
+			snapshots = append(snapshots, datedSnapshot{volume, id, date})
+		}
+	}
+
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].date.Before(snapshots[j].date)
+	})
+	return snapshots
+}
+
+// ResolveSnapshot finds the snapshot a reference points to. References are
+// of the form [volume:]base[~n]:
+//
+//   - volume is the ID or name of the volume to look in, all volumes if omitted
+//   - base is a snapshot ID, "latest" or "@" followed by a date, selecting
+//     the most recent snapshot made at that time or before
+//   - ~n selects the snapshot made n snapshots before base, ~ alone is ~1
+//
+// Apart from plain snapshot IDs, only snapshots matching filter are
+// considered.
+func (r *Repository) ResolveSnapshot(ref string, filter SnapshotFilter) (*Volume, *Snapshot, error) {
+	sr, err := parseSnapshotRef(ref)
+	if err != nil {
+		return &Volume{}, &Snapshot{}, err
+	}
+
+	volumes := r.Volumes
+	if sr.volume != "" {
+		volume, err := r.FindVolume(sr.volume)
+		if err != nil {
+			return &Volume{}, &Snapshot{}, err
+		}
+		volumes = []*Volume{volume}
+	}
+
+	if sr.base != "" && sr.base != "latest" {
+		var volume *Volume
+		for _, v := range volumes {
+			for _, id := range v.Snapshots {
+				if id == sr.base {
+					volume = v
+				}
+			}
+		}
+		if volume == nil {
+			return &Volume{}, &Snapshot{}, ErrSnapshotNotFound
+		}
+		if sr.offset == 0 {
+			snapshot, err := volume.LoadSnapshot(sr.base, r)
+			return volume, snapshot, err
+		}
+		// relative references stay within the volume
+		volumes = []*Volume{volume}
+	}
+
+	snapshots := r.datedSnapshots(volumes)
+
+	pos := -1
+	for i, s := range snapshots {
+		switch {
+		case sr.base == "latest":
+			pos = i
+		case sr.base != "":
+			if s.id == sr.base {
+				pos = i
+			}
+		case !s.date.After(sr.before):
+			pos = i
+		}
+	}
+
+	// walk back from base, only loading the snapshots needed to apply the
+	// filter
+	offset := sr.offset
+	for ; pos >= 0; pos-- {
+		s := snapshots[pos]
+		var snapshot *Snapshot
+		if !filter.IsEmpty() && s.id != sr.base {
+			snapshot, err = s.volume.LoadSnapshot(s.id, r)
+			if err != nil || !filter.Match(snapshot) {
+				continue
+			}
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+
+		if snapshot == nil {
+			snapshot, err = s.volume.LoadSnapshot(s.id, r)
+		}
+		return s.volume, snapshot, err
+	}
+
+	return &Volume{}, &Snapshot{}, ErrSnapshotNotFound
+}
@@ -0,0 +1,129 @@
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseSnapshotRef(t *testing.T) {
+	day, _ := ParseDate("2021-10-01")
+	endOfDay := day.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	noon, _ := ParseDate("2021-10-01 12:00:00")
+
+	tests := []struct {
+		ref      string
+		expected snapshotRef
+	}{
+		{"abcd1234", snapshotRef{base: "abcd1234"}},
+		{"latest", snapshotRef{base: "latest"}},
+		{"vol:latest", snapshotRef{volume: "vol", base: "latest"}},
+		{"latest~2", snapshotRef{base: "latest", offset: 2}},
+		{"abcd1234~", snapshotRef{base: "abcd1234", offset: 1}},
+		{"@2021-10-01", snapshotRef{before: endOfDay}},
+		{"vol:@2021-10-01 12:00:00~1", snapshotRef{volume: "vol", before: noon, offset: 1}},
+	}
+	for _, tt := range tests {
+		r, err := parseSnapshotRef(tt.ref)
+		if err != nil {
+			t.Errorf("Failed parsing %s: %s", tt.ref, err)
+			continue
+		}
+		if r != tt.expected {
+			t.Errorf("Expected %s to be parsed as %+v, got %+v", tt.ref, tt.expected, r)
+		}
+	}
+
+	for _, ref := range []string{"", ":latest", "vol:", "latest~x", "latest~-1", "@yesterday"} {
+		if _, err := parseSnapshotRef(ref); !errors.Is(err, ErrInvalidSnapshotRef) {
+			t.Errorf("Expected %v for %q, got %v", ErrInvalidSnapshotRef, ref, err)
+		}
+	}
+}
+
+func TestResolveSnapshot(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, _ := NewRepository(dir, testPassword)
+	home, _ := NewVolume("home", "")
+	etc, _ := NewVolume("etc", "")
+	_ = r.AddVolume(home)
+	_ = r.AddVolume(etc)
+
+	start, _ := ParseDate("2021-10-01 08:00:00")
+	var ids []string
+	for i := 0; i < 6; i++ {
+		snapshot, _ := NewSnapshot("test_snapshot")
+		snapshot.Date = start.Add(time.Duration(i) * 12 * time.Hour)
+		if i%3 == 0 {
+			snapshot.AddTags("weekly")
+		}
+		_ = snapshot.Save(&r)
+
+		// the volume of every third snapshot is etc
+		vol := home
+		if i%3 == 2 {
+			vol = etc
+		}
+		_ = vol.AddSnapshotWithDate(snapshot)
+		ids = append(ids, snapshot.ID)
+	}
+	// volumes of older repositories don't know the dates of their snapshots
+	etc.Dates = nil
+
+	tests := []struct {
+		ref    string
+		filter SnapshotFilter
+		id     string
+	}{
+		{ids[1], SnapshotFilter{}, ids[1]},
+		{"latest", SnapshotFilter{}, ids[5]},
+		{"latest~1", SnapshotFilter{}, ids[4]},
+		{"etc:latest", SnapshotFilter{}, ids[5]},
+		{"home:latest", SnapshotFilter{}, ids[4]},
+		{home.ID + ":latest~2", SnapshotFilter{}, ids[1]},
+		{ids[4] + "~1", SnapshotFilter{}, ids[3]},
+		{"@2021-10-01", SnapshotFilter{}, ids[1]},
+		{"@2021-10-02 08:00:00", SnapshotFilter{}, ids[2]},
+		{"etc:@2021-10-02", SnapshotFilter{}, ids[2]},
+		{"latest", SnapshotFilter{Tags: []string{"weekly"}}, ids[3]},
+		{"latest~1", SnapshotFilter{Tags: []string{"weekly"}}, ids[0]},
+	}
+	for _, tt := range tests {
+		_, snapshot, err := r.ResolveSnapshot(tt.ref, tt.filter)
+		if err != nil {
+			t.Errorf("Failed resolving %s: %s", tt.ref, err)
+			continue
+		}
+		if snapshot.ID != tt.id {
+			t.Errorf("Expected %s to resolve to %s, got %s", tt.ref, tt.id, snapshot.ID)
+		}
+	}
+
+	// missing dates got looked up
+	if len(etc.Dates) != 2 {
+		t.Errorf("Expected the dates of 2 snapshots to be known, got %d", len(etc.Dates))
+	}
+
+	for _, ref := range []string{"latest~6", "@2021-09-30", "unknown", "etc:" + ids[0], "unknown:latest"} {
+		if _, _, err := r.ResolveSnapshot(ref, SnapshotFilter{}); err == nil {
+			t.Errorf("Expected resolving %s to fail", ref)
+		}
+	}
+}
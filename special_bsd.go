@@ -0,0 +1,21 @@
+// +build darwin dragonfly netbsd openbsd
+
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import "golang.org/x/sys/unix"
+
+func mkdev(path string, mode uint32, dev uint64) error {
+	return unix.Mknod(path, mode, int(dev))
+}
+
+// mksock fails, as sockets can't be created with mknod on this platform.
+func mksock(path string, mode uint32) error {
+	return ErrSpecialFileUnsupported
+}
@@ -0,0 +1,20 @@
+// +build linux
+
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import "golang.org/x/sys/unix"
+
+func mkdev(path string, mode uint32, dev uint64) error {
+	return unix.Mknod(path, mode, int(dev))
+}
+
+func mksock(path string, mode uint32) error {
+	return unix.Mknod(path, mode|unix.S_IFSOCK, 0)
+}
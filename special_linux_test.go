@@ -0,0 +1,124 @@
+// +build linux
+
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSpecialFiles(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	sourcedir, err := ioutil.TempDir("", "knoxite.source")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for source: %s", err)
+		return
+	}
+	defer os.RemoveAll(sourcedir)
+
+	expected := map[string]uint8{"fifo": FIFO}
+	if err := unix.Mkfifo(filepath.Join(sourcedir, "fifo"), 0640); err != nil {
+		t.Errorf("Failed creating FIFO: %s", err)
+		return
+	}
+	if os.Geteuid() == 0 {
+		// same as /dev/null
+		err := unix.Mknod(filepath.Join(sourcedir, "null"), unix.S_IFCHR|0666, int(unix.Mkdev(1, 3)))
+		if err != nil {
+			t.Errorf("Failed creating device node: %s", err)
+			return
+		}
+		expected["null"] = CharDevice
+	}
+
+	// archive paths are relative to the working dir
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Failed getting working dir: %s", err)
+		return
+	}
+	err = os.Chdir(sourcedir)
+	if err != nil {
+		t.Errorf("Failed changing working dir: %s", err)
+		return
+	}
+	defer func() {
+		_ = os.Chdir(wd)
+	}()
+
+	r, _ := NewRepository(dir, testPassword)
+	index, _ := OpenChunkIndex(&r)
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+
+	var paths []string
+	for path := range expected {
+		paths = append(paths, path)
+	}
+	snapshot := storePackedSnapshot(t, &r, vol, &index, paths)
+	for path, typ := range expected {
+		arc, ok := snapshot.Archives[path]
+		if !ok || arc.Type != typ {
+			t.Errorf("Expected %s to be stored as type %d, got %+v", path, typ, arc)
+		}
+	}
+	if arc, ok := snapshot.Archives["null"]; ok {
+		if arc.DevMajor != 1 || arc.DevMinor != 3 {
+			t.Errorf("Expected device number 1, 3, got %d, %d", arc.DevMajor, arc.DevMinor)
+		}
+	}
+
+	targetdir, err := ioutil.TempDir("", "knoxite.target")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for restore: %s", err)
+		return
+	}
+	defer os.RemoveAll(targetdir)
+
+	progress, err := DecodeSnapshot(r, snapshot, targetdir, RestoreOptions{})
+	if err != nil {
+		t.Errorf("Failed restoring snapshot: %s", err)
+		return
+	}
+	for p := range progress {
+		if p.Error != nil {
+			t.Errorf("Failed restoring snapshot: %s", p.Error)
+		}
+	}
+
+	for path := range expected {
+		src, _ := os.Lstat(filepath.Join(sourcedir, path))
+		fi, err := os.Lstat(filepath.Join(targetdir, path))
+		if err != nil {
+			t.Errorf("Failed to stat %s: %s", path, err)
+			continue
+		}
+		if fi.Mode() != src.Mode() {
+			t.Errorf("Expected mode of %s to be %s, got %s", path, src.Mode(), fi.Mode())
+		}
+
+		st, _ := toStatT(fi.Sys())
+		srcSt, _ := toStatT(src.Sys())
+		if st.rdev() != srcSt.rdev() {
+			t.Errorf("Expected device number of %s to be %d, got %d", path, srcSt.rdev(), st.rdev())
+		}
+	}
+}
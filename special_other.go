@@ -0,0 +1,20 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+// mknod isn't supported on this platform.
+func mknod(path string, arc Archive) error {
+	return ErrSpecialFileUnsupported
+}
+
+// deviceNumbers isn't supported on this platform.
+func deviceNumbers(rdev uint64) (uint32, uint32) {
+	return 0, 0
+}
@@ -0,0 +1,43 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mknod creates the device node, FIFO or socket described by arc at path.
+func mknod(path string, arc Archive) error {
+	mode := uint32(arc.Mode.Perm())
+
+	var err error
+	switch arc.Type {
+	case CharDevice:
+		err = mkdev(path, mode|unix.S_IFCHR, unix.Mkdev(arc.DevMajor, arc.DevMinor))
+	case BlockDevice:
+		err = mkdev(path, mode|unix.S_IFBLK, unix.Mkdev(arc.DevMajor, arc.DevMinor))
+	case FIFO:
+		err = unix.Mkfifo(path, mode)
+	case Socket:
+		err = mksock(path, mode)
+	}
+	if err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+	return nil
+}
+
+// deviceNumbers splits a device number of this platform into its major and
+// minor number.
+func deviceNumbers(rdev uint64) (uint32, uint32) {
+	return unix.Major(rdev), unix.Minor(rdev)
+}
@@ -0,0 +1,12 @@
+// +build darwin freebsd netbsd
+
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+func (s statUnix) ctime() int64 { return s.Ctimespec.Nano() }
@@ -34,3 +34,9 @@ func (s statWin) rdev() uint64  { return 0 }
 func (s statWin) size() int64 {
 	return int64(s.FileSizeLow) | (int64(s.FileSizeHigh) << 32)
 }
+
+// Windows doesn't track inode changes, the last write time is the closest
+// equivalent.
+func (s statWin) ctime() int64 {
+	return s.LastWriteTime.Nanoseconds()
+}
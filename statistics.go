@@ -20,6 +20,7 @@ type Stats struct {
 	StorageSize uint64 `json:"stored_size"`
 	Transferred uint64 `json:"transferred"`
 	Errors      uint64 `json:"errors"`
+	Skipped     uint64 `json:"skipped"`
 }
 
 // Add accumulates other into s.
@@ -31,6 +32,7 @@ func (s *Stats) Add(other Stats) {
 	s.StorageSize += other.StorageSize
 	s.Transferred += other.Transferred
 	s.Errors += other.Errors
+	s.Skipped += other.Skipped
 }
 
 // SizeToString prettifies sizes.
@@ -59,6 +61,11 @@ func SizeToString(size uint64) (str string) {
 
 // String returns human-readable Stats.
 func (s Stats) String() string {
-	return fmt.Sprintf("%d files, %d dirs, %d symlinks, %d errors, %v Original Size, %v Storage Size",
-		s.Files, s.Dirs, s.SymLinks, s.Errors, SizeToString(s.Size), SizeToString(s.StorageSize))
+	skipped := ""
+	if s.Skipped > 0 {
+		skipped = fmt.Sprintf(", %d skipped", s.Skipped)
+	}
+
+	return fmt.Sprintf("%d files, %d dirs, %d symlinks, %d errors%s, %v Original Size, %v Storage Size",
+		s.Files, s.Dirs, s.SymLinks, s.Errors, skipped, SizeToString(s.Size), SizeToString(s.StorageSize))
 }
@@ -21,6 +21,7 @@ func TestStatisticsAdd(t *testing.T) {
 			StorageSize: i,
 			Transferred: i,
 			Errors:      i,
+			Skipped:     i,
 		}
 
 		s = append(s, v)
@@ -9,7 +9,9 @@ package amazons3
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -57,6 +59,25 @@ func (backend *AmazonS3StorageBackend) ReadFile(path string) ([]byte, error) {
 	return resultBytes, nil
 }
 
+// ReadFileRange reads length bytes at offset of a file from the backend.
+func (backend *AmazonS3StorageBackend) ReadFileRange(path string, offset, length uint64) ([]byte, error) {
+	if length == 0 {
+		return []byte{}, nil
+	}
+
+	result, err := backend.service.GetObject(&s3.GetObjectInput{
+		Key:    aws.String(path),
+		Bucket: aws.String(backend.bucketName),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer result.Body.Close()
+
+	return ioutil.ReadAll(result.Body)
+}
+
 // WriteFile writes a file to the storage backend.
 func (backend *AmazonS3StorageBackend) WriteFile(path string, data []byte) (uint64, error) {
 	databuf := bytes.NewReader(data)
@@ -90,6 +111,34 @@ func (backend *AmazonS3StorageBackend) DeleteFile(path string) error {
 	return err
 }
 
+// ReadDir returns the names of all objects within a folder.
+func (backend *AmazonS3StorageBackend) ReadDir(path string) ([]string, error) {
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(backend.bucketName),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}
+
+	var names []string
+	for {
+		out, err := backend.service.ListObjectsV2(input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range out.Contents {
+			names = append(names, strings.TrimPrefix(*obj.Key, prefix))
+		}
+		if out.IsTruncated == nil || !*out.IsTruncated {
+			break
+		}
+		input.ContinuationToken = out.NextContinuationToken
+	}
+
+	return names, nil
+}
+
 // Close closes the StorageFileSystem.
 func (*AmazonS3StorageBackend) Close() error {
 	// Close is meaningless for S3 since it's using a RESTful API which is
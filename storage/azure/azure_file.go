@@ -192,6 +192,29 @@ func (backend *AzureFileStorage) WriteFile(p string, data []byte) (size uint64,
 	return uint64(len(data)), nil
 }
 
+// ReadDir returns the names of all files in a directory on Azure file storage.
+func (backend *AzureFileStorage) ReadDir(p string) ([]string, error) {
+	u := backend.endpoint
+	u.Path = path.Join(u.Path, p)
+
+	directoryUrl := azfile.NewDirectoryURL(u, azfile.NewPipeline(&backend.credential, azfile.PipelineOptions{}))
+
+	var names []string
+	for marker := (azfile.Marker{}); marker.NotDone(); {
+		resp, err := directoryUrl.ListFilesAndDirectoriesSegment(context.Background(), marker, azfile.ListFilesAndDirectoriesOptions{})
+		if err != nil {
+			return nil, err
+		}
+		marker = resp.NextMarker
+
+		for _, file := range resp.FileItems {
+			names = append(names, file.Name)
+		}
+	}
+
+	return names, nil
+}
+
 // DeleteFile deletes a file from Azure file storage.
 func (backend *AzureFileStorage) DeleteFile(p string) error {
 	u := backend.endpoint
@@ -26,6 +26,7 @@ type BackblazeStorage struct {
 	url            url.URL
 	repositoryFile string
 	chunkIndexFile string
+	lockPrefix     string
 	Bucket         *backblaze.Bucket
 	backblaze      *backblaze.B2
 }
@@ -75,6 +76,7 @@ func (*BackblazeStorage) NewBackend(URL url.URL) (knoxite.Backend, error) {
 		url:            URL,
 		repositoryFile: bucketPrefix[1] + "-repository",
 		chunkIndexFile: bucketPrefix[1] + "-chunkindex",
+		lockPrefix:     bucketPrefix[1] + "-lock-",
 		Bucket:         bucket,
 		backblaze:      cl,
 	}, nil
@@ -233,6 +235,63 @@ func (backend *BackblazeStorage) SaveRepository(data []byte) error {
 	return err
 }
 
+// ListLocks returns the IDs of all locks.
+func (backend *BackblazeStorage) ListLocks() ([]string, error) {
+	var ids []string
+	start := ""
+	for {
+		list, err := backend.Bucket.ListFileNamesWithPrefix(start, 1000, backend.lockPrefix, "")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range list.Files {
+			ids = append(ids, strings.TrimPrefix(v.Name, backend.lockPrefix))
+		}
+		if list.NextFileName == "" {
+			break
+		}
+		start = list.NextFileName
+	}
+
+	return ids, nil
+}
+
+// LoadLock loads a lock.
+func (backend *BackblazeStorage) LoadLock(id string) ([]byte, error) {
+	_, obj, err := backend.Bucket.DownloadFileByName(backend.lockPrefix + id)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	return ioutil.ReadAll(obj)
+}
+
+// SaveLock stores a lock.
+func (backend *BackblazeStorage) SaveLock(id string, data []byte) error {
+	buf := bytes.NewBuffer(data)
+	metadata := make(map[string]string)
+	_, err := backend.upload(backend.lockPrefix+id, metadata, buf)
+	return err
+}
+
+// DeleteLock deletes a lock.
+func (backend *BackblazeStorage) DeleteLock(id string) error {
+	fileName := backend.lockPrefix + id
+
+	files, err := backend.findLatestFileVersion(fileName)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return knoxite.ErrDeleteLockFailed
+	}
+
+	_, err = backend.Bucket.DeleteFileVersion(fileName, files[0].ID)
+	return err
+}
+
 func (backend *BackblazeStorage) findLatestFileVersion(fileName string) ([]backblaze.FileStatus, error) {
 	var files []backblaze.FileStatus
 
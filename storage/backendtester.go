@@ -207,3 +207,45 @@ func (b *BackendTest) DeleteChunkTest(t *testing.T) {
 		t.Errorf("%s: Expected error, got nil", b.Description)
 	}
 }
+
+func (b *BackendTest) LockTest(t *testing.T) {
+	rnddata := make([]byte, 256)
+	rand.Read(rnddata)
+	id := RandomSuffix()
+
+	err := b.Backend.SaveLock(id, rnddata)
+	if err != nil {
+		t.Errorf("%s: %s", b.Description, err)
+	}
+
+	ids, err := b.Backend.ListLocks()
+	if err != nil {
+		t.Errorf("%s: %s", b.Description, err)
+	}
+	found := false
+	for _, l := range ids {
+		if l == id {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("%s: Lock %s not found in %v", b.Description, id, ids)
+	}
+
+	data, err := b.Backend.LoadLock(id)
+	if err != nil {
+		t.Errorf("%s: %s", b.Description, err)
+	}
+	if !reflect.DeepEqual(data, rnddata) {
+		t.Errorf("%s: Data mismatch", b.Description)
+	}
+
+	err = b.Backend.DeleteLock(id)
+	if err != nil {
+		t.Errorf("%s: %s", b.Description, err)
+	}
+	_, err = b.Backend.LoadLock(id)
+	if err == nil {
+		t.Errorf("%s: Expected error, got nil", b.Description)
+	}
+}
@@ -109,6 +109,20 @@ func (backend *DropboxStorage) WriteFile(path string, data []byte) (size uint64,
 	return uint64(len(data)), backend.dropy.Upload(path, bytes.NewReader(data))
 }
 
+// ReadDir returns the names of all files in a directory on dropbox.
+func (backend *DropboxStorage) ReadDir(path string) ([]string, error) {
+	files, err := backend.dropy.ListFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	return names, nil
+}
+
 // DeleteFile deletes a file from dropbox.
 func (backend *DropboxStorage) DeleteFile(path string) error {
 	return backend.dropy.Delete(path)
@@ -17,6 +17,7 @@ import (
 	"net/url"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jlaffaye/ftp"
@@ -30,6 +31,9 @@ type FTPStorage struct {
 	ftp   *ftp.ServerConn
 	login bool
 	knoxite.StorageFilesystem
+
+	// a single control connection can't handle concurrent requests
+	mut sync.Mutex
 }
 
 // Error declarations.
@@ -114,6 +118,9 @@ func (backend *FTPStorage) AvailableSpace() (uint64, error) {
 
 // CreatePath creates a dir including all its parent dirs, when required.
 func (backend *FTPStorage) CreatePath(path string) error {
+	backend.mut.Lock()
+	defer backend.mut.Unlock()
+
 	slicedPath := strings.Split(path, "/")
 	for i := range slicedPath {
 		if i == 0 {
@@ -128,12 +135,18 @@ func (backend *FTPStorage) CreatePath(path string) error {
 
 // Stat returns the size of a file on ftp.
 func (backend *FTPStorage) Stat(path string) (uint64, error) {
+	backend.mut.Lock()
+	defer backend.mut.Unlock()
+
 	size, err := backend.ftp.FileSize(path)
 	return uint64(size), err
 }
 
 // ReadFile reads a file from ftp.
 func (backend *FTPStorage) ReadFile(path string) ([]byte, error) {
+	backend.mut.Lock()
+	defer backend.mut.Unlock()
+
 	file, err := backend.ftp.Retr(path)
 	if err != nil {
 		return nil, err
@@ -145,15 +158,40 @@ func (backend *FTPStorage) ReadFile(path string) ([]byte, error) {
 
 // WriteFile writes file to ftp.
 func (backend *FTPStorage) WriteFile(path string, data []byte) (size uint64, err error) {
+	backend.mut.Lock()
+	defer backend.mut.Unlock()
+
 	err = backend.ftp.Stor(path, bytes.NewReader(data))
 	return uint64(len(data)), err
 }
 
 // DeleteFile deletes a file from ftp.
 func (backend *FTPStorage) DeleteFile(path string) error {
+	backend.mut.Lock()
+	defer backend.mut.Unlock()
+
 	return backend.ftp.Delete(path)
 }
 
+// ReadDir returns the names of all files in a directory on ftp.
+func (backend *FTPStorage) ReadDir(path string) ([]string, error) {
+	backend.mut.Lock()
+	defer backend.mut.Unlock()
+
+	list, err := backend.ftp.List(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, l := range list {
+		if l.Type == ftp.EntryTypeFile {
+			names = append(names, filepath.Base(l.Name))
+		}
+	}
+	return names, nil
+}
+
 // DeletePath deletes a directory including all its content from ftp.
 func (backend *FTPStorage) DeletePath(path string) error {
 	fmt.Println("Deleting path", path)
@@ -17,6 +17,7 @@ import (
 	"strings"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 
 	"github.com/knoxite/knoxite"
@@ -189,3 +190,30 @@ func (backend *GoogleCloudStorage) DeleteFile(path string) error {
 	}
 	return nil
 }
+
+// ReadDir returns the names of all objects within a folder.
+func (backend *GoogleCloudStorage) ReadDir(path string) ([]string, error) {
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	it := backend.bucket.Objects(context.Background(), &storage.Query{
+		Prefix:    prefix,
+		Delimiter: "/",
+	})
+
+	var names []string
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// sub-folders only come with a prefix
+		if attrs.Name != "" {
+			names = append(names, strings.TrimPrefix(attrs.Name, prefix))
+		}
+	}
+
+	return names, nil
+}
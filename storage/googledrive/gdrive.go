@@ -103,3 +103,23 @@ func (backend *GoogleDriveStorage) LoadRepository() ([]byte, error) {
 func (backend *GoogleDriveStorage) SaveRepository(data []byte) error {
 	return knoxite.ErrStoreRepositoryFailed
 }
+
+// ListLocks returns the IDs of all locks.
+func (backend *GoogleDriveStorage) ListLocks() ([]string, error) {
+	return []string{}, knoxite.ErrLoadLockFailed
+}
+
+// LoadLock loads a lock.
+func (backend *GoogleDriveStorage) LoadLock(id string) ([]byte, error) {
+	return []byte{}, knoxite.ErrLoadLockFailed
+}
+
+// SaveLock stores a lock.
+func (backend *GoogleDriveStorage) SaveLock(id string, data []byte) error {
+	return knoxite.ErrStoreLockFailed
+}
+
+// DeleteLock deletes a lock.
+func (backend *GoogleDriveStorage) DeleteLock(id string) error {
+	return knoxite.ErrDeleteLockFailed
+}
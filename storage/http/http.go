@@ -16,6 +16,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 
 	"github.com/knoxite/knoxite"
 )
@@ -269,3 +270,88 @@ func (backend *HTTPStorage) SaveRepository(data []byte) error {
 	//	fmt.Printf("Uploaded repository: %d bytes\n", len(data))
 	return err
 }
+
+// ListLocks returns the IDs of all locks.
+func (backend *HTTPStorage) ListLocks() ([]string, error) {
+	res, err := http.Get(backend.URL.String() + "/locks")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, knoxite.ErrLoadLockFailed
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// one lock ID per line
+	return strings.Fields(string(b)), nil
+}
+
+// LoadLock loads a lock.
+func (backend *HTTPStorage) LoadLock(id string) ([]byte, error) {
+	res, err := http.Get(backend.URL.String() + "/lock/" + id)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, knoxite.ErrLoadLockFailed
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// SaveLock stores a lock.
+func (backend *HTTPStorage) SaveLock(id string, data []byte) error {
+	bodyBuf := &bytes.Buffer{}
+	bodyWriter := multipart.NewWriter(bodyBuf)
+
+	fileWriter, err := bodyWriter.CreateFormFile("uploadfile", id)
+	if err != nil {
+		return err
+	}
+
+	_, err = fileWriter.Write(data)
+	if err != nil {
+		return err
+	}
+
+	contentType := bodyWriter.FormDataContentType()
+	bodyWriter.Close()
+
+	resp, err := http.Post(backend.URL.String()+"/lock", contentType, bodyBuf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return knoxite.ErrStoreLockFailed
+	}
+	return nil
+}
+
+// DeleteLock deletes a lock.
+func (backend *HTTPStorage) DeleteLock(id string) error {
+	req, err := http.NewRequest(http.MethodDelete, backend.URL.String()+"/lock/"+id, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return knoxite.ErrDeleteLockFailed
+	}
+	return nil
+}
@@ -200,6 +200,27 @@ func (backend *MegaStorage) DeleteFile(path string) error {
 	return backend.mega.Delete(fileToDelete, true)
 }
 
+// ReadDir returns the names of all files in a directory on mega.
+func (backend *MegaStorage) ReadDir(path string) ([]string, error) {
+	dir, err := backend.getNodeFromPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := backend.mega.FS.GetChildren(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, node := range nodes {
+		if node.GetType() == mega.FILE {
+			names = append(names, node.GetName())
+		}
+	}
+	return names, nil
+}
+
 // getNodeFromPath() returns the last node in a path on mega. It may be a file or a directory node.
 func (backend *MegaStorage) getNodeFromPath(path string) (*mega.Node, error) {
 	path = strings.TrimPrefix(path, "/")
@@ -84,3 +84,7 @@ func TestStorageStoreChunk(t *testing.T) {
 func TestStorageDeleteChunk(t *testing.T) {
 	backendTest.DeleteChunkTest(t)
 }
+
+func TestStorageLock(t *testing.T) {
+	backendTest.LockTest(t)
+}
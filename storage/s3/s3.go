@@ -32,6 +32,9 @@ type S3Storage struct {
 	client           *minio.Client
 }
 
+// locks are stored alongside the repository file.
+const lockPrefix = "locks/"
+
 func init() {
 	knoxite.RegisterStorageBackend(&S3Storage{})
 }
@@ -122,6 +125,26 @@ func (backend *S3Storage) LoadChunk(shasum string, part, totalParts uint) ([]byt
 	return ioutil.ReadAll(obj)
 }
 
+// LoadChunkRange loads length bytes at offset of a single Chunk from network.
+func (backend *S3Storage) LoadChunkRange(shasum string, part, totalParts uint, offset, length uint64) ([]byte, error) {
+	if length == 0 {
+		return []byte{}, nil
+	}
+
+	fileName := shasum + "." + strconv.FormatUint(uint64(part), 10) + "_" + strconv.FormatUint(uint64(totalParts), 10)
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetRange(int64(offset), int64(offset+length-1)); err != nil {
+		return nil, err
+	}
+	obj, err := backend.client.GetObject(backend.chunkBucket, fileName, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	return ioutil.ReadAll(obj)
+}
+
 // StoreChunk stores a single Chunk on network.
 func (backend *S3Storage) StoreChunk(shasum string, part, totalParts uint, data []byte) (size uint64, err error) {
 	fileName := shasum + "." + strconv.FormatUint(uint64(part), 10) + "_" + strconv.FormatUint(uint64(totalParts), 10)
@@ -245,3 +268,42 @@ func (backend *S3Storage) SaveRepository(data []byte) error {
 	_, err := backend.client.PutObject(backend.repositoryBucket, knoxite.RepoFilename, buf, int64(buf.Len()), minio.PutObjectOptions{ContentType: "application/octet-stream"})
 	return err
 }
+
+// ListLocks returns the IDs of all locks.
+func (backend *S3Storage) ListLocks() ([]string, error) {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	var ids []string
+	for obj := range backend.client.ListObjects(backend.repositoryBucket, lockPrefix, false, doneCh) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		ids = append(ids, strings.TrimPrefix(obj.Key, lockPrefix))
+	}
+
+	return ids, nil
+}
+
+// LoadLock loads a lock.
+func (backend *S3Storage) LoadLock(id string) ([]byte, error) {
+	obj, err := backend.client.GetObject(backend.repositoryBucket, lockPrefix+id, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	return ioutil.ReadAll(obj)
+}
+
+// SaveLock stores a lock.
+func (backend *S3Storage) SaveLock(id string, data []byte) error {
+	buf := bytes.NewBuffer(data)
+	_, err := backend.client.PutObject(backend.repositoryBucket, lockPrefix+id, buf, int64(buf.Len()), minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	return err
+}
+
+// DeleteLock deletes a lock.
+func (backend *S3Storage) DeleteLock(id string) error {
+	return backend.client.RemoveObject(backend.repositoryBucket, lockPrefix+id)
+}
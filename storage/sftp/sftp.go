@@ -155,6 +155,21 @@ func (backend *SFTPStorage) DeletePath(path string) error {
 	return nil
 }
 
+func (backend *SFTPStorage) ReadDir(path string) ([]string, error) {
+	files, err := backend.sftp.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() {
+			names = append(names, file.Name())
+		}
+	}
+	return names, nil
+}
+
 func (backend *SFTPStorage) ReadFile(path string) ([]byte, error) {
 	file, err := backend.sftp.Open(path)
 	if err != nil {
@@ -165,6 +180,18 @@ func (backend *SFTPStorage) ReadFile(path string) ([]byte, error) {
 	return ioutil.ReadAll(file)
 }
 
+func (backend *SFTPStorage) ReadFileRange(path string, offset, length uint64) ([]byte, error) {
+	file, err := backend.sftp.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	b := make([]byte, length)
+	_, err = file.ReadAt(b, int64(offset))
+	return b, err
+}
+
 func (backend *SFTPStorage) WriteFile(path string, data []byte) (size uint64, err error) {
 	file, err := backend.sftp.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
 	if err != nil {
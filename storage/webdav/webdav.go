@@ -105,6 +105,22 @@ func (backend *WebDAVStorage) DeletePath(path string) error {
 	return backend.Client.Remove(path)
 }
 
+// ReadDir returns the names of all files in a directory.
+func (backend *WebDAVStorage) ReadDir(path string) ([]string, error) {
+	files, err := backend.Client.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() {
+			names = append(names, file.Name())
+		}
+	}
+	return names, nil
+}
+
 // ReadFile reads the file.
 func (backend *WebDAVStorage) ReadFile(path string) ([]byte, error) {
 	return backend.Client.Read(path)
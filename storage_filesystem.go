@@ -10,6 +10,7 @@ package knoxite
 import (
 	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 const (
@@ -19,6 +20,7 @@ const (
 	ChunkIndexFilename = "index"
 	chunksDirname      = "chunks"
 	snapshotsDirname   = "snapshots"
+	locksDirname       = "locks"
 )
 
 // BackendFilesystem is used to store and access data on a filesytem based backend.
@@ -33,6 +35,22 @@ type BackendFilesystem interface {
 	WriteFile(path string, data []byte) (uint64, error)
 	// DeleteFile deletes a file from disk
 	DeleteFile(path string) error
+	// ReadDir returns the names of all files in a directory
+	ReadDir(path string) ([]string, error)
+}
+
+// BackendFilesystemRangeReader can be implemented by a BackendFilesystem
+// which is able to read a range of a file, without reading it entirely.
+type BackendFilesystemRangeReader interface {
+	// ReadFileRange reads length bytes at offset of a file
+	ReadFileRange(path string, offset, length uint64) ([]byte, error)
+}
+
+// BackendFilesystemWalker can be implemented by a BackendFilesystem which is
+// able to list all files below a directory.
+type BackendFilesystemWalker interface {
+	// WalkFiles calls fn with the path and size of every file below path
+	WalkFiles(path string, fn func(path string, size uint64) error) error
 }
 
 // StorageFilesystem is bridging a BackendFilesystem to a Backend interface.
@@ -42,6 +60,7 @@ type StorageFilesystem struct {
 	snapshotPath   string
 	chunkIndexPath string
 	repositoryPath string
+	lockPath       string
 
 	storage *BackendFilesystem
 }
@@ -54,6 +73,7 @@ func NewStorageFilesystem(path string, storage BackendFilesystem) (StorageFilesy
 		snapshotPath:   filepath.Join(path, snapshotsDirname),
 		chunkIndexPath: filepath.Join(path, chunksDirname, ChunkIndexFilename),
 		repositoryPath: filepath.Join(path, RepoFilename),
+		lockPath:       filepath.Join(path, locksDirname),
 		storage:        &storage,
 	}
 	return s, nil
@@ -67,6 +87,22 @@ func (backend StorageFilesystem) LoadChunk(shasum string, part, totalParts uint)
 	return (*backend.storage).ReadFile(fileName)
 }
 
+// LoadChunkRange loads length bytes at offset of a single Chunk from disk.
+func (backend StorageFilesystem) LoadChunkRange(shasum string, part, totalParts uint, offset, length uint64) ([]byte, error) {
+	path := filepath.Join(backend.chunkPath, SubDirForChunk(shasum))
+	fileName := filepath.Join(path, shasum+"."+strconv.FormatUint(uint64(part), 10)+"_"+strconv.FormatUint(uint64(totalParts), 10))
+
+	if rr, ok := (*backend.storage).(BackendFilesystemRangeReader); ok {
+		return rr.ReadFileRange(fileName, offset, length)
+	}
+
+	b, err := (*backend.storage).ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return sliceRange(b, offset, length)
+}
+
 // StoreChunk stores a single Chunk on disk.
 func (backend StorageFilesystem) StoreChunk(shasum string, part, totalParts uint, data []byte) (size uint64, err error) {
 	path := filepath.Join(backend.chunkPath, SubDirForChunk(shasum))
@@ -121,7 +157,7 @@ func (backend StorageFilesystem) InitRepository() error {
 		// Repo seems to already exist
 		return ErrRepositoryExists
 	}
-	paths := []string{backend.chunkPath, backend.snapshotPath}
+	paths := []string{backend.chunkPath, backend.snapshotPath, backend.lockPath}
 	for _, path := range paths {
 		if _, err := (*backend.storage).Stat(path); err == nil {
 			return ErrRepositoryExists
@@ -151,6 +187,81 @@ func (backend StorageFilesystem) SaveRepository(b []byte) error {
 	return err
 }
 
+// ListLocks returns the IDs of all locks.
+func (backend StorageFilesystem) ListLocks() ([]string, error) {
+	// repositories created by older versions don't have a locks dir yet
+	err := (*backend.storage).CreatePath(backend.lockPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return (*backend.storage).ReadDir(backend.lockPath)
+}
+
+// LoadLock loads a lock.
+func (backend StorageFilesystem) LoadLock(id string) ([]byte, error) {
+	return (*backend.storage).ReadFile(filepath.Join(backend.lockPath, id))
+}
+
+// SaveLock stores a lock.
+func (backend StorageFilesystem) SaveLock(id string, b []byte) error {
+	err := (*backend.storage).CreatePath(backend.lockPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = (*backend.storage).WriteFile(filepath.Join(backend.lockPath, id), b)
+	return err
+}
+
+// DeleteLock deletes a lock.
+func (backend StorageFilesystem) DeleteLock(id string) error {
+	return (*backend.storage).DeleteFile(filepath.Join(backend.lockPath, id))
+}
+
+// ListChunks returns all chunk parts and pack files stored on disk.
+func (backend StorageFilesystem) ListChunks() ([]StoredChunk, error) {
+	w, ok := (*backend.storage).(BackendFilesystemWalker)
+	if !ok {
+		return nil, ErrChunkListingUnsupported
+	}
+
+	var chunks []StoredChunk
+	err := w.WalkFiles(backend.chunkPath, func(path string, size uint64) error {
+		// ignores the chunk-index and everything else not named like a chunk
+		if c, ok := parseChunkFilename(filepath.Base(path)); ok {
+			c.Size = size
+			chunks = append(chunks, c)
+		}
+		return nil
+	})
+	return chunks, err
+}
+
+// parseChunkFilename parses file names of the form hash.part_totalParts.
+func parseChunkFilename(name string) (StoredChunk, bool) {
+	dot := strings.LastIndex(name, ".")
+	sep := strings.LastIndex(name, "_")
+	if dot <= 0 || sep < dot {
+		return StoredChunk{}, false
+	}
+
+	part, err := strconv.ParseUint(name[dot+1:sep], 10, 32)
+	if err != nil {
+		return StoredChunk{}, false
+	}
+	totalParts, err := strconv.ParseUint(name[sep+1:], 10, 32)
+	if err != nil {
+		return StoredChunk{}, false
+	}
+
+	return StoredChunk{
+		Hash:       name[:dot],
+		Part:       uint(part),
+		TotalParts: uint(totalParts),
+	}, true
+}
+
 // SubDirForChunk files a chunk into a subdir, based on the chunks name.
 func SubDirForChunk(id string) string {
 	return filepath.Join(id[0:2], id[2:4])
@@ -11,6 +11,7 @@ import (
 	"io/ioutil"
 	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 )
@@ -77,6 +78,19 @@ func (backend StorageLocal) ReadFile(path string) ([]byte, error) {
 	return b, err
 }
 
+// ReadFileRange reads length bytes at offset of a file on disk.
+func (backend StorageLocal) ReadFileRange(path string, offset, length uint64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := make([]byte, length)
+	_, err = f.ReadAt(b, int64(offset))
+	return b, err
+}
+
 // WriteFile writes a file to disk.
 func (backend StorageLocal) WriteFile(path string, data []byte) (size uint64, err error) {
 	err = ioutil.WriteFile(path, data, 0600)
@@ -88,3 +102,32 @@ func (backend StorageLocal) DeleteFile(path string) error {
 	// fmt.Println("Deleting:", path)
 	return os.Remove(path)
 }
+
+// ReadDir returns the names of all files in a directory.
+func (backend StorageLocal) ReadDir(path string) ([]string, error) {
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+// WalkFiles calls fn with the path and size of every file below path.
+func (backend StorageLocal) WalkFiles(path string, fn func(path string, size uint64) error) error {
+	return filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return fn(path, uint64(info.Size()))
+	})
+}
@@ -7,7 +7,11 @@
 
 package knoxite
 
-import uuid "github.com/nu7hatch/gouuid"
+import (
+	"time"
+
+	uuid "github.com/nu7hatch/gouuid"
+)
 
 // A Volume contains various snapshots.
 type Volume struct {
@@ -15,6 +19,11 @@ type Volume struct {
 	Name        string   `json:"name"`
 	Description string   `json:"description"`
 	Snapshots   []string `json:"snapshots"`
+
+	// Dates maps snapshot IDs to their creation date, so snapshots can be
+	// found by date without loading them. Repositories before version 8
+	// lacked them, migrating fills them in
+	Dates map[string]time.Time `json:"dates,omitempty"`
 }
 
 // NewVolume creates a new volume.
@@ -39,6 +48,24 @@ func (v *Volume) AddSnapshot(id string) error {
 	return nil
 }
 
+// AddSnapshotWithDate adds a snapshot to a volume and remembers its date, so
+// it can be found by date without loading it.
+func (v *Volume) AddSnapshotWithDate(snapshot *Snapshot) error {
+	err := v.AddSnapshot(snapshot.ID)
+	if err != nil {
+		return err
+	}
+	v.setSnapshotDate(snapshot.ID, snapshot.Date)
+	return nil
+}
+
+func (v *Volume) setSnapshotDate(id string, date time.Time) {
+	if v.Dates == nil {
+		v.Dates = make(map[string]time.Time)
+	}
+	v.Dates[id] = date
+}
+
 // RemoveSnapshot removes a snapshot from a volume.
 func (v *Volume) RemoveSnapshot(id string) error {
 	snapshots := []string{}
@@ -57,6 +84,7 @@ func (v *Volume) RemoveSnapshot(id string) error {
 	}
 
 	v.Snapshots = snapshots
+	delete(v.Dates, id)
 	return nil
 }
 
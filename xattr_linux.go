@@ -0,0 +1,102 @@
+// +build linux
+
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXAttrs returns the extended attributes of path, without following
+// symlinks. POSIX ACLs, SELinux labels and file capabilities are stored as
+// extended attributes, too.
+func readXAttrs(path string) (map[string][]byte, error) {
+	var buf []byte
+	for {
+		size, err := unix.Llistxattr(path, nil)
+		if err != nil {
+			if errors.Is(err, unix.ENOTSUP) {
+				return nil, nil
+			}
+			return nil, &os.PathError{Op: "llistxattr", Path: path, Err: err}
+		}
+		if size == 0 {
+			return nil, nil
+		}
+
+		buf = make([]byte, size)
+		size, err = unix.Llistxattr(path, buf)
+		if errors.Is(err, unix.ERANGE) {
+			// attributes got added in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "llistxattr", Path: path, Err: err}
+		}
+		buf = buf[:size]
+		break
+	}
+
+	attrs := make(map[string][]byte)
+	for _, name := range strings.Split(string(buf), "\x00") {
+		if name == "" {
+			continue
+		}
+
+		value, err := lgetxattr(path, name)
+		if errors.Is(err, unix.ENODATA) {
+			// attribute got removed in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "lgetxattr", Path: path, Err: err}
+		}
+		attrs[name] = value
+	}
+
+	return attrs, nil
+}
+
+func lgetxattr(path, name string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size)
+		size, err = unix.Lgetxattr(path, name, buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		return buf[:size], err
+	}
+}
+
+// writeXAttrs sets the extended attributes of path, without following
+// symlinks. Attributes which aren't supported by the filesystem or which we
+// lack the privileges for only cause a warning.
+func writeXAttrs(path string, attrs map[string][]byte) error {
+	for name, value := range attrs {
+		err := unix.Lsetxattr(path, name, value, 0)
+		if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EPERM) {
+			log.Warnf("Could not restore extended attribute %s of %s: %v", name, path, err)
+			continue
+		}
+		if err != nil {
+			return &os.PathError{Op: "lsetxattr", Path: path, Err: err}
+		}
+	}
+
+	return nil
+}
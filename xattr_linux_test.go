@@ -0,0 +1,106 @@
+// +build linux
+
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestXAttrs(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	sourcedir, err := ioutil.TempDir("", "knoxite.source")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for source: %s", err)
+		return
+	}
+	defer os.RemoveAll(sourcedir)
+
+	_ = ioutil.WriteFile(filepath.Join(sourcedir, "file"), []byte("content"), 0644)
+	err = unix.Setxattr(filepath.Join(sourcedir, "file"), "user.knoxite", []byte("value"), 0)
+	if errors.Is(err, unix.ENOTSUP) {
+		t.Skip("Filesystem doesn't support extended attributes")
+	}
+	if err != nil {
+		t.Errorf("Failed setting extended attribute: %s", err)
+		return
+	}
+
+	// archive paths are relative to the working dir
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Failed getting working dir: %s", err)
+		return
+	}
+	err = os.Chdir(sourcedir)
+	if err != nil {
+		t.Errorf("Failed changing working dir: %s", err)
+		return
+	}
+	defer func() {
+		_ = os.Chdir(wd)
+	}()
+
+	r, _ := NewRepository(dir, testPassword)
+	index, _ := OpenChunkIndex(&r)
+	vol, _ := NewVolume("test", "")
+	_ = r.AddVolume(vol)
+
+	snapshot, _ := NewSnapshot("test_snapshot")
+	for p := range snapshot.Add(r, &index, StoreOptions{CWD: sourcedir, Paths: []string{"file"}, XAttrs: true}) {
+		if p.Error != nil {
+			t.Errorf("Failed adding to snapshot: %s", p.Error)
+		}
+	}
+	if v := string(snapshot.Archives["file"].XAttrs["user.knoxite"]); v != "value" {
+		t.Errorf("Expected extended attribute to be stored, got %q", v)
+	}
+
+	for _, xattrs := range []bool{true, false} {
+		targetdir, err := ioutil.TempDir("", "knoxite.target")
+		if err != nil {
+			t.Errorf("Failed creating temporary dir for restore: %s", err)
+			return
+		}
+		defer os.RemoveAll(targetdir)
+
+		progress, err := DecodeSnapshot(r, snapshot, targetdir, RestoreOptions{XAttrs: xattrs})
+		if err != nil {
+			t.Errorf("Failed restoring snapshot: %s", err)
+			return
+		}
+		for p := range progress {
+			if p.Error != nil {
+				t.Errorf("Failed restoring snapshot: %s", p.Error)
+			}
+		}
+
+		attrs, err := readXAttrs(filepath.Join(targetdir, "file"))
+		if err != nil {
+			t.Errorf("Failed reading extended attributes: %s", err)
+			continue
+		}
+		if restored := string(attrs["user.knoxite"]) == "value"; restored != xattrs {
+			t.Errorf("Expected extended attribute to be restored: %v, got %v", xattrs, restored)
+		}
+	}
+}
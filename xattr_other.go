@@ -0,0 +1,23 @@
+// +build !linux
+
+/*
+ * knoxite
+ *     Copyright (c) 2021, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE
+ */
+
+package knoxite
+
+// readXAttrs is a no-op on platforms without extended attribute support.
+func readXAttrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// writeXAttrs only warns on platforms without extended attribute support.
+func writeXAttrs(path string, attrs map[string][]byte) error {
+	if len(attrs) > 0 {
+		log.Warnf("Could not restore extended attributes of %s: not supported on this platform", path)
+	}
+	return nil
+}